@@ -17,32 +17,110 @@ limitations under the License.
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	s "strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
-var i int
+// schemaVersion - version written on every stored Entity, Product and Txn* record.
+// Records written before versioning read back as version 0 and are treated as 1.
+const schemaVersion = 2
+
+// migrationCollections - key collections whose records migrate can rewrite
+var migrationCollections = []string{"Entities", "Products", "TxnTopup", "TxnGoods", "TxnTransfer", "TxnEncash", "TxnBatch", "TxnAdjustment",
+	"Holds", "Disputes", "CreditLines", "FeeRules", "TaxRules", "Receipts", "Aliases", "Journal", "FraudRules", "FraudAlerts",
+	"PauseProposals", "PauseEvents", "ParamProposals", "GiftCards", "RedemptionItems", "TxnRedemption"}
+
+// adjustmentReasons - reason codes accepted by adjustBalance
+var adjustmentReasons = []string{"CORRECTION", "GOODWILL", "CHARGEBACK", "FRAUD", "MIGRATION"}
+
+// Error codes returned in the code of a ChaincodeError. Clients match on these,
+// so existing codes must not be renamed.
+const (
+	codeBadArgument          = "BAD_ARGUMENT"
+	codeArgumentCount        = "ARGUMENT_COUNT"
+	codeUnknownFunction      = "UNKNOWN_FUNCTION"
+	codeEntityNotFound       = "ENTITY_NOT_FOUND"
+	codeNotFound             = "NOT_FOUND"
+	codeInsufficientPoints   = "INSUFFICIENT_POINTS"
+	codeInsufficientBalance  = "INSUFFICIENT_BALANCE"
+	codeInsufficientQuantity = "INSUFFICIENT_QUANTITY"
+	codeInsufficientBudget   = "INSUFFICIENT_BUDGET"
+	codeAssetTransferFailed  = "ASSET_TRANSFER_FAILED"
+	codeNotAuthorized        = "NOT_AUTHORIZED"
+	codeInvalidState         = "INVALID_STATE"
+	codeLedger               = "LEDGER_ERROR"
+	codeCorruptRecord        = "CORRUPT_RECORD"
+	codeInternal             = "INTERNAL_ERROR"
+	codeDuplicate            = "DUPLICATE"
+	codePaused               = "PAUSED"
+)
+
+// Chart of accounts of the journal. Entities are sub-ledgers of the account of
+// their type; fee accounts collect fees under accountFees.
+const (
+	accountCustomers = "1000"
+	accountMerchants = "2000"
+	accountBanks     = "3000"
+	accountFees      = "4000"
+	accountGiftCards = "5000"
+	accountIssuance  = "8000"
+	accountOpening   = "9000"
+)
+
+// chartOfAccounts - names of the journal accounts
+var chartOfAccounts = map[string]string{
+	accountCustomers: "Customers",
+	accountMerchants: "Merchants",
+	accountBanks:     "Banks",
+	accountFees:      "Fees",
+	accountGiftCards: "Gift cards",
+	accountIssuance:  "Issuance",
+	accountOpening:   "Opening balances",
+}
+
+// journalTolerance - largest difference treated as zero when balancing the
+// journal, to absorb floating point error on balances
+const journalTolerance = 0.000001
+
+// disputeDeadline - seconds the bank has to adjudicate a dispute once it is opened
+const disputeDeadline = 30 * 24 * 60 * 60
 
 //Entity - Structure for an entity like user, merchant, bank
 type Entity struct {
-	Type    string  `json:"type"`
-	Name    string  `json:"name"`
-	Balance float64 `json:"balance"`
-	Points  int     `json:"points"`
+	ID          string   `json:"id"` // ledger key, fixed when the entity is created
+	Type        string   `json:"type"`
+	Name        string   `json:"name"` // display name, may be changed
+	Aliases     []string `json:"aliases,omitempty"`
+	Balance     float64  `json:"balance"`
+	Points      int      `json:"points"`
+	HeldBalance float64  `json:"heldBalance"` // reserved by open holds, not yet debited
+	HeldPoints  int      `json:"heldPoints"`
+	// lifetime totals used by the customer leaderboard
+	PointsEarned int     `json:"pointsEarned"`
+	Spend        float64 `json:"spend"`
+	Jurisdiction string  `json:"jurisdiction,omitempty"` // tax jurisdiction of a merchant
+	Version      int     `json:"version"`
 }
 
 //Product - Structure for products used in buy goods
 type Product struct {
-	Name   string  `json:"name"`
-	Points int     `json:"points"`
-	Amount float64 `json:"amount"`
-	Entity string  `json:"entity"`
-	Qty    int     `json:"qty"`
+	Name     string  `json:"name"`
+	Points   int     `json:"points"`
+	Amount   float64 `json:"amount"`
+	Entity   string  `json:"entity"`
+	Qty      int     `json:"qty"`
+	Reserved int     `json:"reserved"`           // part of Qty reserved by open holds
+	Category string  `json:"category,omitempty"` // tax category
+	Version  int     `json:"version"`
 }
 
 //TxnTopup - User transactions for adding points or balance
@@ -53,40 +131,1691 @@ type TxnTopup struct {
 	Time      string `json:"time"`
 	Value     string `json:"value"`
 	Asset     string `json:"asset"`
+	Version   int    `json:"version"`
 }
 
 //TxnTransfer - User transactions for transfer of points or balance
 type TxnTransfer struct {
-	Sender   string `json:"sender"`
-	Receiver string `json:"receiver"`
-	Remarks  string `json:"remarks"`
-	ID       string `json:"id"`
-	Time     string `json:"time"`
-	Value    string `json:"value"`
-	Asset    string `json:"asset"`
+	Sender     string  `json:"sender"`
+	Receiver   string  `json:"receiver"`
+	Remarks    string  `json:"remarks"`
+	ID         string  `json:"id"`
+	Time       string  `json:"time"`
+	Value      string  `json:"value"`
+	Asset      string  `json:"asset"`
+	Fee        float64 `json:"fee"` // taken from the value received, in the same asset
+	FeeAccount string  `json:"feeAccount,omitempty"`
+	Version    int     `json:"version"`
 }
 
 //TxnGoods - User transaction details for buying goods
 type TxnGoods struct {
-	Sender   string `json:"sender"`
-	Receiver string `json:"receiver"`
-	Remarks  string `json:"remarks"`
-	ID       string `json:"id"`
-	Time     string `json:"time"`
-	Value    string `json:"value"`
-	Asset    string `json:"asset"`
+	Sender     string  `json:"sender"`
+	Receiver   string  `json:"receiver"`
+	Remarks    string  `json:"remarks"`
+	ID         string  `json:"id"`
+	Time       string  `json:"time"`
+	Value      string  `json:"value"`
+	Asset      string  `json:"asset"`
+	Product    string  `json:"product"`
+	Qty        int     `json:"qty"`
+	Points     int     `json:"points"`    // points redeemed
+	Amount     float64 `json:"amount"`    // currency collected
+	Timestamp  int64   `json:"timestamp"` // seconds since epoch
+	Fee        float64 `json:"fee"`       // commission on the merchant, in the asset paid
+	FeeAccount string  `json:"feeAccount,omitempty"`
+	Version    int     `json:"version"`
 }
 
 //TxnEncash - details of requests from merchant to encash points
 type TxnEncash struct {
-	Key       string `json:"key"`
-	ID        string `json:"id"`
-	Initiator string `json:"initiator"`
-	Bank      string `json:"bank"`
-	Points    int    `json:"points"`
-	Amount    int    `json:"amount"`
-	Remarks   string `json:"remarks"`
-	Time      string `json:"time"`
+	Key        string  `json:"key"`
+	ID         string  `json:"id"`
+	Initiator  string  `json:"initiator"`
+	Bank       string  `json:"bank"`
+	Points     int     `json:"points"`
+	Amount     int     `json:"amount"`
+	Fee        float64 `json:"fee"` // taken from the amount paid to the merchant
+	FeeAccount string  `json:"feeAccount,omitempty"`
+	Remarks    string  `json:"remarks"`
+	Time       string  `json:"time"`
+	// outcome of a request settled by settleEncash
+	Status         string `json:"status,omitempty"` // pending, approved, partial or rejected
+	ApprovedPoints int    `json:"approvedPoints,omitempty"`
+	ApprovedAmount int    `json:"approvedAmount,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	Settled        string `json:"settled,omitempty"`
+	SettledTx      string `json:"settledTx,omitempty"`
+	Version        int    `json:"version"`
+}
+
+//CreditLine - how far below zero a bank lets a merchant's points or balance go
+type CreditLine struct {
+	Merchant     string  `json:"merchant"`
+	Bank         string  `json:"bank"`
+	Asset        string  `json:"asset"` // points or balance
+	Limit        float64 `json:"limit"`
+	InterestRate float64 `json:"interestRate"` // yearly percent on the amount used
+	Fee          float64 `json:"fee"`          // fee agreed for the line
+	Expiry       int64   `json:"expiry"`       // seconds since epoch
+	Status       string  `json:"status"`       // active or revoked
+	Granted      string  `json:"granted"`
+	Version      int     `json:"version"`
+}
+
+//CreditPosition - use of a merchant's credit line, returned by getCreditPosition
+type CreditPosition struct {
+	Merchant  string      `json:"merchant"`
+	Asset     string      `json:"asset"`
+	Funds     float64     `json:"funds"` // own points or balance left before the line is used
+	Used      float64     `json:"used"`
+	Available float64     `json:"available"`
+	Line      *CreditLine `json:"line,omitempty"`
+}
+
+//EncashDecision - a bank's decision on one pending encashment request
+type EncashDecision struct {
+	Request string `json:"request"` // key of the TxnEncash request
+	Action  string `json:"action"`  // approve or reject
+	Points  int    `json:"points"`  // points approved, all of the request when 0
+	Reason  string `json:"reason"`
+}
+
+//Hold - reservation of a customer's funds and product quantity for an order
+type Hold struct {
+	Key      string  `json:"key"`
+	ID       string  `json:"id"`
+	Status   string  `json:"status"` // authorized, captured, voided or expired
+	Asset    string  `json:"asset"`
+	Customer string  `json:"customer"`
+	Merchant string  `json:"merchant"`
+	Product  string  `json:"product"`
+	Qty      int     `json:"qty"`
+	Points   int     `json:"points"`
+	Amount   float64 `json:"amount"`
+	Expiry   int64   `json:"expiry"` // seconds since epoch
+	Time     string  `json:"time"`
+	Closed   string  `json:"closed"`
+	// tax priced when the hold was placed, Amount is the gross
+	Line    *ReceiptLine `json:"line,omitempty"`
+	Taxes   []TaxLine    `json:"taxes,omitempty"`
+	Version int          `json:"version"`
+}
+
+//Dispute - customer dispute against a goods purchase
+type Dispute struct {
+	Key              string   `json:"key"`
+	TxnID            string   `json:"txnId"`
+	Customer         string   `json:"customer"`
+	Merchant         string   `json:"merchant"`
+	Asset            string   `json:"asset"`
+	Value            string   `json:"value"`
+	ReasonCode       string   `json:"reasonCode"`
+	Evidence         []string `json:"evidence"`
+	Response         string   `json:"response"`
+	MerchantEvidence []string `json:"merchantEvidence"`
+	Status           string   `json:"status"` // open, responded, closed or reversed
+	Bank             string   `json:"bank"`   // bank the customer is registered with
+	Ruling           string   `json:"ruling"`
+	Deadline         int64    `json:"deadline"` // seconds since epoch
+	Opened           string   `json:"opened"`
+	Resolved         string   `json:"resolved"`
+	Version          int      `json:"version"`
+}
+
+//SalesLine - units and value of one product sold by a merchant in a period
+type SalesLine struct {
+	Period   string  `json:"period"`
+	Product  string  `json:"product"`
+	Units    int     `json:"units"`
+	Points   int     `json:"points"`
+	Currency float64 `json:"currency"`
+}
+
+//LeaderboardEntry - indexed standing of a customer
+type LeaderboardEntry struct {
+	Customer     string  `json:"customer"`
+	Points       int     `json:"points"`
+	PointsEarned int     `json:"pointsEarned"`
+	Spend        float64 `json:"spend"`
+}
+
+//MigrationReport - progress of migrate over one key collection
+type MigrationReport struct {
+	Collection string `json:"collection"`
+	Total      int    `json:"total"`
+	Start      int    `json:"start"`
+	Next       int    `json:"next"`
+	Migrated   int    `json:"migrated"` // records rewritten in this batch
+	Done       bool   `json:"done"`
+	TxID       string `json:"txId"`
+}
+
+//Supply - running totals of points and balance created and destroyed
+type Supply struct {
+	PointsMinted  int     `json:"pointsMinted"`
+	PointsBurned  int     `json:"pointsBurned"`
+	BalanceMinted float64 `json:"balanceMinted"`
+	BalanceBurned float64 `json:"balanceBurned"`
+}
+
+//Reconciliation - comparison of the supply counters with entity holdings
+type Reconciliation struct {
+	Supply             Supply  `json:"supply"`
+	Entities           int     `json:"entities"`
+	PointsOutstanding  int     `json:"pointsOutstanding"`
+	PointsExpected     int     `json:"pointsExpected"`
+	PointsDiscrepancy  int     `json:"pointsDiscrepancy"`
+	BalanceOutstanding float64 `json:"balanceOutstanding"` // includes gift card balances
+	GiftCards          int     `json:"giftCards"`
+	GiftCardBalance    float64 `json:"giftCardBalance"`
+	BalanceExpected    float64 `json:"balanceExpected"`
+	BalanceDiscrepancy float64 `json:"balanceDiscrepancy"`
+	Balanced           bool    `json:"balanced"`
+}
+
+//TxnAdjustment - audited admin correction of an entity's points or balance
+type TxnAdjustment struct {
+	ID         string `json:"id"`
+	Entity     string `json:"entity"`
+	Asset      string `json:"asset"`
+	Delta      string `json:"delta"`
+	ReasonCode string `json:"reasonCode"`
+	Note       string `json:"note"`
+	Approver   string `json:"approver"`
+	Time       string `json:"time"`
+	Version    int    `json:"version"`
+}
+
+//FeeRule - fee charged on redemptions, encashments or transfers, for every
+// merchant or for one merchant only
+type FeeRule struct {
+	Event    string  `json:"event"`    // redemption, encash or transfer
+	Merchant string  `json:"merchant"` // empty for the default of the event
+	Kind     string  `json:"kind"`     // percent or fixed
+	Rate     float64 `json:"rate"`     // percent of the value, or the fixed fee
+	Account  string  `json:"account"`  // entity the fees are paid to
+	Version  int     `json:"version"`
+}
+
+//Posting - one line of a journal entry. Credits increase what an account
+// holds, debits decrease it; issuance is debited for what is minted.
+type Posting struct {
+	Account string  `json:"account"`
+	Entity  string  `json:"entity,omitempty"` // sub-ledger, ex: the customer
+	Asset   string  `json:"asset"`
+	Debit   float64 `json:"debit"`
+	Credit  float64 `json:"credit"`
+}
+
+//JournalEntry - balanced postings of one transaction
+type JournalEntry struct {
+	TxID     string    `json:"txId"`
+	Function string    `json:"function"`
+	Time     string    `json:"time"`
+	Postings []Posting `json:"postings"`
+	Version  int       `json:"version"`
+}
+
+//TrialBalanceLine - totals of one account, or sub-ledger, for an asset
+type TrialBalanceLine struct {
+	Account string  `json:"account,omitempty"` // empty on the totals
+	Name    string  `json:"name,omitempty"`
+	Entity  string  `json:"entity,omitempty"`
+	Asset   string  `json:"asset"`
+	Debit   float64 `json:"debit"`
+	Credit  float64 `json:"credit"`
+	Balance float64 `json:"balance"` // credit less debit
+}
+
+//TrialBalance - result of getTrialBalance
+type TrialBalance struct {
+	Lines    []TrialBalanceLine `json:"lines"`
+	Totals   []TrialBalanceLine `json:"totals"` // one per asset
+	Balanced bool               `json:"balanced"`
+}
+
+//PauseState - a function, or every value-moving function, stopped by the admins
+type PauseState struct {
+	Scope   string   `json:"scope"` // a function name, or all
+	Reason  string   `json:"reason"`
+	Since   string   `json:"since"`
+	Admins  []string `json:"admins"` // enrollment IDs of the quorum
+	Version int      `json:"version"`
+}
+
+//PauseProposal - admin votes towards pausing or resuming a scope
+type PauseProposal struct {
+	Scope   string   `json:"scope"`
+	Action  string   `json:"action"` // pause or resume
+	Reason  string   `json:"reason"`
+	Votes   []string `json:"votes"`
+	Time    string   `json:"time"`
+	Version int      `json:"version"`
+}
+
+//PauseEvent - a pause or resume that reached the quorum
+type PauseEvent struct {
+	TxID    string   `json:"txId"`
+	Scope   string   `json:"scope"`
+	Action  string   `json:"action"`
+	Reason  string   `json:"reason"`
+	Admins  []string `json:"admins"`
+	Time    string   `json:"time"`
+	Version int      `json:"version"`
+}
+
+//PauseStatus - result of getPauseStatus
+type PauseStatus struct {
+	Quorum    int             `json:"quorum"`
+	Paused    []PauseState    `json:"paused"`
+	Proposals []PauseProposal `json:"proposals"`
+	Events    []PauseEvent    `json:"events"`
+}
+
+//ParamSpec - a program parameter the organisations can change by proposal
+type ParamSpec struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"` // int or number
+	Min         *float64 `json:"min,omitempty"`
+	Positive    bool     `json:"positive,omitempty"` // must be above Min
+	Default     float64  `json:"default"`
+	Product     bool     `json:"product,omitempty"` // named <name>.<product>, kept on the product
+	Description string   `json:"description"`
+}
+
+//ParamValue - current value of a parameter
+type ParamValue struct {
+	Name        string  `json:"name"`
+	Value       float64 `json:"value"`
+	Default     float64 `json:"default"`
+	Description string  `json:"description"`
+}
+
+//ParamSet - result of getParameters
+type ParamSet struct {
+	Organisations []string     `json:"organisations"`
+	Threshold     int          `json:"threshold"`
+	Parameters    []ParamValue `json:"parameters"`
+	Catalogue     []ParamSpec  `json:"catalogue"`
+}
+
+//ParamProposal - proposed change of a parameter and the organisations' votes
+type ParamProposal struct {
+	ID         string   `json:"id"` // txID of the proposal
+	Parameter  string   `json:"parameter"`
+	Value      float64  `json:"value"`
+	Previous   float64  `json:"previous"` // value replaced when applied
+	Reason     string   `json:"reason"`
+	Proposer   string   `json:"proposer"`
+	Approvals  []string `json:"approvals"`
+	Rejections []string `json:"rejections"`
+	Status     string   `json:"status"`            // open, applied or rejected
+	Failure    string   `json:"failure,omitempty"` // why an approved value could not be applied
+	Time       string   `json:"time"`
+	Closed     string   `json:"closed"`
+	ClosedTx   string   `json:"closedTx"`
+	Version    int      `json:"version"`
+}
+
+//BalanceSnapshot - points and balance of an entity after a transaction
+type BalanceSnapshot struct {
+	TxID        string  `json:"txId"`
+	Timestamp   int64   `json:"timestamp"` // seconds since epoch
+	Points      int     `json:"points"`
+	Balance     float64 `json:"balance"`
+	HeldPoints  int     `json:"heldPoints"`
+	HeldBalance float64 `json:"heldBalance"`
+}
+
+//BalanceAt - result of getBalanceAt
+type BalanceAt struct {
+	Entity string `json:"entity"`
+	At     string `json:"at"`
+	BalanceSnapshot
+}
+
+//Alias - another identifier of an entity, ex: a loyalty card number, the hash
+// of a phone number or the ID of a client certificate
+type Alias struct {
+	Alias   string `json:"alias"`
+	Kind    string `json:"kind"` // card, phone or cert
+	Entity  string `json:"entity"`
+	Time    string `json:"time"`
+	Version int    `json:"version"`
+}
+
+//TaxRule - taxes charged on a product category in a jurisdiction
+type TaxRule struct {
+	Jurisdiction string    `json:"jurisdiction"`
+	Category     string    `json:"category"` // empty for the default of the jurisdiction
+	Components   []TaxRate `json:"components"`
+	Version      int       `json:"version"`
+}
+
+//TaxRate - one named tax of a rule, ex: a state and a city sales tax
+type TaxRate struct {
+	Name string  `json:"name"`
+	Rate float64 `json:"rate"` // percent of the net amount
+}
+
+//TaxLine - amount of one tax on a receipt
+type TaxLine struct {
+	Name   string  `json:"name"`
+	Rate   float64 `json:"rate"`
+	Amount float64 `json:"amount"`
+}
+
+//ReceiptLine - one product line of a receipt
+type ReceiptLine struct {
+	Product   string  `json:"product"`
+	Category  string  `json:"category"`
+	Qty       int     `json:"qty"`
+	UnitPrice float64 `json:"unitPrice"` // net of tax
+	Net       float64 `json:"net"`
+	Tax       float64 `json:"tax"`
+	Gross     float64 `json:"gross"`
+}
+
+//Receipt - tax receipt of a purchase paid with balance or a gift card
+type Receipt struct {
+	TxID         string        `json:"txId"`
+	Merchant     string        `json:"merchant"`
+	Customer     string        `json:"customer"`
+	Jurisdiction string        `json:"jurisdiction"`
+	Asset        string        `json:"asset"`
+	Lines        []ReceiptLine `json:"lines"`
+	Taxes        []TaxLine     `json:"taxes"`
+	Net          float64       `json:"net"`
+	Tax          float64       `json:"tax"`
+	Gross        float64       `json:"gross"`
+	Time         string        `json:"time"`
+	Version      int           `json:"version"`
+}
+
+//GiftCard - stored value issued by a merchant. Only a salted hash of the card
+// code is kept, the holder of the code can spend or load the balance.
+type GiftCard struct {
+	ID          string   `json:"id"`
+	Merchant    string   `json:"merchant"`
+	CodeHash    string   `json:"codeHash"` // hex sha256 of the salt followed by the code
+	Salt        string   `json:"salt"`
+	Value       float64  `json:"value"`
+	Balance     float64  `json:"balance"`
+	Expiry      int64    `json:"expiry"` // seconds
+	Status      string   `json:"status"` // active, spent or expired
+	Redemptions []string `json:"redemptions"`
+	Time        string   `json:"time"`
+	Version     int      `json:"version"`
+}
+
+//GiftCardBalance - what the holder of a gift card code can see of the card
+type GiftCardBalance struct {
+	ID       string  `json:"id"`
+	Merchant string  `json:"merchant"`
+	Value    float64 `json:"value"`
+	Balance  float64 `json:"balance"`
+	Expiry   int64   `json:"expiry"`
+	Status   string  `json:"status"`
+}
+
+//RedemptionItem - catalogue item redeemable for stock of an AssetMgmt asset type
+type RedemptionItem struct {
+	Item         string  `json:"item"`
+	Points       int     `json:"points"`       // points burned per item
+	Chaincode    string  `json:"chaincode"`    // name of the AssetMgmt chaincode on the channel
+	AssetType    string  `json:"assetType"`    // AssetMgmt asset the item maps to
+	Units        float64 `json:"units"`        // asset units handed over per item
+	StockAccount string  `json:"stockAccount"` // AssetMgmt account the stock is held in
+	Version      int     `json:"version"`
+}
+
+//TxnRedemption - points burned for stock transferred by the AssetMgmt chaincode
+type TxnRedemption struct {
+	ID        string  `json:"id"`
+	Customer  string  `json:"customer"`
+	Item      string  `json:"item"`
+	Qty       int     `json:"qty"`
+	Points    int     `json:"points"`
+	AssetType string  `json:"assetType"`
+	Units     float64 `json:"units"`
+	From      string  `json:"from"` // AssetMgmt stock account
+	To        string  `json:"to"`   // AssetMgmt account of the customer
+	Time      string  `json:"time"`
+	Version   int     `json:"version"`
+}
+
+//TxnBatch - bulk issuance of points or balance to many entities for a campaign
+type TxnBatch struct {
+	ID         string  `json:"id"`
+	Issuer     string  `json:"issuer"`
+	Campaign   string  `json:"campaign"`
+	Asset      string  `json:"asset"`
+	Recipients int     `json:"recipients"`
+	Total      float64 `json:"total"`
+	Time       string  `json:"time"`
+	Version    int     `json:"version"`
+}
+
+//Recipient - one credit of a bulk issuance
+type Recipient struct {
+	Entity string  `json:"entity"`
+	Amount float64 `json:"amount"`
+}
+
+//InvalidRecipient - recipient rejected by bulk issuance validation
+type InvalidRecipient struct {
+	Index  int    `json:"index"`
+	Entity string `json:"entity"`
+	Reason string `json:"reason"`
+}
+
+//BulkIssueReport - result of validating a bulk issuance
+type BulkIssueReport struct {
+	Valid   bool               `json:"valid"`
+	Total   float64            `json:"total"`
+	Budget  float64            `json:"budget"`
+	Invalid []InvalidRecipient `json:"invalid"`
+}
+
+//Genesis - starting data for Init: entities, products, rates and admin identities
+type Genesis struct {
+	Entities []Entity           `json:"entities"`
+	Products []Product          `json:"products"`
+	Rates    map[string]float64 `json:"rates"`  // encash - points per unit of balance
+	Admins   []string           `json:"admins"` // enrollment IDs allowed to administer
+	// admin votes needed to pause or resume, a majority of Admins when 0
+	PauseQuorum int `json:"pauseQuorum,omitempty"`
+	// bank and merchant entities voting on parameters, every genesis bank and
+	// merchant when empty
+	Organisations []string `json:"organisations,omitempty"`
+	// organisation approvals needed to change a parameter, a majority when 0
+	ParamThreshold int `json:"paramThreshold,omitempty"`
+}
+
+//FraudRule - rule evaluated against the recent activity of an entity
+type FraudRule struct {
+	ID        string  `json:"id"`
+	Kind      string  `json:"kind"`      // velocity, redeemAfterTopup or newReceivers
+	Function  string  `json:"function"`  // transfer, buyGoods or add
+	Asset     string  `json:"asset"`     // points, balance or empty for both
+	Count     int     `json:"count"`     // more than Count matches in the window is a hit
+	Window    int64   `json:"window"`    // window in seconds
+	Threshold float64 `json:"threshold"` // minimum top-up for redeemAfterTopup
+	Action    string  `json:"action"`    // block or review
+	Enabled   bool    `json:"enabled"`
+	Version   int     `json:"version"`
+}
+
+//FraudAlert - record of a transaction matching a fraud rule
+type FraudAlert struct {
+	Key          string  `json:"key"`
+	RuleID       string  `json:"ruleId"`
+	Action       string  `json:"action"`
+	Status       string  `json:"status"` // open or resolved
+	Entity       string  `json:"entity"`
+	Counterparty string  `json:"counterparty"`
+	Function     string  `json:"function"`
+	Asset        string  `json:"asset"`
+	Value        float64 `json:"value"`
+	TxID         string  `json:"txId"`
+	Time         string  `json:"time"`
+	Resolution   string  `json:"resolution"`
+	ResolvedBy   string  `json:"resolvedBy"`
+	Version      int     `json:"version"`
+}
+
+//Activity - value movement of an entity kept for the fraud rules
+type Activity struct {
+	Function     string  `json:"function"`
+	Counterparty string  `json:"counterparty"`
+	Asset        string  `json:"asset"`
+	Value        float64 `json:"value"`
+	NewReceiver  bool    `json:"newReceiver"`
+	Time         int64   `json:"time"`
+}
+
+//CustomerIdentity - on-channel link between a pseudonymous customer and its PII
+type CustomerIdentity struct {
+	ID       string `json:"id"`
+	PIIHash  string `json:"piiHash"` // sha256 of salt and PII, computed by the client
+	Merchant string `json:"merchant"`
+	Bank     string `json:"bank"`
+	Time     string `json:"time"`
+}
+
+//ChaincodeError - machine readable error returned by every Invoke and Query function
+type ChaincodeError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"` // argument that caused the error
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"` // offending value or key
+}
+
+// Error - the error as JSON, which is what the client receives
+func (e *ChaincodeError) Error() string {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Code + ": " + e.Message
+	}
+	return string(bytes)
+}
+
+// newError - builds a ChaincodeError
+func newError(code string, field string, message string, details string) error {
+	return &ChaincodeError{Code: code, Field: field, Message: message, Details: details}
+}
+
+// argCountError - error for a call with the wrong number of arguments
+func argCountError(expecting string, function string) error {
+	return newError(codeArgumentCount, "args", "Incorrect number of arguments. Expecting "+expecting+" for "+function, "")
+}
+
+// toChaincodeError - passes a ChaincodeError through and wraps any other error,
+// such as one returned by the shim, as an internal error
+func toChaincodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ChaincodeError); ok {
+		return err
+	}
+	return newError(codeInternal, "", err.Error(), "")
+}
+
+//ArgSpec - one declared argument of a function, in the order of its positional form
+type ArgSpec struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`               // string, int, number, bool, flag or json
+	Required bool     `json:"required"`           // must be given and not empty
+	Optional bool     `json:"optional,omitempty"` // may be left off the end of the positional form
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Enum     []string `json:"enum,omitempty"`
+	Entity   bool     `json:"entity,omitempty"`  // an entity ID or one of its aliases
+	Caller   bool     `json:"caller,omitempty"`  // the entity acting, must be the caller
+	Private  bool     `json:"private,omitempty"` // a customer here is only readable by them, their merchant or bank, or an admin
+}
+
+// bound - pointer to a Min or Max of an ArgSpec
+func bound(value float64) *float64 {
+	return &value
+}
+
+var assetEnum = []string{"points", "balance"}
+
+//FunctionSpec - registry entry of an Invoke or Query function
+type FunctionSpec struct {
+	Name        string    `json:"name"`
+	Kind        string    `json:"kind"` // invoke or query
+	Role        string    `json:"role"` // role checked before the handler runs: any, admin, customer, merchant, bank or organisation, or a comma separated list of them
+	Description string    `json:"description"`
+	Args        []ArgSpec `json:"args"` // nil when the arguments are not checked, as for init
+	// stopped while the chaincode is paused as a whole
+	MovesValue bool `json:"movesValue,omitempty"`
+	handler    func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+}
+
+// registry - every Invoke and Query function with its argument schema. It is
+// filled in init as the describe handler reads it back.
+var registry []FunctionSpec
+
+func init() {
+	registry = []FunctionSpec{
+		{
+			Name:        "init",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Reseed the entities and products from the demo data {customer, merchant, bank} or a single JSON genesis document; the admins, parameters and organisations set at deploy are kept",
+			MovesValue:  true,
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.initLedger(stub, args, false)
+			},
+		},
+		{
+			Name:        "write",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Create a merchant or bank with its opening points and balance",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "type", Type: "string", Required: true, Enum: []string{"merchant", "bank"}},
+				{Name: "name", Type: "string", Required: true, Entity: true},
+				{Name: "balance", Type: "number", Required: true, Min: bound(0)},
+				{Name: "points", Type: "int", Required: true, Min: bound(0)},
+				{Name: "jurisdiction", Type: "string", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).write,
+		},
+		{
+			Name:        "buyGoods",
+			Kind:        "invoke",
+			Role:        "customer",
+			Description: "Buy a quantity of a merchant's product with points, balance or a gift card of the merchant",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "asset", Type: "string", Required: true, Enum: []string{"points", "balance", "giftcard"}},
+				{Name: "customer", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "merchant", Type: "string", Required: true, Entity: true},
+				{Name: "product", Type: "string", Required: true},
+				{Name: "qty", Type: "int", Required: true, Min: bound(1)},
+				{Name: "remarks", Type: "string"},
+				{Name: "cardID", Type: "string", Optional: true},
+				{Name: "code", Type: "string", Optional: true},
+				{Name: "nextCodeHash", Type: "string", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).buyGoods,
+		},
+		{
+			Name:        "add",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Top up the points or balance of an entity",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "asset", Type: "string", Required: true, Enum: assetEnum},
+				{Name: "entity", Type: "string", Required: true, Entity: true},
+				{Name: "amount", Type: "number", Required: true, Min: bound(0)},
+			},
+			handler: (*LoyaltyChaincode).add,
+		},
+		{
+			Name:        "encashMerchant",
+			Kind:        "invoke",
+			Role:        "merchant",
+			Description: "Request the bank to encash a merchant's points",
+			Args: []ArgSpec{
+				{Name: "merchant", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "bank", Type: "string", Required: true, Entity: true},
+				{Name: "points", Type: "int", Required: true, Min: bound(1)},
+			},
+			handler: (*LoyaltyChaincode).encashMerchant,
+		},
+		{
+			Name:        "approve",
+			Kind:        "invoke",
+			Role:        "bank",
+			Description: "Settle one pending encashment request of a bank, moving the points to the bank and the balance to the merchant at the configured rate",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "bank", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "request", Type: "string", Required: true},
+				{Name: "points", Type: "int", Optional: true, Min: bound(1)},
+			},
+			handler: (*LoyaltyChaincode).approve,
+		},
+		{
+			Name:        "settleEncash",
+			Kind:        "invoke",
+			Role:        "bank",
+			Description: "Approve, partly approve or reject many pending encashment requests of a bank at the configured rate",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "bank", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "decisions", Type: "json", Required: true},
+			},
+			handler: (*LoyaltyChaincode).settleEncash,
+		},
+		{
+			Name:        "votePause",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Vote to pause or resume one invoke function, or every value-moving function with scope all; it applies once the admin quorum has voted",
+			Args: []ArgSpec{
+				{Name: "scope", Type: "string", Required: true},
+				{Name: "action", Type: "string", Required: true, Enum: []string{"pause", "resume"}},
+				{Name: "reason", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).votePause,
+		},
+		{
+			Name:        "proposeParameter",
+			Kind:        "invoke",
+			Role:        "organisation",
+			Description: "Propose a new value for a program parameter, counted as the proposing organisation's approval; the proposal ID is the txID",
+			Args: []ArgSpec{
+				{Name: "parameter", Type: "string", Required: true},
+				{Name: "value", Type: "number", Required: true},
+				{Name: "reason", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).proposeParameter,
+		},
+		{
+			Name:        "voteParameter",
+			Kind:        "invoke",
+			Role:        "organisation",
+			Description: "Approve or reject an open parameter proposal; it is applied once the threshold of organisations approves",
+			Args: []ArgSpec{
+				{Name: "proposal", Type: "string", Required: true},
+				{Name: "vote", Type: "string", Required: true, Enum: []string{"approve", "reject"}},
+			},
+			handler: (*LoyaltyChaincode).voteParameter,
+		},
+		{
+			Name:        "grantCreditLine",
+			Kind:        "invoke",
+			Role:        "bank",
+			Description: "Let a merchant's points or balance go below zero down to a limit, on terms and until an expiry",
+			Args: []ArgSpec{
+				{Name: "bank", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "merchant", Type: "string", Required: true, Entity: true},
+				{Name: "asset", Type: "string", Required: true, Enum: assetEnum},
+				{Name: "limit", Type: "number", Required: true, Min: bound(0)},
+				{Name: "interestRate", Type: "number", Required: true, Min: bound(0)},
+				{Name: "fee", Type: "number", Required: true, Min: bound(0)},
+				{Name: "expiryDays", Type: "int", Required: true, Min: bound(1)},
+			},
+			handler: (*LoyaltyChaincode).grantCreditLine,
+		},
+		{
+			Name:        "revokeCreditLine",
+			Kind:        "invoke",
+			Role:        "bank",
+			Description: "Stop further use of a merchant's credit line, what is used stays owed",
+			Args: []ArgSpec{
+				{Name: "bank", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "merchant", Type: "string", Required: true, Entity: true},
+				{Name: "asset", Type: "string", Required: true, Enum: assetEnum},
+			},
+			handler: (*LoyaltyChaincode).revokeCreditLine,
+		},
+		{
+			Name:        "transfer",
+			Kind:        "invoke",
+			Role:        "any",
+			Description: "Move points or balance from one entity to another",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "fromEntity", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "toEntity", Type: "string", Required: true, Entity: true},
+				{Name: "asset", Type: "string", Required: true, Enum: assetEnum},
+				{Name: "amount", Type: "number", Required: true, Min: bound(0)},
+				{Name: "remarks", Type: "string"},
+			},
+			handler: (*LoyaltyChaincode).transfer,
+		},
+		{
+			Name:        "migrate",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Rewrite a batch of a key collection's records at the current schema version",
+			Args: []ArgSpec{
+				{Name: "collection", Type: "string", Required: true, Enum: migrationCollections},
+				{Name: "start", Type: "int", Required: true, Min: bound(0)},
+				{Name: "batchSize", Type: "int", Required: true, Min: bound(1), Max: bound(1000)},
+				{Name: "keys", Type: "json", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).migrate,
+		},
+		{
+			Name:        "adjustBalance",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Audited correction of an entity's points or balance with a reason code, approved by the calling admin",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "entity", Type: "string", Required: true, Entity: true},
+				{Name: "asset", Type: "string", Required: true, Enum: assetEnum},
+				{Name: "delta", Type: "number", Required: true},
+				{Name: "reasonCode", Type: "string", Required: true, Enum: adjustmentReasons},
+				{Name: "note", Type: "string"},
+			},
+			handler: (*LoyaltyChaincode).adjustBalance,
+		},
+		{
+			Name:        "authorizeGoods",
+			Kind:        "invoke",
+			Role:        "customer",
+			Description: "Reserve a customer's funds and a product until the order ships",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "asset", Type: "string", Required: true, Enum: assetEnum},
+				{Name: "customer", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "merchant", Type: "string", Required: true, Entity: true},
+				{Name: "product", Type: "string", Required: true},
+				{Name: "qty", Type: "int", Required: true, Min: bound(1)},
+				{Name: "expiryMinutes", Type: "int", Required: true, Min: bound(1)},
+			},
+			handler: (*LoyaltyChaincode).authorizeGoods,
+		},
+		{
+			Name:        "captureGoods",
+			Kind:        "invoke",
+			Role:        "merchant",
+			Description: "Debit an authorized hold when the order ships",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "holdKey", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).captureGoods,
+		},
+		{
+			Name:        "voidGoods",
+			Kind:        "invoke",
+			Role:        "any",
+			Description: "Release an authorized hold of a cancelled order",
+			Args: []ArgSpec{
+				{Name: "holdKey", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).voidGoods,
+		},
+		{
+			Name:        "expireHolds",
+			Kind:        "invoke",
+			Role:        "any",
+			Description: "Release every authorized hold past its expiry",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.expireHolds(stub)
+			},
+		},
+		{
+			Name:        "openDispute",
+			Kind:        "invoke",
+			Role:        "customer",
+			Description: "Dispute a goods purchase",
+			Args: []ArgSpec{
+				{Name: "customer", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "txnGoodsID", Type: "string", Required: true},
+				{Name: "reasonCode", Type: "string", Required: true},
+				{Name: "evidenceHashes", Type: "string"},
+			},
+			handler: (*LoyaltyChaincode).openDispute,
+		},
+		{
+			Name:        "respondDispute",
+			Kind:        "invoke",
+			Role:        "merchant",
+			Description: "Answer a dispute with a response and evidence",
+			Args: []ArgSpec{
+				{Name: "merchant", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "disputeKey", Type: "string", Required: true},
+				{Name: "response", Type: "string", Required: true},
+				{Name: "evidenceHashes", Type: "string"},
+			},
+			handler: (*LoyaltyChaincode).respondDispute,
+		},
+		{
+			Name:        "adjudicateDispute",
+			Kind:        "invoke",
+			Role:        "bank",
+			Description: "Close a dispute or reverse its purchase",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "bank", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "disputeKey", Type: "string", Required: true},
+				{Name: "ruling", Type: "string", Required: true, Enum: []string{"close", "reverse"}},
+			},
+			handler: (*LoyaltyChaincode).adjudicateDispute,
+		},
+		{
+			Name:        "enforceDisputeDeadline",
+			Kind:        "invoke",
+			Role:        "any",
+			Description: "Reverse a dispute the bank did not rule on before its deadline",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "disputeKey", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).enforceDisputeDeadline,
+		},
+		{
+			Name:        "bulkIssue",
+			Kind:        "invoke",
+			Role:        "merchant",
+			Description: "Credit many entities from the issuer's budget, or validate them with dryRun",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "issuer", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "asset", Type: "string", Required: true, Enum: assetEnum},
+				{Name: "campaign", Type: "string", Required: true},
+				{Name: "recipients", Type: "json", Required: true},
+				{Name: "dryRun", Type: "flag", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).bulkIssue,
+		},
+		{
+			Name:        "registerCustomer",
+			Kind:        "invoke",
+			Role:        "merchant",
+			Description: "Create a customer under a pseudonymous ID with a salted PII hash",
+			Args: []ArgSpec{
+				{Name: "piiHash", Type: "string", Required: true},
+				{Name: "merchant", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "bank", Type: "string", Required: true, Entity: true},
+			},
+			handler: (*LoyaltyChaincode).registerCustomer,
+		},
+		{
+			Name:        "renameEntity",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Change the display name of an entity, its ID stays the same",
+			Args: []ArgSpec{
+				{Name: "entity", Type: "string", Required: true, Entity: true},
+				{Name: "name", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).renameEntity,
+		},
+		{
+			Name:        "setJurisdiction",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Set or clear the tax jurisdiction of an entity, nothing else about it changes",
+			Args: []ArgSpec{
+				{Name: "entity", Type: "string", Required: true, Entity: true},
+				{Name: "jurisdiction", Type: "string"},
+			},
+			handler: (*LoyaltyChaincode).setJurisdiction,
+		},
+		{
+			Name:        "addAlias",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Map a card number, phone number hash or client certificate ID to an entity",
+			Args: []ArgSpec{
+				{Name: "entity", Type: "string", Required: true, Entity: true},
+				{Name: "kind", Type: "string", Required: true, Enum: []string{"card", "phone", "cert"}},
+				{Name: "alias", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).addAlias,
+		},
+		{
+			Name:        "removeAlias",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Remove an alias from its entity",
+			Args: []ArgSpec{
+				{Name: "alias", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).removeAlias,
+		},
+		{
+			Name:        "putFraudRule",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Create or replace a fraud rule",
+			Args: []ArgSpec{
+				{Name: "id", Type: "string", Required: true},
+				{Name: "kind", Type: "string", Required: true, Enum: []string{"velocity", "redeemAfterTopup", "newReceivers"}},
+				{Name: "function", Type: "string"},
+				{Name: "asset", Type: "string"},
+				{Name: "count", Type: "int", Required: true, Min: bound(0)},
+				{Name: "windowMinutes", Type: "int", Required: true, Min: bound(1)},
+				{Name: "threshold", Type: "number", Required: true},
+				{Name: "action", Type: "string", Required: true, Enum: []string{"block", "review"}},
+				{Name: "enabled", Type: "bool", Required: true},
+			},
+			handler: (*LoyaltyChaincode).putFraudRule,
+		},
+		{
+			Name:        "resolveFraudAlert",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Record the resolution of a fraud alert, resolved by the calling admin",
+			Args: []ArgSpec{
+				{Name: "alertKey", Type: "string", Required: true},
+				{Name: "resolution", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).resolveFraudAlert,
+		},
+		{
+			Name:        "putFeeRule",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Set the percent or fixed fee of redemptions, encashments or transfers, by default or for one merchant",
+			Args: []ArgSpec{
+				{Name: "event", Type: "string", Required: true, Enum: []string{"redemption", "encash", "transfer"}},
+				{Name: "merchant", Type: "string", Entity: true},
+				{Name: "kind", Type: "string", Required: true, Enum: []string{"percent", "fixed"}},
+				{Name: "rate", Type: "number", Required: true, Min: bound(0)},
+				{Name: "account", Type: "string", Required: true, Entity: true},
+			},
+			handler: (*LoyaltyChaincode).putFeeRule,
+		},
+		{
+			Name:        "issueGiftCard",
+			Kind:        "invoke",
+			Role:        "merchant",
+			Description: "Issue a gift card from the merchant's balance, keeping only a salted hash of its code",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "merchant", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "cardID", Type: "string", Required: true},
+				{Name: "codeHash", Type: "string", Required: true},
+				{Name: "salt", Type: "string", Required: true},
+				{Name: "value", Type: "number", Required: true, Min: bound(0.01)},
+				{Name: "expiryDays", Type: "int", Required: true, Min: bound(1)},
+			},
+			handler: (*LoyaltyChaincode).issueGiftCard,
+		},
+		{
+			Name:        "loadGiftCard",
+			Kind:        "invoke",
+			Role:        "any",
+			Description: "Move some or all of a gift card's balance into an entity's balance, replacing the code of a card that keeps a balance",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "cardID", Type: "string", Required: true},
+				{Name: "code", Type: "string", Required: true},
+				{Name: "entity", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "amount", Type: "number", Optional: true, Min: bound(0.01)},
+				{Name: "nextCodeHash", Type: "string", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).loadGiftCard,
+		},
+		{
+			Name:        "expireGiftCards",
+			Kind:        "invoke",
+			Role:        "merchant",
+			Description: "Return the balance left on the merchant's expired gift cards to the merchant",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "merchant", Type: "string", Required: true, Entity: true, Caller: true},
+			},
+			handler: (*LoyaltyChaincode).expireGiftCards,
+		},
+		{
+			Name:        "putRedemptionItem",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Map a catalogue item to an AssetMgmt asset type, its points price and stock account",
+			Args: []ArgSpec{
+				{Name: "item", Type: "string", Required: true},
+				{Name: "points", Type: "int", Required: true, Min: bound(1)},
+				{Name: "chaincode", Type: "string", Required: true},
+				{Name: "assetType", Type: "string", Required: true},
+				{Name: "units", Type: "number", Required: true, Min: bound(0)},
+				{Name: "stockAccount", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).putRedemptionItem,
+		},
+		{
+			Name:        "redeemForAsset",
+			Kind:        "invoke",
+			Role:        "customer",
+			Description: "Burn a customer's points and transfer the mapped stock to their AssetMgmt account",
+			MovesValue:  true,
+			Args: []ArgSpec{
+				{Name: "customer", Type: "string", Required: true, Entity: true, Caller: true},
+				{Name: "item", Type: "string", Required: true},
+				{Name: "qty", Type: "int", Required: true, Min: bound(1)},
+				{Name: "toAccount", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).redeemForAsset,
+		},
+		{
+			Name:        "read",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Read an entity",
+			Args: []ArgSpec{
+				{Name: "name", Type: "string", Required: true, Entity: true, Private: true},
+			},
+			handler: (*LoyaltyChaincode).read,
+		},
+		{
+			Name:        "getAllProducts",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List all products",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getAllProducts(stub)
+			},
+		},
+		{
+			Name:        "getAllTxnTopup",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the top-up transactions visible to the caller",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getAllTxnTopup(stub)
+			},
+		},
+		{
+			Name:        "getAllTxnGoods",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the goods purchases visible to the caller",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getAllTxnGoods(stub)
+			},
+		},
+		{
+			Name:        "getAllTxnTransfer",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the transfers visible to the caller",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getAllTxnTransfer(stub)
+			},
+		},
+		{
+			Name:        "getAllTxnEncash",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the encashment requests and payouts visible to the caller",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getAllTxnEncash(stub)
+			},
+		},
+		{
+			Name:        "getAllTxnAdjustment",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the balance adjustments visible to the caller",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getAllTxnAdjustment(stub)
+			},
+		},
+		{
+			Name:        "getMigrationStatus",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Return the last migrate report of a collection",
+			Args: []ArgSpec{
+				{Name: "collection", Type: "string", Required: true, Enum: migrationCollections},
+			},
+			handler: (*LoyaltyChaincode).getMigrationStatus,
+		},
+		{
+			Name:        "getTopCustomers",
+			Kind:        "query",
+			Role:        "admin,merchant",
+			Description: "Rank customers by points, earned points or spend, of the calling merchant unless an admin calls",
+			Args: []ArgSpec{
+				{Name: "rankBy", Type: "string", Required: true, Enum: []string{"points", "earned", "spend"}},
+				{Name: "limit", Type: "int", Optional: true, Min: bound(1)},
+			},
+			handler: (*LoyaltyChaincode).getTopCustomers,
+		},
+		{
+			Name:        "getMerchantSalesReport",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Total a merchant's goods sales per day, week or month",
+			Args: []ArgSpec{
+				{Name: "merchant", Type: "string", Required: true, Entity: true},
+				{Name: "fromDate", Type: "string", Required: true},
+				{Name: "toDate", Type: "string", Required: true},
+				{Name: "bucket", Type: "string", Required: true, Enum: []string{"day", "week", "month"}},
+			},
+			handler: (*LoyaltyChaincode).getMerchantSalesReport,
+		},
+		{
+			Name:        "getDisputes",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List disputes, optionally by status or party",
+			Args: []ArgSpec{
+				{Name: "filter", Type: "string", Optional: true, Enum: []string{"status", "party"}},
+				{Name: "value", Type: "string", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).getDisputes,
+		},
+		{
+			Name:        "getHolds",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List holds, optionally of one customer",
+			Args: []ArgSpec{
+				{Name: "customer", Type: "string", Optional: true, Entity: true, Private: true},
+			},
+			handler: (*LoyaltyChaincode).getHolds,
+		},
+		{
+			Name:        "reconcile",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Compare the supply counters with the sum of all entity holdings",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.reconcile(stub)
+			},
+		},
+		{
+			Name:        "getAllTxnBatch",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the bulkIssue batches visible to the caller",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getAllTxnBatch(stub)
+			},
+		},
+		{
+			Name:        "verifyCustomer",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Check a PII hash held off the ledger against a customer",
+			Args: []ArgSpec{
+				{Name: "customerID", Type: "string", Required: true, Entity: true, Private: true},
+				{Name: "piiHash", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).verifyCustomer,
+		},
+		{
+			Name:        "getAliases",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the aliases of an entity",
+			Args: []ArgSpec{
+				{Name: "entity", Type: "string", Required: true, Entity: true, Private: true},
+			},
+			handler: (*LoyaltyChaincode).getAliases,
+		},
+		{
+			Name:        "getBalanceAt",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Points and balance of an entity as they were at a time, in seconds or RFC 3339, or after a transaction ID",
+			Args: []ArgSpec{
+				{Name: "entity", Type: "string", Required: true, Entity: true, Private: true},
+				{Name: "at", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).getBalanceAt,
+		},
+		{
+			Name:        "getCreditPosition",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Credit used and available to a merchant, for points or balance",
+			Args: []ArgSpec{
+				{Name: "merchant", Type: "string", Required: true, Entity: true},
+				{Name: "asset", Type: "string", Required: true, Enum: assetEnum},
+			},
+			handler: (*LoyaltyChaincode).getCreditPosition,
+		},
+		{
+			Name:        "getPauseStatus",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Paused scopes, open pause votes and the record of every pause and resume",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getPauseStatus(stub)
+			},
+		},
+		{
+			Name:        "getParameters",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Current program parameters, the voting organisations and the approval threshold",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getParameters(stub)
+			},
+		},
+		{
+			Name:        "getParamProposals",
+			Kind:        "query",
+			Role:        "any",
+			Description: "History of parameter proposals with their votes, optionally by parameter and status",
+			Args: []ArgSpec{
+				{Name: "parameter", Type: "string", Optional: true},
+				{Name: "status", Type: "string", Optional: true, Enum: []string{"open", "applied", "rejected"}},
+			},
+			handler: (*LoyaltyChaincode).getParamProposals,
+		},
+		{
+			Name:        "getTrialBalance",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Debit and credit totals of the journal per account and asset, per entity with detail",
+			Args: []ArgSpec{
+				{Name: "detail", Type: "flag", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).getTrialBalance,
+		},
+		{
+			Name:        "getJournalEntry",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Journal postings of a transaction",
+			Args: []ArgSpec{
+				{Name: "txID", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).getJournalEntry,
+		},
+		{
+			Name:        "getFraudRules",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the configured fraud rules",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getFraudRules(stub)
+			},
+		},
+		{
+			Name:        "getFraudAlerts",
+			Kind:        "query",
+			Role:        "admin",
+			Description: "List fraud alerts, optionally by status",
+			Args: []ArgSpec{
+				{Name: "status", Type: "string", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).getFraudAlerts,
+		},
+		{
+			Name:        "getFeeSchedule",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the fee rules",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getFeeSchedule(stub)
+			},
+		},
+		{
+			Name:        "putTaxRule",
+			Kind:        "invoke",
+			Role:        "admin",
+			Description: "Set the taxes of a product category in a jurisdiction, or of every category without its own rule",
+			Args: []ArgSpec{
+				{Name: "jurisdiction", Type: "string", Required: true},
+				{Name: "category", Type: "string"},
+				{Name: "components", Type: "json", Required: true},
+			},
+			handler: (*LoyaltyChaincode).putTaxRule,
+		},
+		{
+			Name:        "getTaxRules",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the tax rules",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getTaxRules(stub)
+			},
+		},
+		{
+			Name:        "getReceipt",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Get the tax receipt of a purchase by its transaction ID",
+			Args: []ArgSpec{
+				{Name: "txID", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).getReceipt,
+		},
+		{
+			Name:        "getGiftCardBalance",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Check the balance and expiry of a gift card with its code",
+			Args: []ArgSpec{
+				{Name: "cardID", Type: "string", Required: true},
+				{Name: "code", Type: "string", Required: true},
+			},
+			handler: (*LoyaltyChaincode).getGiftCardBalance,
+		},
+		{
+			Name:        "getRedemptionItems",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the catalogue items redeemable for AssetMgmt stock",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getRedemptionItems(stub)
+			},
+		},
+		{
+			Name:        "getAllTxnRedemption",
+			Kind:        "query",
+			Role:        "any",
+			Description: "List the redemptions of points for AssetMgmt stock visible to the caller",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getAllTxnRedemption(stub)
+			},
+		},
+		{
+			Name:        "describe",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Describe the registered functions, or one of them",
+			Args: []ArgSpec{
+				{Name: "function", Type: "string", Optional: true},
+			},
+			handler: (*LoyaltyChaincode).describe,
+		},
+		{
+			Name:        "getOpenAPI",
+			Kind:        "query",
+			Role:        "any",
+			Description: "Return an OpenAPI document of the registered functions",
+			Args:        []ArgSpec{},
+			handler: func(t *LoyaltyChaincode, stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+				return t.getOpenAPI(stub)
+			},
+		},
+	}
+}
+
+// lookupFunction - registry entry of a function
+func lookupFunction(name string) (FunctionSpec, bool) {
+	for _, spec := range registry {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return FunctionSpec{}, false
+}
+
+// parameterSpecs - the parameters that can be changed by proposal
+var parameterSpecs = []ParamSpec{
+	{Name: "encashRate", Type: "number", Min: bound(0), Positive: true, Default: 100, Description: "Points per unit of balance when a merchant encashes"},
+	{Name: "paramThreshold", Type: "int", Min: bound(1), Default: 1, Description: "Organisation approvals needed to change a parameter"},
+	{Name: "productPoints", Type: "int", Min: bound(0), Product: true, Description: "Points price of a product, named productPoints.<product>"},
+	{Name: "productAmount", Type: "number", Min: bound(0), Product: true, Description: "Balance price of a product, named productAmount.<product>"},
+}
+
+// lookupParameter - finds the spec of a parameter name, and the product it
+// names for a product parameter
+func lookupParameter(name string) (ParamSpec, string, bool) {
+	base, product := name, ""
+	if index := s.Index(name, "."); index >= 0 {
+		base, product = name[:index], name[index+1:]
+	}
+	for _, spec := range parameterSpecs {
+		if spec.Name == base && spec.Product == (product != "") {
+			return spec, product, true
+		}
+	}
+	return ParamSpec{}, "", false
+}
+
+// checkArgs - validates the arguments of a function against its schema before it
+// runs. A single JSON object argument is the named form and is converted to the
+// positional form; positional arguments are still accepted but deprecated.
+func checkArgs(spec FunctionSpec, args []string) ([]string, error) {
+	function := spec.Name
+	specs := spec.Args
+	if specs == nil {
+		return args, nil
+	}
+
+	if len(args) == 1 && s.HasPrefix(s.TrimSpace(args[0]), "{") {
+		named, err := namedArgs(function, specs, args[0])
+		if err != nil {
+			return nil, err
+		}
+		args = named
+	} else if len(args) > 0 {
+		fmt.Println("Positional arguments to " + function + " are deprecated, pass a single JSON object")
+	}
+
+	required := len(specs)
+	for required > 0 && specs[required-1].Optional {
+		required--
+	}
+	if len(args) < required || len(args) > len(specs) {
+		expecting := strconv.Itoa(len(specs))
+		if required != len(specs) {
+			expecting = strconv.Itoa(required) + " to " + expecting
+		}
+		return nil, argCountError(expecting, function)
+	}
+
+	for index, value := range args {
+		err := checkArg(specs[index], value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// namedArgs - converts the named form of a function's arguments to its positional form
+func namedArgs(function string, specs []ArgSpec, object string) ([]string, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal([]byte(object), &fields)
+	if err != nil {
+		return nil, newError(codeBadArgument, "args", "Arguments of "+function+" are not a JSON object", err.Error())
+	}
+
+	known := map[string]bool{}
+	for _, spec := range specs {
+		known[spec.Name] = true
+	}
+	for name := range fields {
+		if !known[name] {
+			return nil, newError(codeBadArgument, name, "Unknown argument for "+function, name)
+		}
+	}
+
+	args := make([]string, len(specs))
+	given := 0
+	for index, spec := range specs {
+		raw, ok := fields[spec.Name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		value, err := namedValue(spec, raw)
+		if err != nil {
+			return nil, err
+		}
+		args[index] = value
+		if value != "" || !spec.Optional {
+			given = index + 1
+		}
+	}
+	// Fields that are not optional keep their place even when empty
+	for given < len(specs) && !specs[given].Optional {
+		given++
+	}
+	return args[:given], nil
+}
+
+// namedValue - positional string of one named argument, checking its JSON type
+func namedValue(spec ArgSpec, raw json.RawMessage) (string, error) {
+	text := string(raw)
+	switch spec.Type {
+	case "string":
+		var value string
+		err := json.Unmarshal(raw, &value)
+		if err != nil {
+			return "", newError(codeBadArgument, spec.Name, spec.Name+" must be a string", text)
+		}
+		return value, nil
+	case "int", "number":
+		var value json.Number
+		if text == "" || text[0] == '"' || json.Unmarshal(raw, &value) != nil {
+			return "", newError(codeBadArgument, spec.Name, spec.Name+" must be a number", text)
+		}
+		return value.String(), nil
+	case "bool", "flag":
+		var value bool
+		err := json.Unmarshal(raw, &value)
+		if err != nil {
+			return "", newError(codeBadArgument, spec.Name, spec.Name+" must be true or false", text)
+		}
+		if spec.Type == "flag" {
+			// a flag is passed positionally as its own name
+			if value {
+				return spec.Name, nil
+			}
+			return "", nil
+		}
+		return strconv.FormatBool(value), nil
+	case "json":
+		if text == "" || (text[0] != '{' && text[0] != '[') {
+			return "", newError(codeBadArgument, spec.Name, spec.Name+" must be a JSON object or array", text)
+		}
+		return text, nil
+	}
+	return "", newError(codeInternal, spec.Name, "Unknown argument type "+spec.Type, "")
+}
+
+// checkArg - validates one positional argument against its spec
+func checkArg(spec ArgSpec, value string) error {
+	if value == "" {
+		if spec.Required {
+			return newError(codeBadArgument, spec.Name, spec.Name+" is required", "")
+		}
+		return nil
+	}
+
+	var number float64
+	switch spec.Type {
+	case "int":
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return newError(codeBadArgument, spec.Name, spec.Name+" must be a whole number", value)
+		}
+		number = float64(parsed)
+	case "number":
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+			return newError(codeBadArgument, spec.Name, spec.Name+" must be a number", value)
+		}
+		number = parsed
+	case "bool":
+		_, err := strconv.ParseBool(value)
+		if err != nil {
+			return newError(codeBadArgument, spec.Name, spec.Name+" must be true or false", value)
+		}
+	case "flag":
+		if value != spec.Name {
+			return newError(codeBadArgument, spec.Name, spec.Name+" must be passed as "+spec.Name, value)
+		}
+	case "json":
+		if !json.Valid([]byte(value)) {
+			return newError(codeBadArgument, spec.Name, spec.Name+" must be valid JSON", value)
+		}
+	}
+	if spec.Min != nil && number < *spec.Min {
+		return newError(codeBadArgument, spec.Name, spec.Name+" must be at least "+strconv.FormatFloat(*spec.Min, 'f', -1, 64), value)
+	}
+	if spec.Max != nil && number > *spec.Max {
+		return newError(codeBadArgument, spec.Name, spec.Name+" must be at most "+strconv.FormatFloat(*spec.Max, 'f', -1, 64), value)
+	}
+
+	if len(spec.Enum) > 0 {
+		for _, allowed := range spec.Enum {
+			if value == allowed {
+				return nil
+			}
+		}
+		return newError(codeBadArgument, spec.Name, spec.Name+" must be one of "+s.Join(spec.Enum, ", "), value)
+	}
+	return nil
+}
+
+// parseAmount - parses an amount of an asset; points are whole, balance may be fractional
+func parseAmount(asset string, value string) (float64, error) {
+	if asset == "points" {
+		points, err := strconv.Atoi(value)
+		return float64(points), err
+	}
+	return strconv.ParseFloat(value, 64)
 }
 
 // LoyaltyChaincode example simple Chaincode implementation
@@ -100,988 +1829,7306 @@ func main() {
 	}
 }
 
-// Init resets all the things
-func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+// Init resets all the things
+func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return t.initLedger(stub, args, true)
+}
+
+// initLedger - seeds the ledger at deploy, or reseeds it for an admin through
+// the init invoke. Only the deploy sets the admins, parameters and voting
+// organisations, so an invoke cannot make its caller an admin.
+func (t *LoyaltyChaincode) initLedger(stub shim.ChaincodeStubInterface, args []string, deploy bool) ([]byte, error) {
+
+	/*
+	   args[] - {customer, merchant, bank} to seed the demo data
+	            or {genesisJSON} to seed from a genesis document
+	*/
+	var genesis Genesis
+	if len(args) == 3 {
+		genesis = demoGenesis(args[0], args[1], args[2])
+	} else if len(args) == 1 {
+		err := json.Unmarshal([]byte(args[0]), &genesis)
+		if err != nil {
+			return nil, newError(codeBadArgument, "genesis", "Invalid genesis document", err.Error())
+		}
+		if !deploy && (genesis.Admins != nil || genesis.Rates != nil || genesis.PauseQuorum != 0 || genesis.Organisations != nil || genesis.ParamThreshold != 0) {
+			return nil, newError(codeBadArgument, "genesis", "Admins, rates, quorums and organisations can only be set when the chaincode is deployed", "")
+		}
+	} else {
+		return nil, argCountError("3 or a genesis document", "init")
+	}
+
+	// Nothing is written unless the whole document is valid
+	err := validateGenesis(genesis)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from an empty leaderboard, the seeded customers are indexed when written
+	err = stub.PutState("Leaderboard", []byte("{}"))
+	if err != nil {
+		fmt.Println("Failed to initialize Leaderboard")
+		return nil, err
+	}
+
+	// Initialize the collection of  keys for products and various transactions
+	fmt.Println("Initializing keys collection")
+	var blank []string
+	blankBytes, _ := json.Marshal(&blank)
+	err = stub.PutState("Products", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize Products key collection")
+	}
+	err = stub.PutState("TxnTopup", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TxnTopUp key collection")
+	}
+	err = stub.PutState("TxnGoods", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TxnGoods key collection")
+	}
+	err = stub.PutState("TxnEncash", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TxnEncash key collection")
+	}
+	err = stub.PutState("TxnTransfer", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TxnTransfer key collection")
+	}
+	err = stub.PutState("Holds", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize Holds key collection")
+	}
+	err = stub.PutState("Disputes", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize Disputes key collection")
+	}
+	err = stub.PutState("Entities", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize Entities key collection")
+	}
+	err = stub.PutState("TxnAdjustment", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TxnAdjustment key collection")
+	}
+	err = stub.PutState("TxnBatch", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TxnBatch key collection")
+	}
+	err = stub.PutState("FraudRules", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize FraudRules key collection")
+	}
+	err = stub.PutState("FraudAlerts", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize FraudAlerts key collection")
+	}
+	err = stub.PutState("FeeRules", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize FeeRules key collection")
+	}
+	// A reseed keeps the pauses and parameter proposals of the admins and organisations
+	if deploy {
+		err = stub.PutState("Paused", []byte("{}"))
+		if err != nil {
+			fmt.Println("Failed to initialize Paused")
+		}
+		err = stub.PutState("PauseProposals", blankBytes)
+		if err != nil {
+			fmt.Println("Failed to initialize PauseProposals key collection")
+		}
+		err = stub.PutState("PauseEvents", blankBytes)
+		if err != nil {
+			fmt.Println("Failed to initialize PauseEvents key collection")
+		}
+		err = stub.PutState("ParamProposals", blankBytes)
+		if err != nil {
+			fmt.Println("Failed to initialize ParamProposals key collection")
+		}
+	}
+	err = stub.PutState("Journal", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize Journal key collection")
+	}
+	err = stub.PutState("TrialBalance", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TrialBalance")
+	}
+	err = stub.PutState("CreditLines", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize CreditLines key collection")
+	}
+	err = stub.PutState("Aliases", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize Aliases key collection")
+	}
+	err = stub.PutState("TaxRules", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TaxRules key collection")
+	}
+	err = stub.PutState("Receipts", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize Receipts key collection")
+	}
+	err = stub.PutState("GiftCards", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize GiftCards key collection")
+	}
+	err = stub.PutState("RedemptionItems", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize RedemptionItems key collection")
+	}
+	err = stub.PutState("TxnRedemption", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TxnRedemption key collection")
+	}
+
+	// Seed the entities and record the points and balance they were created with
+	supply := Supply{}
+	for _, entity := range genesis.Entities {
+		fmt.Println(entity)
+		err = t.putEntity(stub, entity.Name, entity)
+		if err != nil {
+			fmt.Println("Error writing state")
+			return nil, err
+		}
+		_, err = t.appendKey(stub, "Entities", entity.Name)
+		if err != nil {
+			return nil, err
+		}
+		supply.PointsMinted += entity.Points
+		supply.BalanceMinted += entity.Balance
+	}
+	bytes, err := json.Marshal(supply)
+	if err != nil {
+		fmt.Println("Error marshaling supply")
+		return nil, newError(codeInternal, "", "Error marshaling supply", "")
+	}
+	err = stub.PutState("Supply", bytes)
+	if err != nil {
+		fmt.Println("Failed to initialize Supply")
+		return nil, err
+	}
+
+	if deploy {
+		err = t.putGenesisConfig(stub, genesis)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("Initialization complete")
+
+	for _, product := range genesis.Products {
+		t.addProduct(stub, []string{product.Name, strconv.Itoa(product.Points), strconv.FormatFloat(product.Amount, 'f', -1, 64), product.Entity, strconv.Itoa(product.Qty), product.Category})
+	}
+
+	// What the genesis entities hold is issued to them
+	return nil, t.closeJournal(stub, "init", accountIssuance)
+}
+
+// Invoke isur entry point to invoke a chaincode function
+func (t *LoyaltyChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	bytes, err := t.invoke(stub, function, args)
+	return bytes, toChaincodeError(err)
+}
+
+// invoke - dispatches an Invoke call to its function
+func (t *LoyaltyChaincode) invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	fmt.Println("invoke is running " + function)
+
+	spec, ok := lookupFunction(function)
+	if !ok || spec.Kind != "invoke" {
+		fmt.Println("invoke did not find func: " + function)
+		return nil, newError(codeUnknownFunction, "function", "Received unknown function invocation", function)
+	}
+	err := t.checkPaused(stub, spec)
+	if err != nil {
+		return nil, err
+	}
+	args, err = checkArgs(spec, args)
+	if err != nil {
+		return nil, err
+	}
+	args, err = t.resolveEntityArgs(stub, spec, args)
+	if err != nil {
+		return nil, err
+	}
+	err = t.checkRole(stub, spec, args)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := spec.handler(t, stub, args)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing commits unless the movements of the transaction balance
+	err = t.closeJournal(stub, function, "")
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// Query is our entry point for queries
+func (t *LoyaltyChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	bytes, err := t.query(stub, function, args)
+	return bytes, toChaincodeError(err)
+}
+
+// query - dispatches a Query call to its function
+func (t *LoyaltyChaincode) query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	fmt.Println("query is running " + function)
+
+	spec, ok := lookupFunction(function)
+	if !ok || spec.Kind != "query" {
+		fmt.Println("query did not find func: " + function)
+		return nil, newError(codeUnknownFunction, "function", "Received unknown function query", function)
+	}
+	args, err := checkArgs(spec, args)
+	if err != nil {
+		return nil, err
+	}
+	args, err = t.resolveEntityArgs(stub, spec, args)
+	if err != nil {
+		return nil, err
+	}
+	err = t.checkRole(stub, spec, args)
+	if err != nil {
+		return nil, err
+	}
+	return spec.handler(t, stub, args)
+}
+
+// write - invoke function creating an entity with its opening points and balance.
+// Use adjustBalance to correct the points or balance of an existing entity.
+func (t *LoyaltyChaincode) write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	fmt.Println("running write()")
+
+	if len(args) != 4 && len(args) != 5 {
+		return nil, argCountError("4 or 5", "write")
+	}
+
+	// Customers only get a pseudonymous ID through registerCustomer
+	typeOf := args[0]
+	name := args[1]
+	if typeOf == "customer" {
+		return nil, newError(codeBadArgument, "type", "Customers are created with registerCustomer", name)
+	}
+	balance, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return nil, newError(codeBadArgument, "balance", "Invalid balance for write", args[2])
+	}
+	points, err := strconv.Atoi(args[3])
+	if err != nil {
+		return nil, newError(codeBadArgument, "points", "Invalid points for write", args[3])
+	}
+	entity := Entity{
+		Type:    typeOf,
+		Name:    name,
+		Balance: balance,
+		Points:  points,
+	}
+	if len(args) == 5 {
+		entity.Jurisdiction = args[4]
+	}
+	fmt.Println(entity)
+
+	// Existing entities are only changed through audited functions
+	bytes, err := stub.GetState(name)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+name, "")
+	}
+	if bytes != nil {
+		return nil, newError(codeDuplicate, "name", "Entity already exists, use adjustBalance to correct its points or balance", name)
+	}
+	// Aliases and IDs share one namespace so every reference stays unambiguous
+	bytes, err = stub.GetState("Alias_" + name)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of Alias_"+name, "")
+	}
+	if bytes != nil {
+		return nil, newError(codeDuplicate, "name", "Name is already in use as an alias", name)
+	}
+	_, err = t.appendKey(stub, "Entities", name)
+	if err != nil {
+		return nil, err
+	}
+	err = t.updateSupply(stub, "points", float64(entity.Points))
+	if err != nil {
+		return nil, err
+	}
+	err = t.updateSupply(stub, "balance", entity.Balance)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.putEntity(stub, name, entity)
+	if err != nil {
+		fmt.Println("Error writing state")
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// read - query function to read key/value pair
+func (t *LoyaltyChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("read() is running")
+
+	if len(args) != 1 {
+		return nil, argCountError("1", "read")
+	}
+
+	key := args[0] // name of Entity
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		fmt.Println("Error retrieving " + key)
+		return nil, newError(codeLedger, "", "Error retrieving "+key, "")
+	}
+	if bytes == nil {
+		return nil, newError(codeEntityNotFound, "name", "Entity not found", key)
+	}
+	customer := Entity{}
+	err = json.Unmarshal(bytes, &customer)
+	if err != nil {
+		fmt.Println("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity", key)
+	}
+	upgradeEntity(&customer)
+	if customer.ID == "" {
+		customer.ID = key
+	}
+	bytes, err = json.Marshal(customer)
+	if err != nil {
+		fmt.Println("Error marshaling customer")
+		return nil, newError(codeInternal, "", "Error marshaling customer", "")
+	}
+
+	fmt.Println(bytes)
+	return bytes, nil
+}
+
+func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	fmt.Println("buyGoods is running ")
+
+	if len(args) != 6 && len(args) != 8 && len(args) != 9 {
+		return nil, argCountError("6, or 8 to 9 with a gift card,", "buyGoods")
+	}
+	asset := args[0] //points, balance or giftcard
+	key1 := args[1]  //Entity1 ex: customer
+	key2 := args[2]  //Entity2 ex: merchant
+	key3 := args[3]  //Product Entity
+	qty, err := strconv.Atoi(args[4])
+	if err != nil || qty <= 0 {
+		return nil, newError(codeBadArgument, "qty", "Invalid quantity for buyGoods", args[4])
+	}
+
+	// A gift card pays like balance and is given by its ID and code, and the
+	// hash of a new code if the card keeps a balance
+	var card GiftCard
+	nextCodeHash := ""
+	if asset == "giftcard" {
+		if len(args) < 8 {
+			return nil, argCountError("8 to 9", "buyGoods with a gift card")
+		}
+		if len(args) == 9 {
+			nextCodeHash = args[8]
+		}
+		card, err = t.unlockGiftCard(stub, args[6], args[7])
+		if err != nil {
+			return nil, err
+		}
+		if card.Merchant != key2 {
+			return nil, newError(codeBadArgument, "cardID", "Gift card is not accepted by merchant", key2)
+		}
+	}
+	args = args[:6]
+
+	// Release the customer's expired holds so their funds are available again
+	err = t.releaseExpiredHolds(stub, key1)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := stub.GetState(key1)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key1, "")
+	}
+	if bytes == nil {
+		return nil, newError(codeEntityNotFound, "customer", "Entity not found", key1)
+	}
+	customer := Entity{}
+	err = json.Unmarshal(bytes, &customer)
+	if err != nil {
+		fmt.Println("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity", key1)
+	}
+	upgradeEntity(&customer)
+
+	bytes, err = stub.GetState(key2)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key2, "")
+	}
+	if bytes == nil {
+		return nil, newError(codeEntityNotFound, "merchant", "Entity not found", key2)
+	}
+	merchant := Entity{}
+	err = json.Unmarshal(bytes, &merchant)
+	if err != nil {
+		fmt.Println("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity", key2)
+	}
+	upgradeEntity(&merchant)
+	bytes, err = stub.GetState(key3)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key3, "")
+	}
+	if bytes == nil {
+		return nil, newError(codeNotFound, "product", "Product not found", key3)
+	}
+	product := Product{}
+	err = json.Unmarshal(bytes, &product)
+	if err != nil {
+		fmt.Println("Error Unmarshaling product bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling product Bytes", key3)
+	}
+	upgradeProduct(&product)
+	if product.Entity != key2 {
+		return nil, newError(codeBadArgument, "merchant", "Product is not sold by merchant", key2)
+	}
+	if product.Qty-product.Reserved < qty {
+		return nil, newError(codeInsufficientQuantity, "qty", "Insufficient quantity of "+key3, "")
+	}
+
+	// Purchases paid with money are taxed and the customer pays the gross
+	var line ReceiptLine
+	var taxes []TaxLine
+	value := float64(product.Points * qty)
+	if s.Compare(asset, "points") != 0 {
+		line, taxes, err = t.priceGoods(stub, merchant, product, qty)
+		if err != nil {
+			return nil, err
+		}
+		value = line.Gross
+	}
+
+	// Evaluate the fraud rules before moving any value
+	blocked, err := t.checkFraudRules(stub, "buyGoods", key1, key2, asset, value)
+	if err != nil {
+		return nil, err
+	}
+	if blocked != nil {
+		return blocked, nil
+	}
+
+	// Perform the transfer
+	fee := 0.0
+	feeAccount := ""
+	if s.Compare(asset, "points") == 0 {
+		fmt.Println("points transfer")
+		//X, err := strconv.Atoi(args[3])
+		if customer.Points-customer.HeldPoints >= product.Points*qty {
+			// The merchant pays the redemption fee out of the points received
+			fee, feeAccount, err = t.feeFor(stub, "redemption", key2, float64(product.Points*qty), true)
+			if err != nil {
+				return nil, err
+			}
+			// A fixed fee can exceed the points received
+			if fee > float64(product.Points*qty) {
+				err = t.checkCredit(stub, key2, merchant, "points", fee-float64(product.Points*qty))
+				if err != nil {
+					return nil, err
+				}
+			}
+			customer.Points = customer.Points - product.Points*qty
+			merchant.Points = merchant.Points + product.Points*qty - int(fee)
+			product.Qty -= qty
+			args[4] = strconv.Itoa(product.Points * qty)
+			fmt.Printf("customer Points = %d, merchant Points = %d\n", customer.Points, merchant.Points)
+		} else {
+			return nil, newError(codeInsufficientPoints, "", "Insufficient points to buy goods", "")
+		}
+	} else if asset == "giftcard" {
+		fmt.Println("gift card payment")
+		if card.Balance >= value {
+			card.Balance = card.Balance - value
+			merchant.Balance = merchant.Balance + value
+			product.Qty -= qty
+			customer.Spend += value
+			args[4] = strconv.FormatFloat(value, 'E', -1, 64)
+			fmt.Printf("gift card Balance = %f, merchant Balance = %f\n", card.Balance, merchant.Balance)
+		} else {
+			return nil, newError(codeInsufficientBalance, "cardID", "Insufficient gift card balance to buy goods", card.ID)
+		}
+	} else {
+		fmt.Println("balance to be added")
+		//X, err := strconv.ParseFloat(args[3], 64)
+		if customer.Balance-customer.HeldBalance >= value {
+			customer.Balance = customer.Balance - value
+			merchant.Balance = merchant.Balance + value
+			product.Qty -= qty
+			customer.Spend += value
+			args[4] = strconv.FormatFloat(value, 'E', -1, 64)
+			fmt.Printf("customer Balance = %f, merchant Balance = %f\n", customer.Balance, merchant.Balance)
+		} else {
+			return nil, newError(codeInsufficientBalance, "", "Insufficient balance to buy goods", "")
+		}
+	}
+	//product.Entity = customer.Name
+	// Write the customer/entity1 state back to the ledger
+	err = t.putEntity(stub, key1, customer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the merchant/entity2 state back to the ledger]
+	err = t.putEntity(stub, key2, merchant)
+	if err != nil {
+		return nil, err
+	}
+	// Write the product state back to the ledger
+	err = t.putProduct(stub, key3, product)
+	if err != nil {
+		return nil, err
+	}
+	if asset == "giftcard" {
+		card.Redemptions = append(card.Redemptions, stub.GetTxID())
+		err = rotateGiftCardCode(&card, nextCodeHash)
+		if err != nil {
+			return nil, err
+		}
+		err = t.putGiftCard(stub, card)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = t.payFee(stub, feeAccount, asset, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	args = append(args, stub.GetTxID())
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, blockTime.String())
+	args = append(args, strconv.Itoa(qty))
+	args = append(args, strconv.FormatFloat(fee, 'f', -1, 64), feeAccount)
+	_, err = t.putTxnGoods(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Compare(asset, "points") != 0 {
+		err = t.putReceipt(stub, key1, merchant, key2, asset, line, taxes, blockTime.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+func (t *LoyaltyChaincode) add(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	fmt.Println("add is running ")
+
+	if len(args) != 3 {
+		return nil, argCountError("3", "add")
+	}
+
+	asset := args[0] //points or balance
+	key := args[1]   //Entity ex: customer
+	// points to be issued are whole, balance may be fractional
+	value, err := parseAmount(asset, args[2])
+	if err != nil {
+		return nil, newError(codeBadArgument, "amount", "Invalid amount for add", args[2])
+	}
+
+	// GET the state of entity from the ledger
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return nil, newError(codeEntityNotFound, "entity", "Entity not found", key)
+	}
+
+	entity := Entity{}
+	err = json.Unmarshal(bytes, &entity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling entity Bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", "")
+	}
+	upgradeEntity(&entity)
+
+	// Evaluate the fraud rules before adding the assets
+	blocked, err := t.checkFraudRules(stub, "add", key, "", asset, value)
+	if err != nil {
+		return nil, err
+	}
+	if blocked != nil {
+		return blocked, nil
+	}
+
+	// Perform the addition of assests
+	if asset == "points" {
+		amt := int(value)
+		entity.Points = entity.Points + amt
+		entity.PointsEarned = entity.PointsEarned + amt
+		fmt.Println("entity Points = ", entity.Points)
+	} else {
+		entity.Balance = entity.Balance + value
+		fmt.Println("entity Points = ", entity.Points)
+	}
+	err = t.updateSupply(stub, asset, value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the state back to the ledger
+	err = t.putEntity(stub, key, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	ID := stub.GetTxID()
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, ID)
+	args = append(args, blockTime.String())
+	_, err = t.putTxnTopup(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (t *LoyaltyChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	fmt.Println("transfer is running ")
+
+	if len(args) != 5 {
+		return nil, argCountError("5", "transfer")
+	}
+
+	key := args[0]   // fromEntity ex: customer
+	key2 := args[1]  // toEntity ex: merchant
+	asset := args[2] // points or balance
+	value, err := parseAmount(asset, args[3])
+	if err != nil {
+		return nil, newError(codeBadArgument, "amount", "Invalid amount for transfer", args[3])
+	}
+	if key == key2 {
+		return nil, newError(codeBadArgument, "toEntity", "Cannot transfer to the same entity", key2)
+	}
+
+	// GET the state of fromEntity from the ledger
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return nil, newError(codeEntityNotFound, "fromEntity", "Entity not found", key)
+	}
+
+	fromEntity := Entity{}
+	err = json.Unmarshal(bytes, &fromEntity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling entity Bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", "")
+	}
+	upgradeEntity(&fromEntity)
+
+	// GET the state of toEntity from the ledger
+	bytes, err = stub.GetState(key2)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key2, "")
+	}
+	if bytes == nil {
+		return nil, newError(codeEntityNotFound, "toEntity", "Entity not found", key2)
+	}
+
+	toEntity := Entity{}
+	err = json.Unmarshal(bytes, &toEntity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling entity Bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", "")
+	}
+	upgradeEntity(&toEntity)
+
+	// Evaluate the fraud rules before moving any value
+	blocked, err := t.checkFraudRules(stub, "transfer", key, key2, asset, value)
+	if err != nil {
+		return nil, err
+	}
+	if blocked != nil {
+		return blocked, nil
+	}
+
+	// The sender may only go negative within a credit line
+	err = t.checkCredit(stub, key, fromEntity, asset, value)
+	if err != nil {
+		return nil, err
+	}
+
+	// The transfer fee follows the rate of the merchant involved, if any, and
+	// is taken from what the receiver is credited
+	feeMerchant := ""
+	if toEntity.Type == "merchant" {
+		feeMerchant = key2
+	} else if fromEntity.Type == "merchant" {
+		feeMerchant = key
+	}
+	fee, feeAccount, err := t.feeFor(stub, "transfer", feeMerchant, value, asset == "points")
+	if err != nil {
+		return nil, err
+	}
+	// A fixed fee can exceed what the receiver is credited
+	if fee > value {
+		err = t.checkCredit(stub, key2, toEntity, asset, fee-value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Perform transfer of assests
+	if asset == "points" {
+		amt := int(value)
+		fromEntity.Points = fromEntity.Points - amt
+		toEntity.Points = toEntity.Points + amt - int(fee)
+		toEntity.PointsEarned = toEntity.PointsEarned + amt - int(fee)
+		fmt.Println("from entity Points = ", fromEntity.Points)
+	} else {
+		fromEntity.Balance = fromEntity.Balance - value
+		toEntity.Balance = toEntity.Balance + value - fee
+		fmt.Println("from entity Points = ", fromEntity.Points)
+	}
+
+	// Write the state back to the ledger
+	err = t.putEntity(stub, key, fromEntity)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.putEntity(stub, key2, toEntity)
+	if err != nil {
+		return nil, err
+	}
+	err = t.payFee(stub, feeAccount, asset, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	ID := stub.GetTxID()
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, ID)
+	args = append(args, blockTime.String())
+	args = append(args, strconv.FormatFloat(fee, 'f', -1, 64), feeAccount)
+	_, err = t.putTxnTransfer(stub, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (t *LoyaltyChaincode) encashMerchant(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	fmt.Println("encashMerchant is running ")
+
+	if len(args) != 3 {
+		return nil, argCountError("3", "encashMerchant")
+	}
+
+	points, err := strconv.Atoi(args[2])
+	if err != nil || points <= 0 {
+		return nil, newError(codeBadArgument, "points", "Invalid points for encashMerchant", args[2])
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	// Quote the fee the bank will take when the encashment is approved
+	amount := int(float64(points) / t.getRate(stub, "encash"))
+	fee, feeAccount, err := t.feeFor(stub, "encash", args[0], float64(amount), false)
+	if err != nil {
+		return nil, err
+	}
+
+	key := "Encash_" + stub.GetTxID()
+	txn := TxnEncash{
+		Version:    schemaVersion,
+		Key:        key,
+		ID:         stub.GetTxID(),
+		Initiator:  args[0],
+		Bank:       args[1],
+		Points:     points,
+		Amount:     amount,
+		Fee:        fee,
+		FeeAccount: feeAccount,
+		Remarks:    "New Request for Encashment",
+		Time:       blockTime.String(),
+		Status:     "pending",
+	}
+
+	bytes, err := json.Marshal(txn)
+	if err != nil {
+		fmt.Println("Error marshaling encashMerchant")
+		return nil, newError(codeInternal, "", "Error marshaling encashMerchant", "")
+	}
+
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.appendKey(stub, "TxnEncash", key)
+}
+
+// approve - invoke function settling one pending encashment request, all of
+// it or only some of the points, the same way settleEncash does
+func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	fmt.Println("approve is running ")
+
+	/*
+	   args[] - {bank, request, points}
+	   points - optional, defaults to the points requested
+	*/
+	if len(args) != 2 && len(args) != 3 {
+		return nil, argCountError("2 or 3", "approve")
+	}
+
+	decision := EncashDecision{Request: args[1], Action: "approve"}
+	if len(args) == 3 && args[2] != "" {
+		points, err := strconv.Atoi(args[2])
+		if err != nil || points <= 0 {
+			return nil, newError(codeBadArgument, "points", "Invalid points for approve", args[2])
+		}
+		decision.Points = points
+	}
+	bytes, err := json.Marshal([]EncashDecision{decision})
+	if err != nil {
+		fmt.Println("Error marshaling encash decision")
+		return nil, newError(codeInternal, "", "Error marshaling encash decision", "")
+	}
+	return t.settleEncash(stub, []string{args[0], string(bytes)})
+}
+
+// checkPaused - rejects an invoke of a paused function, or of a value-moving
+// function while everything is paused. votePause is never paused so the admins
+// can always resume.
+func (t *LoyaltyChaincode) checkPaused(stub shim.ChaincodeStubInterface, spec FunctionSpec) error {
+	if spec.Name == "votePause" {
+		return nil
+	}
+	paused, err := t.getPaused(stub)
+	if err != nil {
+		return err
+	}
+	state, ok := paused[spec.Name]
+	if !ok && spec.MovesValue {
+		state, ok = paused["all"]
+	}
+	if ok {
+		return newError(codePaused, "function", spec.Name+" is paused: "+state.Reason, state.Scope)
+	}
+	return nil
+}
+
+// getPaused - paused scopes by scope
+func (t *LoyaltyChaincode) getPaused(stub shim.ChaincodeStubInterface) (map[string]PauseState, error) {
+	paused := make(map[string]PauseState)
+	bytes, err := stub.GetState("Paused")
+	if err != nil {
+		return paused, newError(codeLedger, "", "Failed to get state of Paused", "")
+	}
+	if bytes == nil {
+		return paused, nil
+	}
+	err = json.Unmarshal(bytes, &paused)
+	if err != nil {
+		fmt.Println("Error Unmarshaling Paused")
+		return paused, newError(codeCorruptRecord, "", "Error Unmarshaling Paused", "")
+	}
+	// Paused is one map rather than a key collection, so its scopes are
+	// brought up to schemaVersion as they are read
+	for scope, state := range paused {
+		if state.Version < schemaVersion {
+			state.Version = schemaVersion
+			paused[scope] = state
+		}
+	}
+	return paused, nil
+}
+
+// pauseQuorum - admin votes needed to pause or resume. It is set by the
+// genesis document and is not a parameter the organisations can change.
+func (t *LoyaltyChaincode) pauseQuorum(stub shim.ChaincodeStubInterface) int {
+	bytes, err := stub.GetState("PauseQuorum")
+	if err != nil || bytes == nil {
+		return 1
+	}
+	quorum, err := strconv.Atoi(string(bytes))
+	if err != nil || quorum < 1 {
+		return 1
+	}
+	return quorum
+}
+
+// votePause - invoke function recording an admin's vote to pause or resume a
+// scope. The first vote opens the proposal with its reason; the vote that
+// reaches the quorum applies it and records the event.
+func (t *LoyaltyChaincode) votePause(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("votePause is running ")
+
+	/*
+	   args[] - {scope, action, reason}
+	   scope - an invoke function name, or all for every value-moving function
+	*/
+	if len(args) != 3 {
+		return nil, argCountError("3", "votePause")
+	}
+	voter, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil || len(voter) == 0 {
+		return nil, newError(codeNotAuthorized, "", "Caller has no enrollmentId to vote with", "")
+	}
+	scope := args[0]
+	action := args[1]
+	if scope != "all" {
+		spec, ok := lookupFunction(scope)
+		if !ok || spec.Kind != "invoke" || spec.Name == "votePause" {
+			return nil, newError(codeBadArgument, "scope", "Scope must be all or an invoke function", scope)
+		}
+	}
+	if args[2] == "" {
+		return nil, newError(codeBadArgument, "reason", "A reason is required to pause or resume", "")
+	}
+
+	paused, err := t.getPaused(stub)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := paused[scope]; ok == (action == "pause") {
+		return nil, newError(codeInvalidState, "scope", "Cannot "+action+" "+scope+", it is already in that state", scope)
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	key := "PauseProposal_" + scope + "_" + action
+	proposal := PauseProposal{Version: schemaVersion, Scope: scope, Action: action, Reason: args[2], Time: blockTime.String()}
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &proposal)
+		if err != nil {
+			fmt.Println("Error Unmarshaling pause proposal")
+			return nil, newError(codeCorruptRecord, "", "Error Unmarshaling pause proposal", key)
+		}
+	} else {
+		_, err = t.appendKey(stub, "PauseProposals", key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, vote := range proposal.Votes {
+		if vote == string(voter) {
+			return nil, newError(codeDuplicate, "", "Admin has already voted to "+action+" "+scope, vote)
+		}
+	}
+	proposal.Votes = append(proposal.Votes, string(voter))
+
+	if len(proposal.Votes) < t.pauseQuorum(stub) {
+		bytes, err = json.Marshal(proposal)
+		if err != nil {
+			fmt.Println("Error marshaling pause proposal")
+			return nil, newError(codeInternal, "", "Error marshaling pause proposal", "")
+		}
+		return nil, stub.PutState(key, bytes)
+	}
+
+	// Quorum reached, apply the proposal
+	if action == "pause" {
+		paused[scope] = PauseState{Version: schemaVersion, Scope: scope, Reason: proposal.Reason, Since: blockTime.String(), Admins: proposal.Votes}
+	} else {
+		delete(paused, scope)
+	}
+	bytes, err = json.Marshal(paused)
+	if err != nil {
+		fmt.Println("Error marshaling Paused")
+		return nil, newError(codeInternal, "", "Error marshaling Paused", "")
+	}
+	err = stub.PutState("Paused", bytes)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return nil, err
+	}
+	err = t.removeKey(stub, "PauseProposals", key)
+	if err != nil {
+		return nil, err
+	}
+
+	event := PauseEvent{
+		Version: schemaVersion,
+		TxID:    stub.GetTxID(),
+		Scope:   scope,
+		Action:  action,
+		Reason:  proposal.Reason,
+		Admins:  proposal.Votes,
+		Time:    blockTime.String(),
+	}
+	bytes, err = json.Marshal(event)
+	if err != nil {
+		fmt.Println("Error marshaling pause event")
+		return nil, newError(codeInternal, "", "Error marshaling pause event", "")
+	}
+	err = stub.PutState("PauseEvent_"+event.TxID, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return t.appendKey(stub, "PauseEvents", "PauseEvent_"+event.TxID)
+}
+
+// getPauseStatus - query function listing paused scopes, open votes and the
+// pause and resume history
+func (t *LoyaltyChaincode) getPauseStatus(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getPauseStatus is running ")
+
+	status := PauseStatus{
+		Quorum:    t.pauseQuorum(stub),
+		Paused:    []PauseState{},
+		Proposals: []PauseProposal{},
+		Events:    []PauseEvent{},
+	}
+	paused, err := t.getPaused(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range paused {
+		status.Paused = append(status.Paused, state)
+	}
+	sort.Slice(status.Paused, func(a, b int) bool {
+		return status.Paused[a].Scope < status.Paused[b].Scope
+	})
+
+	for _, collection := range []string{"PauseProposals", "PauseEvents"} {
+		keysBytes, err := stub.GetState(collection)
+		if err != nil {
+			fmt.Println("Error retrieving " + collection + " keys")
+			return nil, newError(codeLedger, "", "Error retrieving "+collection+" keys", "")
+		}
+		var keys []string
+		err = json.Unmarshal(keysBytes, &keys)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + collection + " keys")
+			return nil, newError(codeCorruptRecord, "", "Error unmarshalling "+collection+" keys", "")
+		}
+		for _, value := range keys {
+			bytes, err := stub.GetState(value)
+			if err != nil {
+				return nil, newError(codeLedger, "", "Error retrieving "+value, "")
+			}
+			if collection == "PauseProposals" {
+				var proposal PauseProposal
+				err = json.Unmarshal(bytes, &proposal)
+				status.Proposals = append(status.Proposals, proposal)
+			} else {
+				var event PauseEvent
+				err = json.Unmarshal(bytes, &event)
+				status.Events = append(status.Events, event)
+			}
+			if err != nil {
+				fmt.Println("Error retrieving " + value)
+				return nil, newError(codeCorruptRecord, "", "Error retrieving "+value, "")
+			}
+		}
+	}
+
+	bytes, err := json.Marshal(status)
+	if err != nil {
+		fmt.Println("Error marshaling pause status")
+		return nil, newError(codeInternal, "", "Error marshaling pause status", "")
+	}
+	return bytes, nil
+}
+
+// paramOrganisation - organisation the caller votes for, the bank or merchant
+// its enrollment ID is or is an alias of
+func (t *LoyaltyChaincode) paramOrganisation(stub shim.ChaincodeStubInterface) (string, []string, error) {
+	organisation, err := t.callerEntity(stub)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var organisations []string
+	bytes, err := stub.GetState("ParamOrganisations")
+	if err != nil {
+		return "", nil, newError(codeLedger, "", "Failed to get state of ParamOrganisations", "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &organisations)
+		if err != nil {
+			fmt.Println("Error Unmarshaling ParamOrganisations")
+			return "", nil, newError(codeCorruptRecord, "", "Error Unmarshaling ParamOrganisations", "")
+		}
+	}
+	for _, member := range organisations {
+		if member == organisation {
+			return organisation, organisations, nil
+		}
+	}
+	return "", nil, newError(codeNotAuthorized, "", "Caller is not a member of a voting organisation", organisation)
+}
+
+// paramValue - current value of a parameter, read from the product for a
+// product parameter
+func (t *LoyaltyChaincode) paramValue(stub shim.ChaincodeStubInterface, name string) (float64, error) {
+	spec, productName, ok := lookupParameter(name)
+	if !ok {
+		return 0, newError(codeBadArgument, "parameter", "Unknown parameter", name)
+	}
+	if !spec.Product {
+		return t.getParam(stub, name), nil
+	}
+	product, err := t.getProduct(stub, productName)
+	if err != nil {
+		return 0, err
+	}
+	if spec.Name == "productPoints" {
+		return float64(product.Points), nil
+	}
+	return product.Amount, nil
+}
+
+// checkParamValue - validates a proposed value against the parameter's spec
+func (t *LoyaltyChaincode) checkParamValue(stub shim.ChaincodeStubInterface, name string, value float64) error {
+	spec, _, ok := lookupParameter(name)
+	if !ok {
+		return newError(codeBadArgument, "parameter", "Unknown parameter", name)
+	}
+	if spec.Type == "int" && value != math.Trunc(value) {
+		return newError(codeBadArgument, "value", name+" must be a whole number", strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	if spec.Min != nil && (value < *spec.Min || spec.Positive && value == *spec.Min) {
+		return newError(codeBadArgument, "value", "Value out of range for "+name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	if name == "paramThreshold" {
+		_, organisations, err := t.paramOrganisation(stub)
+		if err != nil {
+			return err
+		}
+		if int(value) > len(organisations) {
+			return newError(codeBadArgument, "value", "Threshold is above the number of organisations", strconv.Itoa(len(organisations)))
+		}
+	}
+	return nil
+}
+
+// applyParam - writes an approved value to the parameter store, or to the
+// product for a product parameter
+func (t *LoyaltyChaincode) applyParam(stub shim.ChaincodeStubInterface, name string, value float64) error {
+	spec, productName, _ := lookupParameter(name)
+	if spec.Product {
+		product, err := t.getProduct(stub, productName)
+		if err != nil {
+			return err
+		}
+		if spec.Name == "productPoints" {
+			product.Points = int(value)
+		} else {
+			product.Amount = value
+		}
+		return t.putProduct(stub, productName, product)
+	}
+
+	params, err := t.getParams(stub)
+	if err != nil {
+		return err
+	}
+	params[name] = value
+	return t.putParams(stub, params)
+}
+
+// getParamProposal - reads a parameter proposal from the ledger
+func (t *LoyaltyChaincode) getParamProposal(stub shim.ChaincodeStubInterface, id string) (ParamProposal, error) {
+	proposal := ParamProposal{}
+	bytes, err := stub.GetState("ParamProposal_" + id)
+	if err != nil {
+		return proposal, newError(codeLedger, "", "Failed to get state of ParamProposal_"+id, "")
+	}
+	if bytes == nil {
+		return proposal, newError(codeNotFound, "proposal", "Parameter proposal not found", id)
+	}
+	err = json.Unmarshal(bytes, &proposal)
+	if err != nil {
+		fmt.Println("Error Unmarshaling parameter proposal")
+		return proposal, newError(codeCorruptRecord, "", "Error Unmarshaling parameter proposal", id)
+	}
+	return proposal, nil
+}
+
+// putParamProposal - records a parameter proposal, applying it or rejecting it
+// once the votes decide it
+func (t *LoyaltyChaincode) putParamProposal(stub shim.ChaincodeStubInterface, proposal ParamProposal, organisations []string) error {
+	threshold := int(t.getParam(stub, "paramThreshold"))
+	if len(proposal.Approvals) >= threshold || len(organisations)-len(proposal.Rejections) < threshold {
+		blockTime, err := stub.GetTxTimestamp()
+		if err != nil {
+			return err
+		}
+		proposal.Closed = blockTime.String()
+		proposal.ClosedTx = stub.GetTxID()
+		proposal.Status = "rejected"
+	}
+	if len(proposal.Approvals) >= threshold {
+		// Checked again as the value may have been valid only when proposed,
+		// ex: a threshold above the organisations. Such a proposal is closed
+		// as rejected so the vote that decided it is still recorded.
+		err := t.checkParamValue(stub, proposal.Parameter, proposal.Value)
+		if cerr, ok := err.(*ChaincodeError); ok && cerr.Code == codeBadArgument {
+			proposal.Failure = cerr.Message
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(proposal.Approvals) >= threshold && proposal.Failure == "" {
+		var err error
+		proposal.Previous, err = t.paramValue(stub, proposal.Parameter)
+		if err != nil {
+			return err
+		}
+		err = t.applyParam(stub, proposal.Parameter, proposal.Value)
+		if err != nil {
+			return err
+		}
+		proposal.Status = "applied"
+	}
+
+	bytes, err := json.Marshal(proposal)
+	if err != nil {
+		fmt.Println("Error marshaling parameter proposal")
+		return newError(codeInternal, "", "Error marshaling parameter proposal", "")
+	}
+	return stub.PutState("ParamProposal_"+proposal.ID, bytes)
+}
+
+// proposeParameter - invoke function opening a proposal to change a parameter.
+// The proposing organisation approves it, so with a threshold of one it applies
+// straight away.
+func (t *LoyaltyChaincode) proposeParameter(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("proposeParameter is running ")
+
+	/*
+	   args[] - {parameter, value, reason}
+	   parameter - a name from the catalogue of getParameters, ex: encashRate or
+	               productPoints.Cappuccino
+	*/
+	if len(args) != 3 {
+		return nil, argCountError("3", "proposeParameter")
+	}
+	organisation, organisations, err := t.paramOrganisation(stub)
+	if err != nil {
+		return nil, err
+	}
+	value, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return nil, newError(codeBadArgument, "value", "Invalid parameter value", args[1])
+	}
+	err = t.checkParamValue(stub, args[0], value)
+	if err != nil {
+		return nil, err
+	}
+	// The product must exist when proposed, not only when applied
+	previous, err := t.paramValue(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if args[2] == "" {
+		return nil, newError(codeBadArgument, "reason", "A reason is required to propose a parameter change", "")
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	proposal := ParamProposal{
+		Version:    schemaVersion,
+		ID:         stub.GetTxID(),
+		Parameter:  args[0],
+		Value:      value,
+		Previous:   previous,
+		Reason:     args[2],
+		Proposer:   organisation,
+		Approvals:  []string{organisation},
+		Rejections: []string{},
+		Status:     "open",
+		Time:       blockTime.String(),
+	}
+	err = t.putParamProposal(stub, proposal, organisations)
+	if err != nil {
+		return nil, err
+	}
+	return t.appendKey(stub, "ParamProposals", "ParamProposal_"+proposal.ID)
+}
+
+// voteParameter - invoke function recording an organisation's approval or
+// rejection of an open parameter proposal
+func (t *LoyaltyChaincode) voteParameter(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("voteParameter is running ")
+
+	/*
+	   args[] - {proposal, vote}
+	   vote - approve or reject
+	*/
+	if len(args) != 2 {
+		return nil, argCountError("2", "voteParameter")
+	}
+	organisation, organisations, err := t.paramOrganisation(stub)
+	if err != nil {
+		return nil, err
+	}
+	proposal, err := t.getParamProposal(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if proposal.Status != "open" {
+		return nil, newError(codeInvalidState, "proposal", "Parameter proposal is "+proposal.Status, proposal.ID)
+	}
+	for _, voted := range append(proposal.Approvals, proposal.Rejections...) {
+		if voted == organisation {
+			return nil, newError(codeDuplicate, "", "Organisation has already voted on the proposal", organisation)
+		}
+	}
+
+	if args[1] == "approve" {
+		proposal.Approvals = append(proposal.Approvals, organisation)
+	} else {
+		proposal.Rejections = append(proposal.Rejections, organisation)
+	}
+	return nil, t.putParamProposal(stub, proposal, organisations)
+}
+
+// getParameters - query function returning the parameter values and how they
+// are governed
+func (t *LoyaltyChaincode) getParameters(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getParameters is running ")
+
+	set := ParamSet{
+		Organisations: []string{},
+		Threshold:     int(t.getParam(stub, "paramThreshold")),
+		Parameters:    []ParamValue{},
+		Catalogue:     parameterSpecs,
+	}
+	bytes, err := stub.GetState("ParamOrganisations")
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of ParamOrganisations", "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &set.Organisations)
+		if err != nil {
+			fmt.Println("Error Unmarshaling ParamOrganisations")
+			return nil, newError(codeCorruptRecord, "", "Error Unmarshaling ParamOrganisations", "")
+		}
+	}
+	for _, spec := range parameterSpecs {
+		if spec.Product {
+			continue
+		}
+		set.Parameters = append(set.Parameters, ParamValue{
+			Name:        spec.Name,
+			Value:       t.getParam(stub, spec.Name),
+			Default:     spec.Default,
+			Description: spec.Description,
+		})
+	}
+
+	bytes, err = json.Marshal(set)
+	if err != nil {
+		fmt.Println("Error marshaling parameters")
+		return nil, newError(codeInternal, "", "Error marshaling parameters", "")
+	}
+	return bytes, nil
+}
+
+// getParamProposals - query function listing parameter proposals in the order
+// they were made, optionally by parameter and status
+func (t *LoyaltyChaincode) getParamProposals(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getParamProposals is running ")
+
+	if len(args) > 2 {
+		return nil, argCountError("0 to 2", "getParamProposals")
+	}
+	parameter, status := "", ""
+	if len(args) > 0 {
+		parameter = args[0]
+	}
+	if len(args) > 1 {
+		status = args[1]
+	}
+
+	proposals := []ParamProposal{}
+
+	keysBytes, err := stub.GetState("ParamProposals")
+	if err != nil {
+		fmt.Println("Error retrieving ParamProposals keys")
+		return nil, newError(codeLedger, "", "Error retrieving ParamProposals keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling ParamProposals keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling ParamProposals keys", "")
+	}
+
+	for _, value := range keys {
+		proposal, err := t.getParamProposal(stub, s.TrimPrefix(value, "ParamProposal_"))
+		if err != nil {
+			return nil, err
+		}
+		if (parameter == "" || proposal.Parameter == parameter) && (status == "" || proposal.Status == status) {
+			proposals = append(proposals, proposal)
+		}
+	}
+
+	bytes, err := json.Marshal(proposals)
+	if err != nil {
+		fmt.Println("Error marshaling parameter proposals")
+		return nil, newError(codeInternal, "", "Error marshaling parameter proposals", "")
+	}
+	return bytes, nil
+}
+
+// grantCreditLine - invoke function granting, or replacing, a merchant's
+// credit line for points or balance
+func (t *LoyaltyChaincode) grantCreditLine(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("grantCreditLine is running ")
+
+	/*
+	   args[] - {bank, merchant, asset, limit, interestRate, fee, expiryDays}
+	*/
+	if len(args) != 7 {
+		return nil, argCountError("7", "grantCreditLine")
+	}
+	bank, err := t.getEntity(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if bank.Type != "bank" {
+		return nil, newError(codeNotAuthorized, "bank", "Only a bank can grant credit lines", args[0])
+	}
+	merchant, err := t.getEntity(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if merchant.Type != "merchant" {
+		return nil, newError(codeBadArgument, "merchant", "Credit lines are only granted to merchants", args[1])
+	}
+	asset := args[2]
+	limit, err := parseAmount(asset, args[3])
+	if err != nil || limit < 0 {
+		return nil, newError(codeBadArgument, "limit", "Invalid limit for credit line", args[3])
+	}
+	interestRate, err := strconv.ParseFloat(args[4], 64)
+	if err != nil || interestRate < 0 {
+		return nil, newError(codeBadArgument, "interestRate", "Invalid interest rate for credit line", args[4])
+	}
+	fee, err := strconv.ParseFloat(args[5], 64)
+	if err != nil || fee < 0 {
+		return nil, newError(codeBadArgument, "fee", "Invalid fee for credit line", args[5])
+	}
+	days, err := strconv.Atoi(args[6])
+	if err != nil || days <= 0 {
+		return nil, newError(codeBadArgument, "expiryDays", "Invalid expiry for credit line", args[6])
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	line := CreditLine{
+		Version:      schemaVersion,
+		Merchant:     args[1],
+		Bank:         args[0],
+		Asset:        asset,
+		Limit:        limit,
+		InterestRate: interestRate,
+		Fee:          fee,
+		Expiry:       blockTime.Seconds + int64(days)*24*60*60,
+		Status:       "active",
+		Granted:      blockTime.String(),
+	}
+	key := "CreditLine_" + line.Merchant + "_" + asset
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	err = t.putCreditLine(stub, line)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, nil
+	}
+	return t.appendKey(stub, "CreditLines", key)
+}
+
+// revokeCreditLine - invoke function stopping further use of a credit line
+func (t *LoyaltyChaincode) revokeCreditLine(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("revokeCreditLine is running ")
+
+	/*
+	   args[] - {bank, merchant, asset}
+	*/
+	if len(args) != 3 {
+		return nil, argCountError("3", "revokeCreditLine")
+	}
+	line, err := t.getCreditLine(stub, args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	if line == nil {
+		return nil, newError(codeNotFound, "merchant", "Credit line not found", args[1])
+	}
+	if line.Bank != args[0] {
+		return nil, newError(codeNotAuthorized, "bank", "Credit line was granted by another bank", args[0])
+	}
+	line.Status = "revoked"
+	return nil, t.putCreditLine(stub, *line)
+}
+
+// getCreditLine - a merchant's credit line for an asset, nil when there is none
+func (t *LoyaltyChaincode) getCreditLine(stub shim.ChaincodeStubInterface, merchant string, asset string) (*CreditLine, error) {
+	key := "CreditLine_" + merchant + "_" + asset
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var line CreditLine
+	err = json.Unmarshal(bytes, &line)
+	if err != nil {
+		fmt.Println("Error Unmarshaling credit line")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling credit line", key)
+	}
+	return &line, nil
+}
+
+// putCreditLine - writes a credit line back to the ledger
+func (t *LoyaltyChaincode) putCreditLine(stub shim.ChaincodeStubInterface, line CreditLine) error {
+	bytes, err := json.Marshal(line)
+	if err != nil {
+		fmt.Println("Error marshaling credit line")
+		return newError(codeInternal, "", "Error marshaling credit line", "")
+	}
+	return stub.PutState("CreditLine_"+line.Merchant+"_"+line.Asset, bytes)
+}
+
+// creditPosition - own funds, credit used and credit available of an entity
+func (t *LoyaltyChaincode) creditPosition(stub shim.ChaincodeStubInterface, key string, entity Entity, asset string) (CreditPosition, error) {
+	position := CreditPosition{Merchant: key, Asset: asset}
+	funds := entity.Balance - entity.HeldBalance
+	if asset == "points" {
+		funds = float64(entity.Points - entity.HeldPoints)
+	}
+	if funds >= 0 {
+		position.Funds = funds
+	} else {
+		position.Used = -funds
+	}
+
+	line, err := t.getCreditLine(stub, key, asset)
+	if err != nil {
+		return position, err
+	}
+	position.Line = line
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return position, err
+	}
+	if line != nil && line.Status == "active" && blockTime.Seconds <= line.Expiry && line.Limit > position.Used {
+		position.Available = line.Limit - position.Used
+	}
+	return position, nil
+}
+
+// checkCredit - rejects a debit that would take an entity below zero by more
+// than its credit line has available
+func (t *LoyaltyChaincode) checkCredit(stub shim.ChaincodeStubInterface, key string, entity Entity, asset string, debit float64) error {
+	position, err := t.creditPosition(stub, key, entity, asset)
+	if err != nil {
+		return err
+	}
+	if debit <= position.Funds+position.Available {
+		return nil
+	}
+	if asset == "points" {
+		return newError(codeInsufficientPoints, "", "Insufficient points, including credit line, for "+key, strconv.FormatFloat(position.Available, 'f', -1, 64))
+	}
+	return newError(codeInsufficientBalance, "", "Insufficient balance, including credit line, for "+key, strconv.FormatFloat(position.Available, 'f', -1, 64))
+}
+
+// getCreditPosition - query function showing how much of a merchant's credit
+// line is used and how much is available
+func (t *LoyaltyChaincode) getCreditPosition(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getCreditPosition is running ")
+
+	if len(args) != 2 {
+		return nil, argCountError("2", "getCreditPosition")
+	}
+	entity, err := t.getEntity(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	position, err := t.creditPosition(stub, args[0], entity, args[1])
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(position)
+	if err != nil {
+		fmt.Println("Error marshaling credit position")
+		return nil, newError(codeInternal, "", "Error marshaling credit position", "")
+	}
+	return bytes, nil
+}
+
+// settleEncash - invoke function settling many pending encashment requests of
+// a bank at once. Every decision is checked, and the bank's balance must cover
+// all of the approvals, before anything is written.
+func (t *LoyaltyChaincode) settleEncash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("settleEncash is running ")
+
+	/*
+	   args[] - {bank, decisions}
+	   decisions - [{"request": "Encash_<txID>", "action": "approve", "points": 500},
+	                {"request": "Encash_<txID>", "action": "reject", "reason": "..."}]
+	*/
+	if len(args) != 2 {
+		return nil, argCountError("2", "settleEncash")
+	}
+	bankKey := args[0]
+	var decisions []EncashDecision
+	err := json.Unmarshal([]byte(args[1]), &decisions)
+	if err != nil {
+		return nil, newError(codeBadArgument, "decisions", "Invalid encashment decisions", err.Error())
+	}
+	if len(decisions) == 0 {
+		return nil, newError(codeBadArgument, "decisions", "No decisions for settleEncash", "")
+	}
+
+	bank, err := t.getEntity(stub, bankKey)
+	if err != nil {
+		return nil, err
+	}
+	rate := t.getRate(stub, "encash")
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	merchants := make(map[string]Entity)
+	var order []string
+	var requests []TxnEncash
+	seen := make(map[string]bool)
+	paid := 0.0
+	for _, decision := range decisions {
+		if seen[decision.Request] {
+			return nil, newError(codeBadArgument, "decisions", "Request decided twice", decision.Request)
+		}
+		seen[decision.Request] = true
+
+		bytes, err := stub.GetState(decision.Request)
+		if err != nil {
+			return nil, newError(codeLedger, "", "Failed to get state of "+decision.Request, "")
+		}
+		if bytes == nil {
+			return nil, newError(codeNotFound, "decisions", "Encash request not found", decision.Request)
+		}
+		var request TxnEncash
+		err = json.Unmarshal(bytes, &request)
+		if err != nil {
+			fmt.Println("Error Unmarshaling encash request")
+			return nil, newError(codeCorruptRecord, "", "Error Unmarshaling encash request", decision.Request)
+		}
+		upgradeTxnEncash(&request)
+		if request.Status != "pending" {
+			return nil, newError(codeInvalidState, "decisions", "Encash request is not pending", decision.Request)
+		}
+		if request.Bank != bankKey {
+			return nil, newError(codeNotAuthorized, "decisions", "Encash request was made to another bank", decision.Request)
+		}
+
+		request.Reason = decision.Reason
+		request.Settled = blockTime.String()
+		request.SettledTx = stub.GetTxID()
+		request.Fee = 0
+		request.FeeAccount = ""
+		switch decision.Action {
+		case "reject":
+			request.Status = "rejected"
+			requests = append(requests, request)
+			continue
+		case "approve":
+		default:
+			return nil, newError(codeBadArgument, "decisions", "Action must be approve or reject", decision.Request)
+		}
+
+		points := decision.Points
+		if points == 0 {
+			points = request.Points
+		}
+		if points < 0 || points > request.Points {
+			return nil, newError(codeBadArgument, "decisions", "Approved points must be between 1 and the points requested", decision.Request)
+		}
+		merchant, ok := merchants[request.Initiator]
+		if !ok {
+			merchant, err = t.getEntity(stub, request.Initiator)
+			if err != nil {
+				return nil, err
+			}
+			order = append(order, request.Initiator)
+		}
+		err = t.checkCredit(stub, request.Initiator, merchant, "points", float64(points))
+		if err != nil {
+			return nil, err
+		}
+
+		amount := int(float64(points) / rate)
+		fee, feeAccount, err := t.feeFor(stub, "encash", request.Initiator, float64(amount), false)
+		if err != nil {
+			return nil, err
+		}
+		// A fixed fee can exceed the amount paid out
+		if fee > float64(amount) {
+			err = t.checkCredit(stub, request.Initiator, merchant, "balance", fee-float64(amount))
+			if err != nil {
+				return nil, err
+			}
+		}
+		merchant.Points -= points
+		merchant.Balance += float64(amount) - fee
+		merchants[request.Initiator] = merchant
+		bank.Points += points
+		bank.Balance -= float64(amount)
+		paid += float64(amount)
+
+		request.Status = "approved"
+		if points < request.Points {
+			request.Status = "partial"
+		}
+		request.ApprovedPoints = points
+		request.ApprovedAmount = amount
+		request.Fee = fee
+		request.FeeAccount = feeAccount
+		requests = append(requests, request)
+	}
+	if bank.Balance-bank.HeldBalance < 0 {
+		return nil, newError(codeInsufficientBalance, "", "Insufficient bank balance to settle encashments", strconv.FormatFloat(paid, 'f', -1, 64))
+	}
+
+	// Everything is valid, write the entities then each outcome
+	for _, key := range order {
+		err = t.putEntity(stub, key, merchants[key])
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = t.putEntity(stub, bankKey, bank)
+	if err != nil {
+		return nil, err
+	}
+	for _, request := range requests {
+		err = t.payFee(stub, request.FeeAccount, "balance", request.Fee)
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := json.Marshal(request)
+		if err != nil {
+			fmt.Println("Error marshaling encash request")
+			return nil, newError(codeInternal, "", "Error marshaling encash request", "")
+		}
+		err = stub.PutState(request.Key, bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bytes, err := json.Marshal(requests)
+	if err != nil {
+		fmt.Println("Error marshaling encash outcomes")
+		return nil, newError(codeInternal, "", "Error marshaling encash outcomes", "")
+	}
+	return bytes, nil
+}
+
+func (t *LoyaltyChaincode) addProduct(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("adding product information")
+	if len(args) != 5 && len(args) != 6 {
+		return nil, argCountError("5 or 6", "addProduct")
+	}
+	amt, err := strconv.ParseFloat(args[2], 64)
+	points, err := strconv.Atoi(args[1])
+	qty, err := strconv.Atoi(args[4])
+
+	product := Product{
+		Version: schemaVersion,
+		Name:    args[0],
+		Points:  points,
+		Amount:  amt,
+		Entity:  args[3],
+		Qty:     qty,
+	}
+	if len(args) == 6 {
+		product.Category = args[5]
+	}
+
+	bytes, err := json.Marshal(product)
+	if err != nil {
+		fmt.Println("Error marshaling product")
+		return nil, newError(codeInternal, "", "Error marshaling product", "")
+	}
+
+	err = stub.PutState(product.Name, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err = stub.GetState("Products")
+	if err != nil {
+
+	}
+	var keys []string
+	err = json.Unmarshal(bytes, &keys)
+	if err != nil {
+
+	}
+	keys = append(keys, args[0])
+	bytes, err = json.Marshal(keys)
+	if err != nil {
+		fmt.Println("Error marshaling product keys")
+		return nil, newError(codeInternal, "", "Error marshaling product keys", "")
+	}
+	err = stub.PutState("Products", bytes)
+	if err != nil {
+
+	}
+
+	return nil, nil
+}
+
+func (t *LoyaltyChaincode) getAllProducts(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	fmt.Println("getAllProducts is running ")
+
+	var products []Product
+
+	// Get list of all the keys - Products
+	keysBytes, err := stub.GetState("Products")
+	if err != nil {
+		fmt.Println("Error retrieving Products")
+		return nil, newError(codeLedger, "", "Error retrieving Products", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling Products")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling Products", "")
+	}
+
+	// Get each product from "Products" keys
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var product Product
+		err = json.Unmarshal(bytes, &product)
+		if err != nil {
+			fmt.Println("Error retrieving product " + value)
+			return nil, newError(codeLedger, "", "Error retrieving product "+value, "")
+		}
+		upgradeProduct(&product)
+
+		fmt.Println("Appending product " + value)
+		products = append(products, product)
+	}
+
+	bytes, err := json.Marshal(products)
+	if err != nil {
+		fmt.Println("Error marshaling product")
+		return nil, newError(codeInternal, "", "Error marshaling product", "")
+	}
+	return bytes, nil
+}
+
+func (t *LoyaltyChaincode) putTxnTopup(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("putTxnTopup is running ")
+
+	if len(args) != 5 {
+		return nil, argCountError("5", "putTxnTopup")
+	}
+	txn := TxnTopup{
+		Version:   schemaVersion,
+		Initiator: args[1],
+		Remarks:   args[0] + " addedd",
+		ID:        args[3],
+		Time:      args[4],
+		Value:     args[2],
+		Asset:     args[0],
+	}
+
+	bytes, err := json.Marshal(txn)
+	if err != nil {
+		fmt.Println("Error marshaling TxnTopup")
+		return nil, newError(codeInternal, "", "Error marshaling TxnTopup", "")
+	}
+
+	err = stub.PutState(txn.ID, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.appendKey(stub, "TxnTopup", txn.ID)
+}
+
+func (t *LoyaltyChaincode) getAllTxnTopup(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getAllTxnTopup is running ")
+
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var txns []TxnTopup
+
+	// Get list of all the keys - TxnTopup
+	keysBytes, err := stub.GetState("TxnTopup")
+	if err != nil {
+		fmt.Println("Error retrieving TxnTopup keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnTopup keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling TxnTopup key")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnTopup keys", "")
+	}
+
+	// Get each product txn "TxnTopup" keys
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var txn TxnTopup
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+		upgradeTxnTopup(&txn)
+
+		ok, err := visibleParty(visible, txn.Initiator)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		fmt.Println("Appending txn" + value)
+		txns = append(txns, txn)
+	}
+
+	bytes, err := json.Marshal(txns)
+	if err != nil {
+		fmt.Println("Error marshaling txns topup")
+		return nil, newError(codeInternal, "", "Error marshaling txns topup", "")
+	}
+	return bytes, nil
+}
+
+func (t *LoyaltyChaincode) putTxnGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("putTxnGoods is running ")
+
+	if len(args) != 9 && len(args) != 11 {
+		return nil, argCountError("9 or 11", "putTxnGoods")
+	}
+	qty, err := strconv.Atoi(args[8])
+	if err != nil {
+		return nil, newError(codeBadArgument, "qty", "Invalid quantity for putTxnGoods", args[8])
+	}
+	value, err := strconv.ParseFloat(args[4], 64)
+	if err != nil {
+		return nil, newError(codeBadArgument, "value", "Invalid value for putTxnGoods", args[4])
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	txn := TxnGoods{
+		Version:   schemaVersion,
+		Sender:    args[1],
+		Receiver:  args[2],
+		Remarks:   args[3] + " - " + args[5],
+		ID:        args[6],
+		Time:      args[7],
+		Value:     args[4],
+		Asset:     args[0],
+		Product:   args[3],
+		Qty:       qty,
+		Timestamp: blockTime.Seconds,
+	}
+	if txn.Asset == "points" {
+		txn.Points = int(value)
+	} else {
+		txn.Amount = value
+	}
+	if len(args) == 11 {
+		txn.Fee, err = strconv.ParseFloat(args[9], 64)
+		if err != nil {
+			return nil, newError(codeBadArgument, "fee", "Invalid fee for putTxnGoods", args[9])
+		}
+		txn.FeeAccount = args[10]
+	}
+
+	bytes, err := json.Marshal(txn)
+	if err != nil {
+		fmt.Println("Error marshaling TxnGoods")
+		return nil, newError(codeInternal, "", "Error marshaling TxnGoods", "")
+	}
+
+	err = stub.PutState(txn.ID, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.appendKey(stub, "TxnGoods", txn.ID)
+}
+
+func (t *LoyaltyChaincode) getAllTxnGoods(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getAllTxnGoods is running ")
+
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var txns []TxnGoods
+
+	// Get list of all the keys - TxnGoods
+	keysBytes, err := stub.GetState("TxnGoods")
+	if err != nil {
+		fmt.Println("Error retrieving TxnGoods keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnGoods keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling TxnGoods key")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnGoods keys", "")
+	}
+
+	// Get each txn from "TxnGoods" keys
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var txn TxnGoods
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+		upgradeTxnGoods(&txn)
+
+		ok, err := visibleParty(visible, txn.Sender, txn.Receiver)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		fmt.Println("Appending txn goods details " + value)
+		txns = append(txns, txn)
+	}
+
+	bytes, err := json.Marshal(txns)
+	if err != nil {
+		fmt.Println("Error marshaling txns TxnGoods")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnGoods", "")
+	}
+	return bytes, nil
+}
+
+func (t *LoyaltyChaincode) putTxnTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("putTxnTransfer is running ")
+
+	if len(args) != 7 && len(args) != 9 {
+		return nil, argCountError("7 or 9", "putTxnTransfer")
+	}
+	txn := TxnTransfer{
+		Version:  schemaVersion,
+		Sender:   args[0],
+		Receiver: args[1],
+		Remarks:  args[4],
+		ID:       args[5],
+		Time:     args[6],
+		Value:    args[3],
+		Asset:    args[2],
+	}
+	if len(args) == 9 {
+		fee, err := strconv.ParseFloat(args[7], 64)
+		if err != nil {
+			return nil, newError(codeBadArgument, "fee", "Invalid fee for putTxnTransfer", args[7])
+		}
+		txn.Fee = fee
+		txn.FeeAccount = args[8]
+	}
+
+	bytes, err := json.Marshal(txn)
+	if err != nil {
+		fmt.Println("Error marshaling TxnTransfer")
+		return nil, newError(codeInternal, "", "Error marshaling TxnTransfer", "")
+	}
+
+	err = stub.PutState(txn.ID, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.appendKey(stub, "TxnTransfer", txn.ID)
+}
+
+func (t *LoyaltyChaincode) getAllTxnTransfer(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getAllTxnTransfer is running ")
+
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var txns []TxnTransfer
+
+	// Get list of all the keys - TxnGoods
+	keysBytes, err := stub.GetState("TxnTransfer")
+	if err != nil {
+		fmt.Println("Error retrieving TxnTransfer keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnTransfer keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling TxnTransfer key")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnTransfer keys", "")
+	}
+
+	// Get each txn from "TxnTransfer" keys
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var txn TxnTransfer
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+		upgradeTxnTransfer(&txn)
+
+		ok, err := visibleParty(visible, txn.Sender, txn.Receiver)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		fmt.Println("Appending txn goods details " + value)
+		txns = append(txns, txn)
+	}
+
+	bytes, err := json.Marshal(txns)
+	if err != nil {
+		fmt.Println("Error marshaling txns TxnTransfer")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnTransfer", "")
+	}
+	return bytes, nil
+}
+
+func (t *LoyaltyChaincode) getAllTxnEncash(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getAllTxnEncash is running ")
+
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var txns []TxnEncash
+
+	// Get list of all the keys - TxnGoods
+	keysBytes, err := stub.GetState("TxnEncash")
+	if err != nil {
+		fmt.Println("Error retrieving TxnEncash keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnEncash keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling TxnEncash key")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnEncash keys", "")
+	}
+
+	// Get each txn from "TxnGoods" keys
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var txn TxnEncash
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+		upgradeTxnEncash(&txn)
+
+		ok, err := visibleParty(visible, txn.Initiator, txn.Bank)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		fmt.Println("Appending txn encash details " + value)
+		txns = append(txns, txn)
+	}
+
+	bytes, err := json.Marshal(txns)
+	if err != nil {
+		fmt.Println("Error marshaling txns TxnEncash")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnEncash", "")
+	}
+	return bytes, nil
+}
+func (t *LoyaltyChaincode) appendKey(stub shim.ChaincodeStubInterface, primeKey string, key string) ([]byte, error) {
+	fmt.Println("appendKey is running " + primeKey + " " + key)
+
+	bytes, err := stub.GetState(primeKey)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	err = json.Unmarshal(bytes, &keys)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, key)
+	bytes, err = json.Marshal(keys)
+	if err != nil {
+		fmt.Println("Error marshaling " + primeKey)
+		return nil, newError(codeInternal, "", "Error marshaling keys"+primeKey, "")
+	}
+	err = stub.PutState(primeKey, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// removeKey - drops a key from a key collection
+func (t *LoyaltyChaincode) removeKey(stub shim.ChaincodeStubInterface, primeKey string, key string) error {
+	fmt.Println("removeKey is running " + primeKey + " " + key)
+
+	bytes, err := stub.GetState(primeKey)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	err = json.Unmarshal(bytes, &keys)
+	if err != nil {
+		return err
+	}
+	remaining := []string{}
+	for _, other := range keys {
+		if other != key {
+			remaining = append(remaining, other)
+		}
+	}
+	bytes, err = json.Marshal(remaining)
+	if err != nil {
+		fmt.Println("Error marshaling " + primeKey)
+		return newError(codeInternal, "", "Error marshaling keys"+primeKey, "")
+	}
+	return stub.PutState(primeKey, bytes)
+}
+
+// hasKey - checks whether a key collection holds a key
+func (t *LoyaltyChaincode) hasKey(stub shim.ChaincodeStubInterface, primeKey string, key string) (bool, error) {
+	bytes, err := stub.GetState(primeKey)
+	if err != nil {
+		return false, newError(codeLedger, "", "Failed to get state of "+primeKey, "")
+	}
+	var keys []string
+	err = json.Unmarshal(bytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling " + primeKey + " keys")
+		return false, newError(codeCorruptRecord, "", "Error unmarshalling "+primeKey+" keys", "")
+	}
+	for _, other := range keys {
+		if other == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isAdmin - checks the role attribute of the caller's certificate, or its
+// enrollment ID against the admins listed in the genesis document
+func (t *LoyaltyChaincode) isAdmin(stub shim.ChaincodeStubInterface) bool {
+	role, err := stub.ReadCertAttribute("role")
+	if err == nil && string(role) == "admin" {
+		return true
+	}
+
+	enrollmentID, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil {
+		fmt.Println("Error reading enrollmentId attribute of caller")
+		return false
+	}
+	bytes, err := stub.GetState("Admins")
+	if err != nil || bytes == nil {
+		return false
+	}
+	var admins []string
+	err = json.Unmarshal(bytes, &admins)
+	if err != nil {
+		fmt.Println("Error unmarshalling Admins")
+		return false
+	}
+	for _, admin := range admins {
+		if admin == string(enrollmentID) {
+			return true
+		}
+	}
+	return false
+}
+
+// putFraudRule - admin invoke to create or replace a fraud rule
+func (t *LoyaltyChaincode) putFraudRule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("putFraudRule is running ")
+
+	/*
+	   args[] - {id, kind, function, asset, count, windowMinutes, threshold, action, enabled}
+	*/
+	if len(args) != 9 {
+		return nil, argCountError("9", "putFraudRule")
+	}
+
+	count, err := strconv.Atoi(args[4])
+	if err != nil || count < 0 {
+		return nil, newError(codeBadArgument, "count", "Invalid count for fraud rule", args[4])
+	}
+	minutes, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil || minutes <= 0 {
+		return nil, newError(codeBadArgument, "windowMinutes", "Invalid window for fraud rule", args[5])
+	}
+	threshold, err := strconv.ParseFloat(args[6], 64)
+	if err != nil {
+		return nil, newError(codeBadArgument, "threshold", "Invalid threshold for fraud rule", args[6])
+	}
+	enabled, err := strconv.ParseBool(args[8])
+	if err != nil {
+		return nil, newError(codeBadArgument, "enabled", "Invalid enabled flag for fraud rule", args[8])
+	}
+
+	rule := FraudRule{
+		Version:   schemaVersion,
+		ID:        args[0],
+		Kind:      args[1],
+		Function:  args[2],
+		Asset:     args[3],
+		Count:     count,
+		Window:    minutes * 60,
+		Threshold: threshold,
+		Action:    args[7],
+		Enabled:   enabled,
+	}
+
+	// redeemAfterTopup and newReceivers only make sense on one function
+	switch rule.Kind {
+	case "velocity":
+		if rule.Function != "transfer" && rule.Function != "buyGoods" && rule.Function != "add" {
+			return nil, newError(codeBadArgument, "function", "Unknown function for velocity rule", rule.Function)
+		}
+	case "redeemAfterTopup":
+		rule.Function = "buyGoods"
+	case "newReceivers":
+		rule.Function = "transfer"
+	default:
+		return nil, newError(codeBadArgument, "kind", "Unknown fraud rule kind", rule.Kind)
+	}
+	if rule.Action != "block" && rule.Action != "review" {
+		return nil, newError(codeBadArgument, "action", "Fraud rule action must be block or review", rule.Action)
+	}
+
+	key := "FraudRule_" + rule.ID
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+
+	bytes, err := json.Marshal(rule)
+	if err != nil {
+		fmt.Println("Error marshaling fraud rule")
+		return nil, newError(codeInternal, "", "Error marshaling fraud rule", "")
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		return nil, nil
+	}
+	return t.appendKey(stub, "FraudRules", key)
+}
+
+// getFraudRules - query function to list the configured fraud rules
+func (t *LoyaltyChaincode) getFraudRules(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getFraudRules is running ")
+
+	rules, err := t.loadFraudRules(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(rules)
+	if err != nil {
+		fmt.Println("Error marshaling fraud rules")
+		return nil, newError(codeInternal, "", "Error marshaling fraud rules", "")
+	}
+	return bytes, nil
+}
+
+func (t *LoyaltyChaincode) loadFraudRules(stub shim.ChaincodeStubInterface) ([]FraudRule, error) {
+	var rules []FraudRule
+
+	keysBytes, err := stub.GetState("FraudRules")
+	if err != nil {
+		fmt.Println("Error retrieving FraudRules keys")
+		return nil, newError(codeLedger, "", "Error retrieving FraudRules keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling FraudRules keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling FraudRules keys", "")
+	}
+
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var rule FraudRule
+		err = json.Unmarshal(bytes, &rule)
+		if err != nil {
+			fmt.Println("Error retrieving fraud rule " + value)
+			return nil, newError(codeLedger, "", "Error retrieving fraud rule "+value, "")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// checkFraudRules - evaluates the fraud rules for a value movement of entity.
+// Every hit is written as a FraudAlert. When a hit has the block action the
+// alerts are returned as the response and the caller must not move any value;
+// the invoke still succeeds so that the alerts are committed to the ledger.
+func (t *LoyaltyChaincode) checkFraudRules(stub shim.ChaincodeStubInterface, function string, entity string, counterparty string, asset string, value float64) ([]byte, error) {
+	fmt.Println("checkFraudRules is running " + function + " " + entity)
+
+	rules, err := t.loadFraudRules(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	now := blockTime.Seconds
+
+	// Recent activity of the entity
+	activityKey := "Activity_" + entity
+	var activities []Activity
+	bytes, err := stub.GetState(activityKey)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+activityKey, "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &activities)
+		if err != nil {
+			fmt.Println("Error Unmarshaling " + activityKey)
+			return nil, newError(codeCorruptRecord, "", "Error Unmarshaling "+activityKey, "")
+		}
+	}
+
+	// Receivers the entity has transferred to before
+	receiversKey := "Receivers_" + entity
+	var receivers []string
+	current := Activity{
+		Function:     function,
+		Counterparty: counterparty,
+		Asset:        asset,
+		Value:        value,
+		Time:         now,
+	}
+	if function == "transfer" {
+		bytes, err = stub.GetState(receiversKey)
+		if err != nil {
+			return nil, newError(codeLedger, "", "Failed to get state of "+receiversKey, "")
+		}
+		if bytes != nil {
+			err = json.Unmarshal(bytes, &receivers)
+			if err != nil {
+				fmt.Println("Error Unmarshaling " + receiversKey)
+				return nil, newError(codeCorruptRecord, "", "Error Unmarshaling "+receiversKey, "")
+			}
+		}
+		current.NewReceiver = true
+		for _, receiver := range receivers {
+			if receiver == counterparty {
+				current.NewReceiver = false
+				break
+			}
+		}
+	}
+
+	// Evaluate every enabled rule against the activity and this transaction
+	var alerts []FraudAlert
+	var maxWindow int64
+	blocked := false
+	for _, rule := range rules {
+		if rule.Window > maxWindow {
+			maxWindow = rule.Window
+		}
+		if !rule.Enabled || rule.Function != function {
+			continue
+		}
+		if rule.Asset != "" && rule.Asset != asset {
+			continue
+		}
+
+		hit := false
+		switch rule.Kind {
+		case "velocity":
+			count := 1
+			for _, activity := range activities {
+				if activity.Function == function && now-activity.Time <= rule.Window &&
+					(rule.Asset == "" || activity.Asset == rule.Asset) {
+					count++
+				}
+			}
+			hit = count > rule.Count
+		case "redeemAfterTopup":
+			for _, activity := range activities {
+				if activity.Function == "add" && activity.Value >= rule.Threshold && now-activity.Time <= rule.Window {
+					hit = true
+					break
+				}
+			}
+		case "newReceivers":
+			if current.NewReceiver {
+				count := 1
+				for _, activity := range activities {
+					if activity.Function == "transfer" && activity.NewReceiver && now-activity.Time <= rule.Window {
+						count++
+					}
+				}
+				hit = count > rule.Count
+			}
+		}
+		if !hit {
+			continue
+		}
+
+		fmt.Println("fraud rule hit " + rule.ID)
+		alert := FraudAlert{
+			Version:      schemaVersion,
+			Key:          "FraudAlert_" + stub.GetTxID() + "_" + rule.ID,
+			RuleID:       rule.ID,
+			Action:       rule.Action,
+			Status:       "open",
+			Entity:       entity,
+			Counterparty: counterparty,
+			Function:     function,
+			Asset:        asset,
+			Value:        value,
+			TxID:         stub.GetTxID(),
+			Time:         blockTime.String(),
+		}
+		bytes, err = json.Marshal(alert)
+		if err != nil {
+			fmt.Println("Error marshaling fraud alert")
+			return nil, newError(codeInternal, "", "Error marshaling fraud alert", "")
+		}
+		err = stub.PutState(alert.Key, bytes)
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.appendKey(stub, "FraudAlerts", alert.Key)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+		if rule.Action == "block" {
+			blocked = true
+		}
+	}
+
+	if blocked {
+		bytes, err = json.Marshal(alerts)
+		if err != nil {
+			fmt.Println("Error marshaling fraud alerts")
+			return nil, newError(codeInternal, "", "Error marshaling fraud alerts", "")
+		}
+		return bytes, nil
+	}
+
+	// Record the movement, dropping activity older than the longest window
+	var recent []Activity
+	for _, activity := range activities {
+		if now-activity.Time <= maxWindow {
+			recent = append(recent, activity)
+		}
+	}
+	recent = append(recent, current)
+	bytes, err = json.Marshal(recent)
+	if err != nil {
+		fmt.Println("Error marshaling " + activityKey)
+		return nil, newError(codeInternal, "", "Error marshaling "+activityKey, "")
+	}
+	err = stub.PutState(activityKey, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if current.NewReceiver {
+		receivers = append(receivers, counterparty)
+		bytes, err = json.Marshal(receivers)
+		if err != nil {
+			fmt.Println("Error marshaling " + receiversKey)
+			return nil, newError(codeInternal, "", "Error marshaling "+receiversKey, "")
+		}
+		err = stub.PutState(receiversKey, bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// getFraudAlerts - admin query to list fraud alerts, optionally by status
+func (t *LoyaltyChaincode) getFraudAlerts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getFraudAlerts is running ")
+
+	if len(args) > 1 {
+		return nil, argCountError("0 or 1", "getFraudAlerts")
+	}
+	status := ""
+	if len(args) == 1 {
+		status = args[0]
+	}
+
+	var alerts []FraudAlert
+
+	keysBytes, err := stub.GetState("FraudAlerts")
+	if err != nil {
+		fmt.Println("Error retrieving FraudAlerts keys")
+		return nil, newError(codeLedger, "", "Error retrieving FraudAlerts keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling FraudAlerts keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling FraudAlerts keys", "")
+	}
+
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var alert FraudAlert
+		err = json.Unmarshal(bytes, &alert)
+		if err != nil {
+			fmt.Println("Error retrieving fraud alert " + value)
+			return nil, newError(codeLedger, "", "Error retrieving fraud alert "+value, "")
+		}
+		if status == "" || alert.Status == status {
+			alerts = append(alerts, alert)
+		}
+	}
+
+	bytes, err := json.Marshal(alerts)
+	if err != nil {
+		fmt.Println("Error marshaling fraud alerts")
+		return nil, newError(codeInternal, "", "Error marshaling fraud alerts", "")
+	}
+	return bytes, nil
+}
+
+// resolveFraudAlert - admin invoke to close a fraud alert with a resolution
+func (t *LoyaltyChaincode) resolveFraudAlert(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("resolveFraudAlert is running ")
+
+	/*
+	   args[] - {alertKey, resolution}
+	*/
+	if len(args) != 2 {
+		return nil, argCountError("2", "resolveFraudAlert")
+	}
+	// Only alerts may be rewritten here, not any record named by the caller
+	if !s.HasPrefix(args[0], "FraudAlert_") {
+		return nil, newError(codeBadArgument, "alertKey", "Not a fraud alert key", args[0])
+	}
+	resolver, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil || len(resolver) == 0 {
+		return nil, newError(codeNotAuthorized, "", "Caller has no enrollmentId to record as resolver", "")
+	}
+
+	bytes, err := stub.GetState(args[0])
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+args[0], "")
+	}
+	if bytes == nil {
+		return nil, newError(codeNotFound, "alertKey", "Fraud alert not found", args[0])
+	}
+	alert := FraudAlert{}
+	err = json.Unmarshal(bytes, &alert)
+	if err != nil {
+		fmt.Println("Error Unmarshaling fraud alert")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling fraud alert", "")
+	}
+	if alert.Status == "resolved" {
+		return nil, newError(codeInvalidState, "", "Fraud alert already resolved", "")
+	}
+
+	alert.Status = "resolved"
+	alert.Resolution = args[1]
+	alert.ResolvedBy = string(resolver)
+
+	bytes, err = json.Marshal(alert)
+	if err != nil {
+		fmt.Println("Error marshaling fraud alert")
+		return nil, newError(codeInternal, "", "Error marshaling fraud alert", "")
+	}
+	err = stub.PutState(args[0], bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// registerCustomer - invoke function to create a customer under a pseudonymous ID.
+// The customer's name, email and phone never reach the chaincode: the client
+// sends the hex sha256 of a salt and the PII, and the merchant and bank keep
+// the PII and salt off the ledger.
+func (t *LoyaltyChaincode) registerCustomer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("registerCustomer is running ")
+
+	/*
+	   args[] - {piiHash, merchant, bank}
+	*/
+	if len(args) != 3 {
+		return nil, argCountError("3", "registerCustomer")
+	}
+	piiHash := s.ToLower(args[0])
+	hashBytes, err := hex.DecodeString(piiHash)
+	if err != nil || len(hashBytes) != sha256.Size {
+		return nil, newError(codeBadArgument, "piiHash", "PII hash must be a hex encoded sha256", "")
+	}
+
+	for index, entityType := range []string{"merchant", "bank"} {
+		key := args[index+1]
+		entity, err := t.getEntity(stub, key)
+		if err != nil {
+			return nil, err
+		}
+		if entity.Type != entityType {
+			return nil, newError(codeBadArgument, entityType, "Entity is not a "+entityType, key)
+		}
+	}
+
+	// The pseudonymous ID is derived from the transaction so it is the same on every peer
+	sum := sha256.Sum256([]byte(stub.GetTxID()))
+	id := "C" + hex.EncodeToString(sum[:8])
+	for _, key := range []string{id, "Alias_" + id} {
+		bytes, err := stub.GetState(key)
+		if err != nil {
+			return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+		}
+		if bytes != nil {
+			return nil, newError(codeDuplicate, "", "Customer ID is already in use", id)
+		}
+	}
+
+	customer := Entity{
+		Type:    "customer",
+		Name:    id,
+		Balance: 0,
+		Points:  0,
+	}
+	err = t.putEntity(stub, id, customer)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.appendKey(stub, "Entities", id)
+	if err != nil {
+		return nil, err
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	identity := CustomerIdentity{
+		ID:       id,
+		PIIHash:  piiHash,
+		Merchant: args[1],
+		Bank:     args[2],
+		Time:     blockTime.String(),
+	}
+	bytes, err := json.Marshal(identity)
+	if err != nil {
+		fmt.Println("Error marshaling customer identity")
+		return nil, newError(codeInternal, "", "Error marshaling customer identity", "")
+	}
+	err = stub.PutState("Identity_"+id, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(id), nil
+}
+
+// verifyCustomer - query function to check PII held off the ledger against a customer
+func (t *LoyaltyChaincode) verifyCustomer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("verifyCustomer is running ")
+
+	/*
+	   args[] - {customerID, piiHash}
+	*/
+	if len(args) != 2 {
+		return nil, argCountError("2", "verifyCustomer")
+	}
+
+	bytes, err := stub.GetState("Identity_" + args[0])
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+args[0], "")
+	}
+	if bytes == nil {
+		return nil, newError(codeNotFound, "customerID", "Customer identity not found", args[0])
+	}
+	identity := CustomerIdentity{}
+	err = json.Unmarshal(bytes, &identity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling customer identity")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling customer identity", "")
+	}
+
+	return []byte(strconv.FormatBool(identity.PIIHash == s.ToLower(args[1]))), nil
+}
+
+// getEntity - reads an entity from the ledger
+func (t *LoyaltyChaincode) getEntity(stub shim.ChaincodeStubInterface, key string) (Entity, error) {
+	entity := Entity{}
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return entity, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return entity, newError(codeEntityNotFound, "", "Entity not found", key)
+	}
+	err = json.Unmarshal(bytes, &entity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling entity Bytes")
+		return entity, newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", "")
+	}
+	upgradeEntity(&entity)
+	// Entities written before IDs were recorded are keyed by their ID
+	if entity.ID == "" {
+		entity.ID = key
+	}
+	return entity, nil
+}
+
+// putEntity - writes an entity back to the ledger under its key.
+// Every entity write goes through here so the indexes stay up to date.
+func (t *LoyaltyChaincode) putEntity(stub shim.ChaincodeStubInterface, key string, entity Entity) error {
+	return t.writeEntity(stub, key, entity, accountFor(entity.Type))
+}
+
+// writeEntity - putEntity journaling the entity's movements to an account
+func (t *LoyaltyChaincode) writeEntity(stub shim.ChaincodeStubInterface, key string, entity Entity, account string) error {
+	entity.Version = schemaVersion
+	entity.ID = key
+	err := t.journalEntity(stub, key, entity, account)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		fmt.Println("Error marshaling entity")
+		return newError(codeInternal, "", "Error marshaling entity", "")
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		return err
+	}
+	err = t.recordBalance(stub, key, entity)
+	if err != nil {
+		return err
+	}
+
+	if entity.Type == "customer" {
+		return t.updateLeaderboard(stub, key, entity)
+	}
+	return nil
+}
+
+// accountFor - journal account of an entity type
+func accountFor(entityType string) string {
+	switch entityType {
+	case "merchant":
+		return accountMerchants
+	case "bank":
+		return accountBanks
+	}
+	return accountCustomers
+}
+
+// journalEntity - posts the change in an entity's points and balance since its
+// last write. An entity last written before the journal started is first
+// given an opening entry for what it held.
+func (t *LoyaltyChaincode) journalEntity(stub shim.ChaincodeStubInterface, key string, entity Entity, account string) error {
+	latest, err := t.latestBalance(stub, key)
+	if err != nil {
+		return err
+	}
+	var points int
+	var balance float64
+	if latest != nil {
+		points = latest.Points
+		balance = latest.Balance
+	} else {
+		bytes, err := stub.GetState(key)
+		if err != nil {
+			return newError(codeLedger, "", "Failed to get state of "+key, "")
+		}
+		if bytes != nil {
+			previous := Entity{}
+			err = json.Unmarshal(bytes, &previous)
+			if err != nil {
+				fmt.Println("Error Unmarshaling entity Bytes")
+				return newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", key)
+			}
+			points = previous.Points
+			balance = previous.Balance
+			for _, opening := range []Posting{
+				{Account: accountFor(previous.Type), Entity: key, Asset: "points", Credit: float64(points)},
+				{Account: accountOpening, Asset: "points", Debit: float64(points)},
+				{Account: accountFor(previous.Type), Entity: key, Asset: "balance", Credit: balance},
+				{Account: accountOpening, Asset: "balance", Debit: balance},
+			} {
+				err = t.post(stub, opening.Account, opening.Entity, opening.Asset, opening.Credit-opening.Debit)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	err = t.post(stub, account, key, "points", float64(entity.Points-points))
+	if err != nil {
+		return err
+	}
+	return t.post(stub, account, key, "balance", entity.Balance-balance)
+}
+
+// post - adds an amount to the pending journal entry of the transaction, as a
+// credit when positive and a debit when negative. Postings to the same account,
+// entity and asset are netted.
+func (t *LoyaltyChaincode) post(stub shim.ChaincodeStubInterface, account string, entity string, asset string, amount float64) error {
+	if amount == 0 {
+		return nil
+	}
+	key := "JournalPending_" + stub.GetTxID()
+	entry := JournalEntry{Version: schemaVersion, TxID: stub.GetTxID()}
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &entry)
+		if err != nil {
+			fmt.Println("Error Unmarshaling journal entry")
+			return newError(codeCorruptRecord, "", "Error Unmarshaling journal entry", key)
+		}
+	}
+
+	found := false
+	for index, posting := range entry.Postings {
+		if posting.Account == account && posting.Entity == entity && posting.Asset == asset {
+			entry.Postings[index] = netPosting(posting, posting.Credit-posting.Debit+amount)
+			found = true
+			break
+		}
+	}
+	if !found {
+		entry.Postings = append(entry.Postings, netPosting(Posting{Account: account, Entity: entity, Asset: asset}, amount))
+	}
+
+	bytes, err = json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Error marshaling journal entry")
+		return newError(codeInternal, "", "Error marshaling journal entry", "")
+	}
+	return stub.PutState(key, bytes)
+}
+
+// netPosting - posting carrying a net amount on its debit or credit side
+func netPosting(posting Posting, amount float64) Posting {
+	amount = roundJournal(amount)
+	posting.Debit = 0
+	posting.Credit = 0
+	if amount > 0 {
+		posting.Credit = amount
+	} else {
+		posting.Debit = -amount
+	}
+	return posting
+}
+
+// roundJournal - rounds a journal amount to the tolerance it is balanced to
+func roundJournal(amount float64) float64 {
+	if amount < 0 {
+		return -math.Floor(-amount/journalTolerance+0.5) * journalTolerance
+	}
+	return math.Floor(amount/journalTolerance+0.5) * journalTolerance
+}
+
+// closeJournal - checks that the pending entry of the transaction balances for
+// every asset, then records it and adds it to the trial balance. When an
+// account is given it takes up any difference, otherwise an unbalanced entry
+// fails the transaction.
+func (t *LoyaltyChaincode) closeJournal(stub shim.ChaincodeStubInterface, function string, balancing string) error {
+	key := "JournalPending_" + stub.GetTxID()
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return nil
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return err
+	}
+	var entry JournalEntry
+	err = json.Unmarshal(bytes, &entry)
+	if err != nil {
+		fmt.Println("Error Unmarshaling journal entry")
+		return newError(codeCorruptRecord, "", "Error Unmarshaling journal entry", key)
+	}
+
+	var postings []Posting
+	net := make(map[string]float64)
+	for _, posting := range entry.Postings {
+		if math.Abs(posting.Credit-posting.Debit) < journalTolerance {
+			continue
+		}
+		postings = append(postings, posting)
+		net[posting.Asset] += posting.Credit - posting.Debit
+	}
+	for _, asset := range assetEnum {
+		if math.Abs(net[asset]) < journalTolerance {
+			continue
+		}
+		if balancing == "" {
+			return newError(codeInvalidState, "", "Journal entry of "+function+" does not balance", asset+" "+strconv.FormatFloat(net[asset], 'f', -1, 64))
+		}
+		postings = append(postings, netPosting(Posting{Account: balancing, Asset: asset}, -net[asset]))
+	}
+	if len(postings) == 0 {
+		return nil
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	entry.Function = function
+	entry.Time = blockTime.String()
+	entry.Postings = postings
+	bytes, err = json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Error marshaling journal entry")
+		return newError(codeInternal, "", "Error marshaling journal entry", "")
+	}
+	err = stub.PutState("Journal_"+entry.TxID, bytes)
+	if err != nil {
+		return err
+	}
+	_, err = t.appendKey(stub, "Journal", "Journal_"+entry.TxID)
+	if err != nil {
+		return err
+	}
+
+	// Keep running totals per sub-ledger so the trial balance is one read
+	var totals []Posting
+	bytes, err = stub.GetState("TrialBalance")
+	if err != nil {
+		return newError(codeLedger, "", "Failed to get state of TrialBalance", "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &totals)
+		if err != nil {
+			fmt.Println("Error Unmarshaling trial balance")
+			return newError(codeCorruptRecord, "", "Error Unmarshaling trial balance", "")
+		}
+	}
+	for _, posting := range postings {
+		found := false
+		for index, total := range totals {
+			if total.Account == posting.Account && total.Entity == posting.Entity && total.Asset == posting.Asset {
+				totals[index].Debit = roundJournal(total.Debit + posting.Debit)
+				totals[index].Credit = roundJournal(total.Credit + posting.Credit)
+				found = true
+				break
+			}
+		}
+		if !found {
+			totals = append(totals, posting)
+		}
+	}
+	bytes, err = json.Marshal(totals)
+	if err != nil {
+		fmt.Println("Error marshaling trial balance")
+		return newError(codeInternal, "", "Error marshaling trial balance", "")
+	}
+	return stub.PutState("TrialBalance", bytes)
+}
+
+// getTrialBalance - query function totalling the journal by account and asset,
+// or by sub-ledger with detail
+func (t *LoyaltyChaincode) getTrialBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getTrialBalance is running ")
+
+	if len(args) > 1 {
+		return nil, argCountError("0 or 1", "getTrialBalance")
+	}
+	detail := len(args) == 1 && args[0] == "detail"
+	// Per entity lines show every customer's holdings
+	if detail && !t.isAdmin(stub) {
+		return nil, newError(codeNotAuthorized, "detail", "Only an admin can see the trial balance per entity", "")
+	}
+
+	var totals []Posting
+	bytes, err := stub.GetState("TrialBalance")
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of TrialBalance", "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &totals)
+		if err != nil {
+			fmt.Println("Error Unmarshaling trial balance")
+			return nil, newError(codeCorruptRecord, "", "Error Unmarshaling trial balance", "")
+		}
+	}
+
+	result := TrialBalance{Lines: []TrialBalanceLine{}, Balanced: true}
+	lines := make(map[string]int)
+	sums := make(map[string]*TrialBalanceLine)
+	for _, total := range totals {
+		entity := ""
+		if detail {
+			entity = total.Entity
+		}
+		lineKey := total.Account + "|" + entity + "|" + total.Asset
+		index, ok := lines[lineKey]
+		if !ok {
+			index = len(result.Lines)
+			lines[lineKey] = index
+			result.Lines = append(result.Lines, TrialBalanceLine{Account: total.Account, Name: chartOfAccounts[total.Account], Entity: entity, Asset: total.Asset})
+		}
+		result.Lines[index].Debit = roundJournal(result.Lines[index].Debit + total.Debit)
+		result.Lines[index].Credit = roundJournal(result.Lines[index].Credit + total.Credit)
+		result.Lines[index].Balance = roundJournal(result.Lines[index].Credit - result.Lines[index].Debit)
+
+		if sums[total.Asset] == nil {
+			sums[total.Asset] = &TrialBalanceLine{Asset: total.Asset}
+		}
+		sums[total.Asset].Debit = roundJournal(sums[total.Asset].Debit + total.Debit)
+		sums[total.Asset].Credit = roundJournal(sums[total.Asset].Credit + total.Credit)
+	}
+	sort.Slice(result.Lines, func(a, b int) bool {
+		if result.Lines[a].Account != result.Lines[b].Account {
+			return result.Lines[a].Account < result.Lines[b].Account
+		}
+		if result.Lines[a].Asset != result.Lines[b].Asset {
+			return result.Lines[a].Asset < result.Lines[b].Asset
+		}
+		return result.Lines[a].Entity < result.Lines[b].Entity
+	})
+	for _, asset := range assetEnum {
+		sum, ok := sums[asset]
+		if !ok {
+			continue
+		}
+		sum.Balance = roundJournal(sum.Credit - sum.Debit)
+		if math.Abs(sum.Balance) >= journalTolerance {
+			result.Balanced = false
+		}
+		result.Totals = append(result.Totals, *sum)
+	}
+
+	bytes, err = json.Marshal(result)
+	if err != nil {
+		fmt.Println("Error marshaling trial balance")
+		return nil, newError(codeInternal, "", "Error marshaling trial balance", "")
+	}
+	return bytes, nil
+}
+
+// getJournalEntry - query function returning the journal entry of a transaction
+func (t *LoyaltyChaincode) getJournalEntry(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getJournalEntry is running ")
+
+	if len(args) != 1 {
+		return nil, argCountError("1", "getJournalEntry")
+	}
+	bytes, err := stub.GetState("Journal_" + args[0])
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of Journal_"+args[0], "")
+	}
+	if bytes == nil {
+		return nil, newError(codeNotFound, "txID", "Journal entry not found", args[0])
+	}
+	entry := JournalEntry{}
+	err = json.Unmarshal(bytes, &entry)
+	if err != nil {
+		fmt.Println("Error Unmarshaling journal entry")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling journal entry", args[0])
+	}
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+	parties := []string{}
+	for _, posting := range entry.Postings {
+		parties = append(parties, posting.Entity)
+	}
+	ok, err := visibleParty(visible, parties...)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, newError(codeNotAuthorized, "txID", "Only the parties of a transaction can read its journal entry", args[0])
+	}
+	return bytes, nil
+}
+
+// recordBalance - saves the entity's points and balance as a snapshot of its
+// history. An entity written more than once in a transaction keeps the last
+// values only.
+func (t *LoyaltyChaincode) recordBalance(stub shim.ChaincodeStubInterface, key string, entity Entity) error {
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	snapshot := BalanceSnapshot{
+		TxID:        stub.GetTxID(),
+		Timestamp:   blockTime.Seconds,
+		Points:      entity.Points,
+		Balance:     entity.Balance,
+		HeldPoints:  entity.HeldPoints,
+		HeldBalance: entity.HeldBalance,
+	}
+	err = t.putBalanceSnapshot(stub, key, snapshot)
+	if err != nil {
+		return err
+	}
+
+	// Remember when the transaction ran, so it can be looked up by entities
+	// it did not touch
+	return stub.PutState("TxTime_"+snapshot.TxID, []byte(strconv.FormatInt(snapshot.Timestamp, 10)))
+}
+
+// balanceSnapshotKey - key of an entity's snapshot. The time is zero padded so
+// the keys of an entity sort by time.
+func balanceSnapshotKey(key string, seconds int64, txID string) string {
+	return fmt.Sprintf("BalanceHistory_%s_%012d_%s", key, seconds, txID)
+}
+
+// putBalanceSnapshot - writes one snapshot under its own key, and as the
+// latest snapshot of the entity
+func (t *LoyaltyChaincode) putBalanceSnapshot(stub shim.ChaincodeStubInterface, key string, snapshot BalanceSnapshot) error {
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		fmt.Println("Error marshaling balance snapshot")
+		return newError(codeInternal, "", "Error marshaling balance snapshot", "")
+	}
+	err = stub.PutState(balanceSnapshotKey(key, snapshot.Timestamp, snapshot.TxID), bytes)
+	if err != nil {
+		return err
+	}
+	return stub.PutState("BalanceLatest_"+key, bytes)
+}
+
+// latestBalance - the last snapshot of an entity, nil when it has none
+func (t *LoyaltyChaincode) latestBalance(stub shim.ChaincodeStubInterface, key string) (*BalanceSnapshot, error) {
+	bytes, err := stub.GetState("BalanceLatest_" + key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of BalanceLatest_"+key, "")
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	snapshot := BalanceSnapshot{}
+	err = json.Unmarshal(bytes, &snapshot)
+	if err != nil {
+		fmt.Println("Error Unmarshaling balance snapshot")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling balance snapshot", key)
+	}
+	return &snapshot, nil
+}
+
+// balanceBefore - the last snapshot of an entity at or before a time, nil when
+// it has none. The snapshot keys sort by time, so only those up to the time
+// are read.
+func (t *LoyaltyChaincode) balanceBefore(stub shim.ChaincodeStubInterface, key string, seconds int64) (*BalanceSnapshot, error) {
+	prefix := "BalanceHistory_" + key + "_"
+	iter, err := stub.RangeQueryState(prefix, balanceSnapshotKey(key, seconds+1, ""))
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to query balance history of "+key, "")
+	}
+	defer iter.Close()
+
+	var found *BalanceSnapshot
+	for iter.HasNext() {
+		snapshotKey, bytes, err := iter.Next()
+		if err != nil {
+			return nil, newError(codeLedger, "", "Failed to query balance history of "+key, "")
+		}
+		// Skip the snapshots of another entity whose ID starts with this one
+		rest := s.TrimPrefix(snapshotKey, prefix)
+		if len(rest) < 13 || rest[12] != '_' {
+			continue
+		}
+		if _, err := strconv.ParseInt(rest[:12], 10, 64); err != nil {
+			continue
+		}
+		snapshot := BalanceSnapshot{}
+		err = json.Unmarshal(bytes, &snapshot)
+		if err != nil {
+			fmt.Println("Error Unmarshaling balance snapshot")
+			return nil, newError(codeCorruptRecord, "", "Error Unmarshaling balance snapshot", snapshotKey)
+		}
+		found = &snapshot
+	}
+	return found, nil
+}
+
+// backfillBalance - gives an entity with no history a snapshot of what it holds
+func (t *LoyaltyChaincode) backfillBalance(stub shim.ChaincodeStubInterface, key string, entityBytes []byte) error {
+	bytes, err := stub.GetState("BalanceLatest_" + key)
+	if err != nil {
+		return newError(codeLedger, "", "Failed to get state of BalanceLatest_"+key, "")
+	}
+	if bytes != nil {
+		return nil
+	}
+	entity := Entity{}
+	err = json.Unmarshal(entityBytes, &entity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling entity Bytes")
+		return newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", key)
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	return t.putBalanceSnapshot(stub, key, BalanceSnapshot{
+		TxID:        stub.GetTxID(),
+		Timestamp:   blockTime.Seconds,
+		Points:      entity.Points,
+		Balance:     entity.Balance,
+		HeldPoints:  entity.HeldPoints,
+		HeldBalance: entity.HeldBalance,
+	})
+}
+
+// getBalanceAt - query function returning the points and balance of an entity
+// at a time (seconds since epoch or RFC 3339) or right after a transaction
+func (t *LoyaltyChaincode) getBalanceAt(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getBalanceAt is running ")
+
+	/*
+	   args[] - {entity, at}
+	*/
+	if len(args) != 2 {
+		return nil, argCountError("2", "getBalanceAt")
+	}
+	key := args[0]
+	_, err := t.getEntity(stub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		at, err := time.Parse(time.RFC3339, args[1])
+		if err == nil {
+			seconds = at.Unix()
+		} else {
+			// Any other transaction is placed by the time it ran
+			bytes, err := stub.GetState("TxTime_" + args[1])
+			if err != nil {
+				return nil, newError(codeLedger, "", "Failed to get state of TxTime_"+args[1], "")
+			}
+			if bytes == nil {
+				return nil, newError(codeBadArgument, "at", "Not a time or a known transaction ID", args[1])
+			}
+			seconds, err = strconv.ParseInt(string(bytes), 10, 64)
+			if err != nil {
+				return nil, newError(codeCorruptRecord, "", "Error parsing transaction time", args[1])
+			}
+
+			// The state after a transaction of the entity is its own snapshot
+			bytes, err = stub.GetState(balanceSnapshotKey(key, seconds, args[1]))
+			if err != nil {
+				return nil, newError(codeLedger, "", "Failed to get state of balance snapshot", args[1])
+			}
+			if bytes != nil {
+				snapshot := BalanceSnapshot{}
+				err = json.Unmarshal(bytes, &snapshot)
+				if err != nil {
+					fmt.Println("Error Unmarshaling balance snapshot")
+					return nil, newError(codeCorruptRecord, "", "Error Unmarshaling balance snapshot", args[1])
+				}
+				return t.marshalBalanceAt(key, args[1], snapshot)
+			}
+		}
+	}
+
+	snapshot, err := t.balanceBefore(stub, key, seconds)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, newError(codeNotFound, "at", "No balance recorded for "+key+" at that time", args[1])
+	}
+	return t.marshalBalanceAt(key, args[1], *snapshot)
+}
+
+// marshalBalanceAt - JSON result of getBalanceAt
+func (t *LoyaltyChaincode) marshalBalanceAt(key string, at string, snapshot BalanceSnapshot) ([]byte, error) {
+	result := BalanceAt{
+		Entity:          key,
+		At:              at,
+		BalanceSnapshot: snapshot,
+	}
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		fmt.Println("Error marshaling balance")
+		return nil, newError(codeInternal, "", "Error marshaling balance", "")
+	}
+	return bytes, nil
+}
+
+// resolveEntity - ID of the entity an alias maps to. Anything that is not an
+// alias is taken to be an ID already.
+func (t *LoyaltyChaincode) resolveEntity(stub shim.ChaincodeStubInterface, ref string) (string, error) {
+	if ref == "" {
+		return ref, nil
+	}
+	bytes, err := stub.GetState("Alias_" + ref)
+	if err != nil {
+		return ref, newError(codeLedger, "", "Failed to get state of Alias_"+ref, "")
+	}
+	if bytes == nil {
+		return ref, nil
+	}
+	var alias Alias
+	err = json.Unmarshal(bytes, &alias)
+	if err != nil {
+		fmt.Println("Error Unmarshaling alias")
+		return ref, newError(codeCorruptRecord, "", "Error Unmarshaling alias", ref)
+	}
+	return alias.Entity, nil
+}
+
+// callerEntity - entity the caller's enrollment ID is, or is a cert alias of
+func (t *LoyaltyChaincode) callerEntity(stub shim.ChaincodeStubInterface) (string, error) {
+	enrollmentID, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil || len(enrollmentID) == 0 {
+		return "", newError(codeNotAuthorized, "", "Caller has no enrollmentId", "")
+	}
+	return t.resolveEntity(stub, string(enrollmentID))
+}
+
+// checkRole - enforces the role of a function, and that the entity given for
+// each Caller argument is the caller. A customer, merchant or bank role needs
+// a caller that is an entity of that type. A comma separated list of roles,
+// ex: admin,merchant, admits a caller with any of them.
+func (t *LoyaltyChaincode) checkRole(stub shim.ChaincodeStubInterface, spec FunctionSpec, args []string) error {
+	roles := s.Split(spec.Role, ",")
+	var err error
+	for _, role := range roles {
+		err = t.hasRole(stub, role, spec.Name)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil && len(roles) > 1 {
+		return newError(codeNotAuthorized, "", "Callers of "+spec.Name+" must be one of "+spec.Role, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	for index, arg := range spec.Args {
+		if !arg.Caller || index >= len(args) {
+			continue
+		}
+		caller, err := t.callerEntity(stub)
+		if err != nil {
+			return err
+		}
+		if args[index] != caller {
+			return newError(codeNotAuthorized, arg.Name, "The "+arg.Name+" of "+spec.Name+" must be the caller", args[index])
+		}
+	}
+
+	for index, arg := range spec.Args {
+		if !arg.Private || index >= len(args) || args[index] == "" {
+			continue
+		}
+		err := t.checkCustomerAccess(stub, arg.Name, args[index])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasRole - checks the caller against a single role of a function
+func (t *LoyaltyChaincode) hasRole(stub shim.ChaincodeStubInterface, role string, name string) error {
+	switch role {
+	case "any":
+	case "admin":
+		if !t.isAdmin(stub) {
+			return newError(codeNotAuthorized, "", "Only an admin can call "+name, "")
+		}
+	case "organisation":
+		_, _, err := t.paramOrganisation(stub)
+		if err != nil {
+			return err
+		}
+	default:
+		caller, err := t.callerEntity(stub)
+		if err != nil {
+			return err
+		}
+		entity, err := t.getEntity(stub, caller)
+		if err != nil || entity.Type != role {
+			return newError(codeNotAuthorized, "", "Only a "+role+" can call "+name, caller)
+		}
+	}
+	return nil
+}
+
+// checkCustomerAccess - lets only an admin, the customer, or the merchant or
+// bank the customer was registered with read the records of a customer. Other
+// entities can be read by anyone.
+func (t *LoyaltyChaincode) checkCustomerAccess(stub shim.ChaincodeStubInterface, field string, key string) error {
+	if t.isAdmin(stub) {
+		return nil
+	}
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return nil
+	}
+	entity := Entity{}
+	err = json.Unmarshal(bytes, &entity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling entity Bytes")
+		return newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", key)
+	}
+	if entity.Type != "customer" {
+		return nil
+	}
+
+	caller, err := t.callerEntity(stub)
+	if err != nil {
+		return err
+	}
+	if caller == key {
+		return nil
+	}
+	bytes, err = stub.GetState("Identity_" + key)
+	if err != nil {
+		return newError(codeLedger, "", "Failed to get state of Identity_"+key, "")
+	}
+	if bytes != nil {
+		identity := CustomerIdentity{}
+		err = json.Unmarshal(bytes, &identity)
+		if err != nil {
+			fmt.Println("Error Unmarshaling customer identity")
+			return newError(codeCorruptRecord, "", "Error Unmarshaling customer identity", key)
+		}
+		if caller == identity.Merchant || caller == identity.Bank {
+			return nil
+		}
+	}
+	return newError(codeNotAuthorized, field, "Only the customer, their merchant or bank, or an admin can read this customer", key)
+}
+
+// visibleFilter - returns whether the caller may see the records of an entity.
+// Admins see every entity, other callers themselves and the customers
+// registered with them.
+func (t *LoyaltyChaincode) visibleFilter(stub shim.ChaincodeStubInterface) (func(key string) (bool, error), error) {
+	if t.isAdmin(stub) {
+		return func(key string) (bool, error) { return true, nil }, nil
+	}
+	caller, err := t.callerEntity(stub)
+	if err != nil {
+		return nil, err
+	}
+	return func(key string) (bool, error) {
+		if key == caller {
+			return true, nil
+		}
+		identity, err := t.getCustomerIdentity(stub, key)
+		if err != nil {
+			return false, err
+		}
+		return identity.Merchant == caller || identity.Bank == caller, nil
+	}, nil
+}
+
+// visibleParty - whether the caller may see a record of any of the parties
+func visibleParty(visible func(key string) (bool, error), parties ...string) (bool, error) {
+	for _, party := range parties {
+		if party == "" {
+			continue
+		}
+		ok, err := visible(party)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// resolveEntityArgs - replaces the aliases given for entity arguments with the
+// IDs they map to, so functions only ever see IDs
+func (t *LoyaltyChaincode) resolveEntityArgs(stub shim.ChaincodeStubInterface, spec FunctionSpec, args []string) ([]string, error) {
+	for index, arg := range spec.Args {
+		if !arg.Entity || index >= len(args) {
+			continue
+		}
+		id, err := t.resolveEntity(stub, args[index])
+		if err != nil {
+			return nil, err
+		}
+		args[index] = id
+	}
+	return args, nil
+}
+
+// renameEntity - invoke function changing the display name of an entity
+func (t *LoyaltyChaincode) renameEntity(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("renameEntity is running ")
+
+	/*
+	   args[] - {entity, name}
+	*/
+	if len(args) != 2 {
+		return nil, argCountError("2", "renameEntity")
+	}
+	entity, err := t.getEntity(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	entity.Name = args[1]
+	return nil, t.putEntity(stub, args[0], entity)
+}
+
+// setJurisdiction - invoke function changing the tax jurisdiction of an entity
+func (t *LoyaltyChaincode) setJurisdiction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("setJurisdiction is running ")
+
+	/*
+	   args[] - {entity, jurisdiction}
+	   an empty jurisdiction clears it
+	*/
+	if len(args) != 2 {
+		return nil, argCountError("2", "setJurisdiction")
+	}
+	entity, err := t.getEntity(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	entity.Jurisdiction = args[1]
+	return nil, t.putEntity(stub, args[0], entity)
+}
+
+// addAlias - invoke function mapping another identifier to an entity. An alias
+// belongs to one entity only and cannot shadow an existing key.
+func (t *LoyaltyChaincode) addAlias(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("addAlias is running ")
+
+	/*
+	   args[] - {entity, kind, alias}
+	   a phone alias is the hex sha256 of the phone number, never the number
+	*/
+	if len(args) != 3 {
+		return nil, argCountError("3", "addAlias")
+	}
+	key := args[0]
+	kind := args[1]
+	value := args[2]
+	if kind == "phone" {
+		value = s.ToLower(value)
+		decoded, err := hex.DecodeString(value)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, newError(codeBadArgument, "alias", "Phone alias must be a hex sha256 hash", "")
+		}
+	}
+	if value == "" {
+		return nil, newError(codeBadArgument, "alias", "Alias is required", "")
+	}
+
+	entity, err := t.getEntity(stub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Aliases and IDs share one namespace so every reference stays unambiguous
+	existing, err := stub.GetState("Alias_" + value)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of Alias_"+value, "")
+	}
+	if existing != nil {
+		return nil, newError(codeDuplicate, "alias", "Alias is already in use", value)
+	}
+	existing, err = stub.GetState(value)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+value, "")
+	}
+	if existing != nil {
+		return nil, newError(codeDuplicate, "alias", "Alias is already used as a key", value)
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	alias := Alias{
+		Version: schemaVersion,
+		Alias:   value,
+		Kind:    kind,
+		Entity:  key,
+		Time:    blockTime.String(),
+	}
+	bytes, err := json.Marshal(alias)
+	if err != nil {
+		fmt.Println("Error marshaling alias")
+		return nil, newError(codeInternal, "", "Error marshaling alias", "")
+	}
+	err = stub.PutState("Alias_"+value, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	entity.Aliases = append(entity.Aliases, value)
+	err = t.putEntity(stub, key, entity)
+	if err != nil {
+		return nil, err
+	}
+	return t.appendKey(stub, "Aliases", "Alias_"+value)
+}
+
+// removeAlias - invoke function removing an alias from its entity
+func (t *LoyaltyChaincode) removeAlias(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("removeAlias is running ")
+
+	/*
+	   args[] - {alias}
+	*/
+	if len(args) != 1 {
+		return nil, argCountError("1", "removeAlias")
+	}
+	value := args[0]
+	bytes, err := stub.GetState("Alias_" + value)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of Alias_"+value, "")
+	}
+	if bytes == nil {
+		// phone aliases are stored in lower case
+		value = s.ToLower(value)
+		bytes, err = stub.GetState("Alias_" + value)
+		if err != nil {
+			return nil, newError(codeLedger, "", "Failed to get state of Alias_"+value, "")
+		}
+	}
+	if bytes == nil {
+		return nil, newError(codeNotFound, "alias", "Alias not found", args[0])
+	}
+	var alias Alias
+	err = json.Unmarshal(bytes, &alias)
+	if err != nil {
+		fmt.Println("Error Unmarshaling alias")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling alias", value)
+	}
+
+	entity, err := t.getEntity(stub, alias.Entity)
+	if err != nil {
+		return nil, err
+	}
+	var aliases []string
+	for _, other := range entity.Aliases {
+		if other != value {
+			aliases = append(aliases, other)
+		}
+	}
+	entity.Aliases = aliases
+	err = t.putEntity(stub, alias.Entity, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.DelState("Alias_" + value)
+	if err != nil {
+		return nil, err
+	}
+	return nil, t.removeKey(stub, "Aliases", "Alias_"+value)
+}
+
+// getAliases - query function listing the aliases of an entity
+func (t *LoyaltyChaincode) getAliases(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getAliases is running ")
+
+	if len(args) != 1 {
+		return nil, argCountError("1", "getAliases")
+	}
+	entity, err := t.getEntity(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := []Alias{}
+	for _, value := range entity.Aliases {
+		bytes, err := stub.GetState("Alias_" + value)
+		if err != nil {
+			return nil, newError(codeLedger, "", "Failed to get state of Alias_"+value, "")
+		}
+		var alias Alias
+		err = json.Unmarshal(bytes, &alias)
+		if err != nil {
+			fmt.Println("Error retrieving alias " + value)
+			return nil, newError(codeCorruptRecord, "", "Error retrieving alias "+value, "")
+		}
+		aliases = append(aliases, alias)
+	}
+
+	bytes, err := json.Marshal(aliases)
+	if err != nil {
+		fmt.Println("Error marshaling aliases")
+		return nil, newError(codeInternal, "", "Error marshaling aliases", "")
+	}
+	return bytes, nil
+}
+
+// bulkIssue - invoke function to credit many entities from the issuer's budget.
+// In dryRun mode nothing is written and the validation report is returned.
+func (t *LoyaltyChaincode) bulkIssue(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("bulkIssue is running ")
+
+	/*
+	   args[] - {issuer, asset, campaign, recipientsJSON[, dryRun]}
+	   recipientsJSON - [{"entity": "...", "amount": 100}, ...]
+	*/
+	if len(args) != 4 && len(args) != 5 {
+		return nil, argCountError("4 or 5", "bulkIssue")
+	}
+	issuerKey := args[0]
+	asset := args[1]
+	campaign := args[2]
+	dryRun := len(args) == 5 && args[4] == "dryRun"
+	if asset != "points" && asset != "balance" {
+		return nil, newError(codeBadArgument, "asset", "Asset must be points or balance", asset)
+	}
+	if campaign == "" {
+		return nil, newError(codeBadArgument, "campaign", "Campaign reference is required for bulkIssue", "")
+	}
+
+	var recipients []Recipient
+	err := json.Unmarshal([]byte(args[3]), &recipients)
+	if err != nil {
+		return nil, newError(codeBadArgument, "recipients", "Invalid recipients for bulkIssue", err.Error())
+	}
+	if len(recipients) == 0 {
+		return nil, newError(codeBadArgument, "recipients", "No recipients for bulkIssue", "")
+	}
+	// Recipients may be given by alias as well
+	for index := range recipients {
+		recipients[index].Entity, err = t.resolveEntity(stub, recipients[index].Entity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	issuer, err := t.getEntity(stub, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate every recipient before anything is written
+	report := BulkIssueReport{Invalid: []InvalidRecipient{}}
+	report.Budget = issuer.Balance
+	if asset == "points" {
+		report.Budget = float64(issuer.Points)
+	}
+	entities := make(map[string]Entity)
+	for index, recipient := range recipients {
+		reason := ""
+		if recipient.Entity == "" {
+			reason = "missing entity"
+		} else if recipient.Entity == issuerKey {
+			reason = "issuer cannot be a recipient"
+		} else if recipient.Amount <= 0 {
+			reason = "amount must be positive"
+		} else if asset == "points" && recipient.Amount != float64(int(recipient.Amount)) {
+			reason = "points must be a whole number"
+		} else if _, ok := entities[recipient.Entity]; !ok {
+			entity, err := t.getEntity(stub, recipient.Entity)
+			if err != nil {
+				reason = err.Error()
+			} else {
+				entities[recipient.Entity] = entity
+			}
+		}
+		if reason != "" {
+			report.Invalid = append(report.Invalid, InvalidRecipient{Index: index, Entity: recipient.Entity, Reason: reason})
+			continue
+		}
+		report.Total += recipient.Amount
+	}
+	report.Valid = len(report.Invalid) == 0 && report.Total <= report.Budget
+
+	if dryRun {
+		bytes, err := json.Marshal(report)
+		if err != nil {
+			fmt.Println("Error marshaling bulkIssue report")
+			return nil, newError(codeInternal, "", "Error marshaling bulkIssue report", "")
+		}
+		return bytes, nil
+	}
+	if len(report.Invalid) != 0 {
+		return nil, newError(codeBadArgument, "recipients", "Invalid recipients in bulkIssue, run with dryRun for details", "")
+	}
+	if report.Total > report.Budget {
+		return nil, newError(codeInsufficientBudget, "", "Insufficient issuer budget for bulkIssue", "")
+	}
+
+	// Apply every credit
+	for _, recipient := range recipients {
+		entity := entities[recipient.Entity]
+		if asset == "points" {
+			entity.Points = entity.Points + int(recipient.Amount)
+			entity.PointsEarned = entity.PointsEarned + int(recipient.Amount)
+		} else {
+			entity.Balance = entity.Balance + recipient.Amount
+		}
+		entities[recipient.Entity] = entity
+	}
+	if asset == "points" {
+		issuer.Points = issuer.Points - int(report.Total)
+	} else {
+		issuer.Balance = issuer.Balance - report.Total
+	}
+	for key, entity := range entities {
+		err = t.putEntity(stub, key, entity)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = t.putEntity(stub, issuerKey, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	ID := stub.GetTxID()
+	for index, recipient := range recipients {
+		value := strconv.FormatFloat(recipient.Amount, 'f', -1, 64)
+		_, err = t.putTxnTopup(stub, []string{asset, recipient.Entity, value, ID + "_" + strconv.Itoa(index), blockTime.String()})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	batch := TxnBatch{
+		Version:    schemaVersion,
+		ID:         ID,
+		Issuer:     issuerKey,
+		Campaign:   campaign,
+		Asset:      asset,
+		Recipients: len(recipients),
+		Total:      report.Total,
+		Time:       blockTime.String(),
+	}
+	bytes, err := json.Marshal(batch)
+	if err != nil {
+		fmt.Println("Error marshaling TxnBatch")
+		return nil, newError(codeInternal, "", "Error marshaling TxnBatch", "")
+	}
+	err = stub.PutState(batch.ID, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.appendKey(stub, "TxnBatch", batch.ID)
+}
+
+func (t *LoyaltyChaincode) getAllTxnBatch(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getAllTxnBatch is running ")
+
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var txns []TxnBatch
+
+	// Get list of all the keys - TxnBatch
+	keysBytes, err := stub.GetState("TxnBatch")
+	if err != nil {
+		fmt.Println("Error retrieving TxnBatch keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnBatch keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling TxnBatch key")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnBatch keys", "")
+	}
+
+	// Get each txn from "TxnBatch" keys
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var txn TxnBatch
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+		upgradeTxnBatch(&txn)
+
+		ok, err := visibleParty(visible, txn.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		fmt.Println("Appending txn batch details " + value)
+		txns = append(txns, txn)
+	}
+
+	bytes, err := json.Marshal(txns)
+	if err != nil {
+		fmt.Println("Error marshaling txns TxnBatch")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnBatch", "")
+	}
+	return bytes, nil
+}
+
+// updateSupply - adds delta of asset to the mint counter, or to the burn counter when negative
+func (t *LoyaltyChaincode) updateSupply(stub shim.ChaincodeStubInterface, asset string, delta float64) error {
+	if delta == 0 {
+		return nil
+	}
+
+	bytes, err := stub.GetState("Supply")
+	if err != nil {
+		return newError(codeLedger, "", "Failed to get state of Supply", "")
+	}
+	supply := Supply{}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &supply)
+		if err != nil {
+			fmt.Println("Error Unmarshaling supply")
+			return newError(codeCorruptRecord, "", "Error Unmarshaling supply", "")
+		}
+	}
+
+	err = t.post(stub, accountIssuance, "", asset, -delta)
+	if err != nil {
+		return err
+	}
+
+	if asset == "points" {
+		if delta > 0 {
+			supply.PointsMinted += int(delta)
+		} else {
+			supply.PointsBurned += int(-delta)
+		}
+	} else {
+		if delta > 0 {
+			supply.BalanceMinted += delta
+		} else {
+			supply.BalanceBurned += -delta
+		}
+	}
+
+	bytes, err = json.Marshal(supply)
+	if err != nil {
+		fmt.Println("Error marshaling supply")
+		return newError(codeInternal, "", "Error marshaling supply", "")
+	}
+	return stub.PutState("Supply", bytes)
+}
+
+// reconcile - query function comparing the supply counters with the sum of all entity holdings
+func (t *LoyaltyChaincode) reconcile(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("reconcile is running ")
+
+	result := Reconciliation{}
+	bytes, err := stub.GetState("Supply")
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of Supply", "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &result.Supply)
+		if err != nil {
+			fmt.Println("Error Unmarshaling supply")
+			return nil, newError(codeCorruptRecord, "", "Error Unmarshaling supply", "")
+		}
+	}
+
+	keysBytes, err := stub.GetState("Entities")
+	if err != nil {
+		fmt.Println("Error retrieving Entities keys")
+		return nil, newError(codeLedger, "", "Error retrieving Entities keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling Entities keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling Entities keys", "")
+	}
+
+	for _, value := range keys {
+		entity, err := t.getEntity(stub, value)
+		if err != nil {
+			return nil, newError(codeLedger, "", "Error retrieving entity "+value, "")
+		}
+		result.PointsOutstanding += entity.Points
+		result.BalanceOutstanding += entity.Balance
+	}
+	result.Entities = len(keys)
+
+	// Value on gift cards left the merchants' balances but is still outstanding
+	keysBytes, err = stub.GetState("GiftCards")
+	if err != nil {
+		fmt.Println("Error retrieving GiftCards keys")
+		return nil, newError(codeLedger, "", "Error retrieving GiftCards keys", "")
+	}
+	keys = nil
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling GiftCards keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling GiftCards keys", "")
+	}
+	for _, value := range keys {
+		card, err := t.getGiftCard(stub, s.TrimPrefix(value, "GiftCard_"))
+		if err != nil {
+			return nil, err
+		}
+		result.GiftCardBalance += card.Balance
+	}
+	result.GiftCards = len(keys)
+	result.BalanceOutstanding += result.GiftCardBalance
+
+	result.PointsExpected = result.Supply.PointsMinted - result.Supply.PointsBurned
+	result.PointsDiscrepancy = result.PointsOutstanding - result.PointsExpected
+	result.BalanceExpected = result.Supply.BalanceMinted - result.Supply.BalanceBurned
+	result.BalanceDiscrepancy = result.BalanceOutstanding - result.BalanceExpected
+	// Balances are floats, so ignore differences below a hundredth of a unit
+	result.Balanced = result.PointsDiscrepancy == 0 && result.BalanceDiscrepancy < 0.005 && result.BalanceDiscrepancy > -0.005
+
+	bytes, err = json.Marshal(result)
+	if err != nil {
+		fmt.Println("Error marshaling reconciliation")
+		return nil, newError(codeInternal, "", "Error marshaling reconciliation", "")
+	}
+	return bytes, nil
+}
+
+// getProduct - reads a product from the ledger
+func (t *LoyaltyChaincode) getProduct(stub shim.ChaincodeStubInterface, key string) (Product, error) {
+	product := Product{}
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return product, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return product, newError(codeNotFound, "", "Product not found", key)
+	}
+	err = json.Unmarshal(bytes, &product)
+	if err != nil {
+		fmt.Println("Error Unmarshaling product bytes")
+		return product, newError(codeCorruptRecord, "", "Error Unmarshaling product Bytes", "")
+	}
+	upgradeProduct(&product)
+	return product, nil
+}
+
+// putProduct - writes a product back to the ledger under its key
+func (t *LoyaltyChaincode) putProduct(stub shim.ChaincodeStubInterface, key string, product Product) error {
+	product.Version = schemaVersion
+	bytes, err := json.Marshal(product)
+	if err != nil {
+		fmt.Println("Error marshaling product")
+		return newError(codeInternal, "", "Error marshaling product", "")
+	}
+	return stub.PutState(key, bytes)
+}
+
+// getHold - reads a hold from the ledger
+func (t *LoyaltyChaincode) getHold(stub shim.ChaincodeStubInterface, key string) (Hold, error) {
+	hold := Hold{}
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return hold, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return hold, newError(codeNotFound, "", "Hold not found", key)
+	}
+	err = json.Unmarshal(bytes, &hold)
+	if err != nil {
+		fmt.Println("Error Unmarshaling hold")
+		return hold, newError(codeCorruptRecord, "", "Error Unmarshaling hold", "")
+	}
+	return hold, nil
+}
+
+// putHold - writes a hold back to the ledger
+func (t *LoyaltyChaincode) putHold(stub shim.ChaincodeStubInterface, hold Hold) error {
+	bytes, err := json.Marshal(hold)
+	if err != nil {
+		fmt.Println("Error marshaling hold")
+		return newError(codeInternal, "", "Error marshaling hold", "")
+	}
+	return stub.PutState(hold.Key, bytes)
+}
+
+// openHolds - keys of the customer's holds that are still authorized
+func (t *LoyaltyChaincode) openHolds(stub shim.ChaincodeStubInterface, customer string) ([]string, error) {
+	var keys []string
+	bytes, err := stub.GetState("Holds_" + customer)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of Holds_"+customer, "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &keys)
+		if err != nil {
+			fmt.Println("Error unmarshalling Holds_" + customer)
+			return nil, newError(codeCorruptRecord, "", "Error unmarshalling Holds_"+customer, "")
+		}
+	}
+	return keys, nil
+}
+
+// putOpenHolds - writes the keys of the customer's authorized holds
+func (t *LoyaltyChaincode) putOpenHolds(stub shim.ChaincodeStubInterface, customer string, keys []string) error {
+	bytes, err := json.Marshal(keys)
+	if err != nil {
+		fmt.Println("Error marshaling Holds_" + customer)
+		return newError(codeInternal, "", "Error marshaling Holds_"+customer, "")
+	}
+	return stub.PutState("Holds_"+customer, bytes)
+}
+
+// authorizeGoods - invoke function reserving a customer's funds and the product
+// quantity for an order, to be captured when the order ships
+func (t *LoyaltyChaincode) authorizeGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("authorizeGoods is running ")
+
+	/*
+	   args[] - {asset, customer, merchant, product, qty, expiryMinutes}
+	*/
+	if len(args) != 6 {
+		return nil, argCountError("6", "authorizeGoods")
+	}
+	asset := args[0]
+	key1 := args[1]
+	key2 := args[2]
+	key3 := args[3]
+	qty, err := strconv.Atoi(args[4])
+	if err != nil || qty <= 0 {
+		return nil, newError(codeBadArgument, "qty", "Invalid quantity for authorizeGoods", args[4])
+	}
+	minutes, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil || minutes <= 0 {
+		return nil, newError(codeBadArgument, "expiryMinutes", "Invalid expiry for authorizeGoods", args[5])
+	}
+
+	err = t.releaseExpiredHolds(stub, key1)
+	if err != nil {
+		return nil, err
+	}
+
+	customer, err := t.getEntity(stub, key1)
+	if err != nil {
+		return nil, err
+	}
+	merchant, err := t.getEntity(stub, key2)
+	if err != nil {
+		return nil, err
+	}
+	product, err := t.getProduct(stub, key3)
+	if err != nil {
+		return nil, err
+	}
+	if product.Entity != key2 {
+		return nil, newError(codeBadArgument, "product", "Product is not sold by merchant", key2)
+	}
+	if product.Qty-product.Reserved < qty {
+		return nil, newError(codeInsufficientQuantity, "qty", "Insufficient quantity of "+key3, "")
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	hold := Hold{
+		Version:  schemaVersion,
+		Key:      "Hold_" + stub.GetTxID(),
+		ID:       stub.GetTxID(),
+		Status:   "authorized",
+		Asset:    asset,
+		Customer: key1,
+		Merchant: key2,
+		Product:  key3,
+		Qty:      qty,
+		Expiry:   blockTime.Seconds + minutes*60,
+		Time:     blockTime.String(),
+	}
+
+	value := float64(product.Points * qty)
+	if asset == "points" {
+		hold.Points = product.Points * qty
+		if customer.Points-customer.HeldPoints < hold.Points {
+			return nil, newError(codeInsufficientPoints, "", "Insufficient points to buy goods", "")
+		}
+	} else {
+		line, taxes, err := t.priceGoods(stub, merchant, product, qty)
+		if err != nil {
+			return nil, err
+		}
+		hold.Line = &line
+		hold.Taxes = taxes
+		hold.Amount = line.Gross
+		value = hold.Amount
+		if customer.Balance-customer.HeldBalance < hold.Amount {
+			return nil, newError(codeInsufficientBalance, "", "Insufficient balance to buy goods", "")
+		}
+	}
+
+	// The order is placed now, so this is where the purchase is screened
+	blocked, err := t.checkFraudRules(stub, "buyGoods", key1, key2, asset, value)
+	if err != nil {
+		return nil, err
+	}
+	if blocked != nil {
+		return blocked, nil
+	}
+
+	customer.HeldPoints += hold.Points
+	customer.HeldBalance += hold.Amount
+	product.Reserved += qty
+
+	err = t.putEntity(stub, key1, customer)
+	if err != nil {
+		return nil, err
+	}
+	err = t.putProduct(stub, key3, product)
+	if err != nil {
+		return nil, err
+	}
+	err = t.putHold(stub, hold)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := t.openHolds(stub, key1)
+	if err != nil {
+		return nil, err
+	}
+	err = t.putOpenHolds(stub, key1, append(keys, hold.Key))
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.appendKey(stub, "Holds", hold.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(hold.Key), nil
+}
+
+// captureGoods - invoke function debiting an authorized hold when the order ships
+func (t *LoyaltyChaincode) captureGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("captureGoods is running ")
+
+	/*
+	   args[] - {holdKey}
+	*/
+	if len(args) != 1 {
+		return nil, argCountError("1", "captureGoods")
+	}
+
+	hold, err := t.getHold(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.callerEntity(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != hold.Merchant {
+		return nil, newError(codeNotAuthorized, "", "Only the merchant of a hold can capture it", caller)
+	}
+	if hold.Status != "authorized" {
+		return nil, newError(codeInvalidState, "", "Hold is "+hold.Status, hold.Key)
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	if blockTime.Seconds > hold.Expiry {
+		err = t.closeHold(stub, hold, "expired")
+		if err != nil {
+			return nil, err
+		}
+		return []byte("Hold expired"), nil
+	}
+
+	customer, err := t.getEntity(stub, hold.Customer)
+	if err != nil {
+		return nil, err
+	}
+	merchant, err := t.getEntity(stub, hold.Merchant)
+	if err != nil {
+		return nil, err
+	}
+	product, err := t.getProduct(stub, hold.Product)
+	if err != nil {
+		return nil, err
+	}
+
+	// The merchant pays the redemption fee out of the points received
+	fee := 0.0
+	feeAccount := ""
+	if hold.Asset == "points" {
+		fee, feeAccount, err = t.feeFor(stub, "redemption", hold.Merchant, float64(hold.Points), true)
+		if err != nil {
+			return nil, err
+		}
+		// A fixed fee can exceed the points received
+		if fee > float64(hold.Points) {
+			err = t.checkCredit(stub, hold.Merchant, merchant, "points", fee-float64(hold.Points))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Debit the reserved funds and quantity
+	customer.HeldPoints -= hold.Points
+	customer.HeldBalance -= hold.Amount
+	customer.Points -= hold.Points
+	customer.Balance -= hold.Amount
+	merchant.Points += hold.Points - int(fee)
+	merchant.Balance += hold.Amount
+	customer.Spend += hold.Amount
+	product.Reserved -= hold.Qty
+	product.Qty -= hold.Qty
+
+	err = t.putEntity(stub, hold.Customer, customer)
+	if err != nil {
+		return nil, err
+	}
+	err = t.putEntity(stub, hold.Merchant, merchant)
+	if err != nil {
+		return nil, err
+	}
+	err = t.putProduct(stub, hold.Product, product)
+	if err != nil {
+		return nil, err
+	}
+	err = t.payFee(stub, feeAccount, hold.Asset, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	value := strconv.Itoa(hold.Points)
+	if hold.Asset != "points" {
+		value = strconv.FormatFloat(hold.Amount, 'E', -1, 64)
+	}
+	_, err = t.putTxnGoods(stub, []string{hold.Asset, hold.Customer, hold.Merchant, hold.Product, value, "captured " + hold.Key, stub.GetTxID(), blockTime.String(), strconv.Itoa(hold.Qty), strconv.FormatFloat(fee, 'f', -1, 64), feeAccount})
+	if err != nil {
+		return nil, err
+	}
+	// Holds placed before taxes were recorded on them have no line to print
+	if hold.Line != nil {
+		err = t.putReceipt(stub, hold.Customer, merchant, hold.Merchant, hold.Asset, *hold.Line, hold.Taxes, blockTime.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hold.Status = "captured"
+	hold.Closed = blockTime.String()
+	err = t.putHold(stub, hold)
+	if err != nil {
+		return nil, err
+	}
+	return nil, t.removeOpenHold(stub, hold)
+}
+
+// voidGoods - invoke function releasing an authorized hold of a cancelled order
+func (t *LoyaltyChaincode) voidGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("voidGoods is running ")
+
+	/*
+	   args[] - {holdKey}
+	*/
+	if len(args) != 1 {
+		return nil, argCountError("1", "voidGoods")
+	}
+
+	hold, err := t.getHold(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	caller, err := t.callerEntity(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != hold.Customer && caller != hold.Merchant {
+		return nil, newError(codeNotAuthorized, "", "Only the customer or merchant of a hold can void it", caller)
+	}
+	if hold.Status != "authorized" {
+		return nil, newError(codeInvalidState, "", "Hold is "+hold.Status, hold.Key)
+	}
+
+	return nil, t.closeHold(stub, hold, "voided")
+}
+
+// expireHolds - invoke function releasing every authorized hold past its expiry
+func (t *LoyaltyChaincode) expireHolds(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("expireHolds is running ")
+
+	keysBytes, err := stub.GetState("Holds")
+	if err != nil {
+		fmt.Println("Error retrieving Holds keys")
+		return nil, newError(codeLedger, "", "Error retrieving Holds keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling Holds keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling Holds keys", "")
+	}
+
+	customers := make(map[string]bool)
+	for _, value := range keys {
+		hold, err := t.getHold(stub, value)
+		if err != nil {
+			return nil, err
+		}
+		if hold.Status == "authorized" && !customers[hold.Customer] {
+			customers[hold.Customer] = true
+			err = t.releaseExpiredHolds(stub, hold.Customer)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// releaseExpiredHolds - expires the customer's authorized holds past their expiry.
+// Chaincode cannot run on a timer, so this runs whenever the customer's funds are
+// used and from the expireHolds invoke.
+func (t *LoyaltyChaincode) releaseExpiredHolds(stub shim.ChaincodeStubInterface, customer string) error {
+	keys, err := t.openHolds(stub, customer)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		hold, err := t.getHold(stub, key)
+		if err != nil {
+			return err
+		}
+		if blockTime.Seconds > hold.Expiry {
+			err = t.closeHold(stub, hold, "expired")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeHold - returns the reserved funds and quantity of a hold and closes it
+func (t *LoyaltyChaincode) closeHold(stub shim.ChaincodeStubInterface, hold Hold, status string) error {
+	fmt.Println("closing hold " + hold.Key + " as " + status)
+
+	customer, err := t.getEntity(stub, hold.Customer)
+	if err != nil {
+		return err
+	}
+	product, err := t.getProduct(stub, hold.Product)
+	if err != nil {
+		return err
+	}
+	customer.HeldPoints -= hold.Points
+	customer.HeldBalance -= hold.Amount
+	product.Reserved -= hold.Qty
+
+	err = t.putEntity(stub, hold.Customer, customer)
+	if err != nil {
+		return err
+	}
+	err = t.putProduct(stub, hold.Product, product)
+	if err != nil {
+		return err
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	hold.Status = status
+	hold.Closed = blockTime.String()
+	err = t.putHold(stub, hold)
+	if err != nil {
+		return err
+	}
+	return t.removeOpenHold(stub, hold)
+}
+
+// removeOpenHold - drops a closed hold from its customer's authorized holds
+func (t *LoyaltyChaincode) removeOpenHold(stub shim.ChaincodeStubInterface, hold Hold) error {
+	keys, err := t.openHolds(stub, hold.Customer)
+	if err != nil {
+		return err
+	}
+	var remaining []string
+	for _, key := range keys {
+		if key != hold.Key {
+			remaining = append(remaining, key)
+		}
+	}
+	return t.putOpenHolds(stub, hold.Customer, remaining)
+}
+
+// getHolds - query function to list holds, optionally of one customer
+func (t *LoyaltyChaincode) getHolds(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getHolds is running ")
+
+	if len(args) > 1 {
+		return nil, argCountError("0 or 1", "getHolds")
+	}
+	// The holds of every customer are only listed to an admin
+	if (len(args) == 0 || args[0] == "") && !t.isAdmin(stub) {
+		return nil, newError(codeNotAuthorized, "customer", "Only an admin can list the holds of every customer", "")
+	}
+
+	keysBytes, err := stub.GetState("Holds")
+	if err != nil {
+		fmt.Println("Error retrieving Holds keys")
+		return nil, newError(codeLedger, "", "Error retrieving Holds keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling Holds keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling Holds keys", "")
+	}
+
+	var holds []Hold
+	for _, value := range keys {
+		hold, err := t.getHold(stub, value)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 || hold.Customer == args[0] {
+			holds = append(holds, hold)
+		}
+	}
+
+	bytes, err := json.Marshal(holds)
+	if err != nil {
+		fmt.Println("Error marshaling holds")
+		return nil, newError(codeInternal, "", "Error marshaling holds", "")
+	}
+	return bytes, nil
+}
+
+// getDispute - reads a dispute from the ledger
+func (t *LoyaltyChaincode) getDispute(stub shim.ChaincodeStubInterface, key string) (Dispute, error) {
+	dispute := Dispute{}
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return dispute, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return dispute, newError(codeNotFound, "", "Dispute not found", key)
+	}
+	err = json.Unmarshal(bytes, &dispute)
+	if err != nil {
+		fmt.Println("Error Unmarshaling dispute")
+		return dispute, newError(codeCorruptRecord, "", "Error Unmarshaling dispute", "")
+	}
+	return dispute, nil
+}
+
+// putDispute - writes a dispute back to the ledger
+func (t *LoyaltyChaincode) putDispute(stub shim.ChaincodeStubInterface, dispute Dispute) error {
+	bytes, err := json.Marshal(dispute)
+	if err != nil {
+		fmt.Println("Error marshaling dispute")
+		return newError(codeInternal, "", "Error marshaling dispute", "")
+	}
+	return stub.PutState(dispute.Key, bytes)
+}
+
+// splitHashes - parses a comma separated list of evidence hashes
+func splitHashes(list string) []string {
+	hashes := []string{}
+	for _, hash := range s.Split(list, ",") {
+		hash = s.TrimSpace(hash)
+		if hash != "" {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// openDispute - invoke function for a customer to dispute a goods purchase
+func (t *LoyaltyChaincode) openDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("openDispute is running ")
+
+	/*
+	   args[] - {customer, txnGoodsID, reasonCode, evidenceHashes}
+	   evidenceHashes - comma separated hashes of documents kept off the ledger
+	*/
+	if len(args) != 4 {
+		return nil, argCountError("4", "openDispute")
+	}
+	if args[2] == "" {
+		return nil, newError(codeBadArgument, "reasonCode", "Reason code is required for openDispute", "")
+	}
+
+	// Transfers and other records are keyed by txID too, only purchases can be disputed
+	found, err := t.hasKey(stub, "TxnGoods", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(codeNotFound, "txnGoodsID", "TxnGoods not found", args[1])
+	}
+	bytes, err := stub.GetState(args[1])
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+args[1], "")
+	}
+	if bytes == nil {
+		return nil, newError(codeNotFound, "txnGoodsID", "TxnGoods not found", args[1])
+	}
+	txn := TxnGoods{}
+	err = json.Unmarshal(bytes, &txn)
+	if err != nil {
+		fmt.Println("Error Unmarshaling TxnGoods")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling TxnGoods", "")
+	}
+	upgradeTxnGoods(&txn)
+	if txn.Sender != args[0] {
+		return nil, newError(codeNotAuthorized, "", "Only the customer of a purchase can dispute it", "")
+	}
+
+	key := "Dispute_" + txn.ID
+	bytes, err = stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes != nil {
+		return nil, newError(codeInvalidState, "", "Purchase is already disputed", "")
+	}
+
+	identity, err := t.getCustomerIdentity(stub, txn.Sender)
+	if err != nil {
+		return nil, err
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	dispute := Dispute{
+		Version:          schemaVersion,
+		Key:              key,
+		TxnID:            txn.ID,
+		Customer:         txn.Sender,
+		Merchant:         txn.Receiver,
+		Asset:            txn.Asset,
+		Value:            txn.Value,
+		ReasonCode:       args[2],
+		Evidence:         splitHashes(args[3]),
+		MerchantEvidence: []string{},
+		Status:           "open",
+		Bank:             identity.Bank,
+		Deadline:         blockTime.Seconds + disputeDeadline,
+		Opened:           blockTime.String(),
+	}
+	err = t.putDispute(stub, dispute)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.appendKey(stub, "Disputes", key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(key), nil
+}
+
+// respondDispute - invoke function for the merchant to answer a dispute
+func (t *LoyaltyChaincode) respondDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("respondDispute is running ")
+
+	/*
+	   args[] - {merchant, disputeKey, response, evidenceHashes}
+	*/
+	if len(args) != 4 {
+		return nil, argCountError("4", "respondDispute")
+	}
+
+	dispute, err := t.getDispute(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if dispute.Merchant != args[0] {
+		return nil, newError(codeNotAuthorized, "", "Only the merchant of a purchase can respond to its dispute", "")
+	}
+	if dispute.Status != "open" {
+		return nil, newError(codeInvalidState, "", "Dispute is "+dispute.Status, dispute.Key)
+	}
+
+	dispute.Response = args[2]
+	dispute.MerchantEvidence = splitHashes(args[3])
+	dispute.Status = "responded"
+
+	return nil, t.putDispute(stub, dispute)
+}
+
+// adjudicateDispute - invoke function for the bank to rule on a dispute before its deadline.
+// A ruling of reverse refunds the purchase from the merchant to the customer.
+func (t *LoyaltyChaincode) adjudicateDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("adjudicateDispute is running ")
+
+	/*
+	   args[] - {bank, disputeKey, ruling (close or reverse)}
+	*/
+	if len(args) != 3 {
+		return nil, argCountError("3", "adjudicateDispute")
+	}
+	if args[2] != "close" && args[2] != "reverse" {
+		return nil, newError(codeBadArgument, "ruling", "Ruling must be close or reverse", args[2])
+	}
+
+	dispute, err := t.getDispute(stub, args[1])
+	if err != nil {
+		return nil, err
+	}
+	// Disputes opened before the bank was recorded fall back to the customer's identity
+	if dispute.Bank == "" {
+		identity, err := t.getCustomerIdentity(stub, dispute.Customer)
+		if err != nil {
+			return nil, err
+		}
+		dispute.Bank = identity.Bank
+	}
+	if dispute.Bank != args[0] {
+		return nil, newError(codeNotAuthorized, "", "Only the customer's bank can adjudicate this dispute", dispute.Key)
+	}
+	if dispute.Status != "open" && dispute.Status != "responded" {
+		return nil, newError(codeInvalidState, "", "Dispute is "+dispute.Status, dispute.Key)
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	if blockTime.Seconds > dispute.Deadline {
+		return nil, newError(codeInvalidState, "", "Dispute deadline has passed", dispute.Key)
+	}
+
+	return nil, t.resolveDispute(stub, dispute, args[2])
+}
+
+// getCustomerIdentity - returns the merchant and bank a customer was registered
+// with, empty when the customer has no identity record
+func (t *LoyaltyChaincode) getCustomerIdentity(stub shim.ChaincodeStubInterface, customer string) (CustomerIdentity, error) {
+	identity := CustomerIdentity{}
+	bytes, err := stub.GetState("Identity_" + customer)
+	if err != nil {
+		return identity, newError(codeLedger, "", "Failed to get state of Identity_"+customer, "")
+	}
+	if bytes == nil {
+		return identity, nil
+	}
+	err = json.Unmarshal(bytes, &identity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling customer identity")
+		return identity, newError(codeCorruptRecord, "", "Error Unmarshaling customer identity", customer)
+	}
+	return identity, nil
+}
+
+// enforceDisputeDeadline - invoke function reversing a dispute the bank did not
+// adjudicate before its deadline
+func (t *LoyaltyChaincode) enforceDisputeDeadline(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("enforceDisputeDeadline is running ")
+
+	/*
+	   args[] - {disputeKey}
+	*/
+	if len(args) != 1 {
+		return nil, argCountError("1", "enforceDisputeDeadline")
+	}
+
+	dispute, err := t.getDispute(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if dispute.Status != "open" && dispute.Status != "responded" {
+		return nil, newError(codeInvalidState, "", "Dispute is "+dispute.Status, dispute.Key)
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	if blockTime.Seconds <= dispute.Deadline {
+		return nil, newError(codeInvalidState, "", "Dispute deadline has not passed", dispute.Key)
+	}
+
+	return nil, t.resolveDispute(stub, dispute, "reverse")
+}
+
+// resolveDispute - closes a dispute, refunding the customer when the ruling is reverse
+func (t *LoyaltyChaincode) resolveDispute(stub shim.ChaincodeStubInterface, dispute Dispute, ruling string) error {
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+
+	dispute.Ruling = ruling
+	dispute.Status = "closed"
+	if ruling == "reverse" {
+		value, err := strconv.ParseFloat(dispute.Value, 64)
+		if err != nil {
+			return newError(codeCorruptRecord, "", "Invalid value on disputed purchase", dispute.TxnID)
+		}
+		merchant, err := t.getEntity(stub, dispute.Merchant)
+		if err != nil {
+			return err
+		}
+		customer, err := t.getEntity(stub, dispute.Customer)
+		if err != nil {
+			return err
+		}
+		// The merchant may only go negative within a credit line
+		asset := "balance"
+		if dispute.Asset == "points" {
+			asset = "points"
+		}
+		err = t.checkCredit(stub, dispute.Merchant, merchant, asset, value)
+		if err != nil {
+			return err
+		}
+		if dispute.Asset == "points" {
+			merchant.Points = merchant.Points - int(value)
+			customer.Points = customer.Points + int(value)
+		} else {
+			merchant.Balance = merchant.Balance - value
+			customer.Balance = customer.Balance + value
+		}
+		err = t.putEntity(stub, dispute.Merchant, merchant)
+		if err != nil {
+			return err
+		}
+		err = t.putEntity(stub, dispute.Customer, customer)
+		if err != nil {
+			return err
+		}
+
+		_, err = t.putTxnTransfer(stub, []string{dispute.Merchant, dispute.Customer, dispute.Asset, dispute.Value, "Chargeback of " + dispute.TxnID, stub.GetTxID(), blockTime.String()})
+		if err != nil {
+			return err
+		}
+		dispute.Status = "reversed"
+	}
+	dispute.Resolved = blockTime.String()
+
+	return t.putDispute(stub, dispute)
+}
+
+// getDisputes - query function to list disputes by status or by party
+func (t *LoyaltyChaincode) getDisputes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getDisputes is running ")
+
+	/*
+	   args[] - {} or {"status", status} or {"party", entity}
+	*/
+	if len(args) != 0 && len(args) != 2 {
+		return nil, argCountError("0 or 2", "getDisputes")
+	}
+	if len(args) == 2 && args[0] != "status" && args[0] != "party" {
+		return nil, newError(codeBadArgument, "filter", "Disputes can be filtered by status or party", args[0])
+	}
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	keysBytes, err := stub.GetState("Disputes")
+	if err != nil {
+		fmt.Println("Error retrieving Disputes keys")
+		return nil, newError(codeLedger, "", "Error retrieving Disputes keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling Disputes keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling Disputes keys", "")
+	}
+
+	var disputes []Dispute
+	for _, value := range keys {
+		dispute, err := t.getDispute(stub, value)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 2 {
+			if args[0] == "status" && dispute.Status != args[1] {
+				continue
+			}
+			if args[0] == "party" && dispute.Customer != args[1] && dispute.Merchant != args[1] && dispute.Bank != args[1] {
+				continue
+			}
+		}
+		ok, err := visibleParty(visible, dispute.Customer, dispute.Merchant, dispute.Bank)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		disputes = append(disputes, dispute)
+	}
+
+	bytes, err := json.Marshal(disputes)
+	if err != nil {
+		fmt.Println("Error marshaling disputes")
+		return nil, newError(codeInternal, "", "Error marshaling disputes", "")
+	}
+	return bytes, nil
+}
+
+// salesPeriod - label of the day, ISO week or month a purchase falls in
+func salesPeriod(seconds int64, bucket string) string {
+	date := time.Unix(seconds, 0).UTC()
+	switch bucket {
+	case "week":
+		year, week := date.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case "month":
+		return date.Format("2006-01")
+	}
+	return date.Format("2006-01-02")
+}
+
+// getMerchantSalesReport - query function totalling a merchant's goods sales per
+// product and period between two dates (YYYY-MM-DD, both inclusive)
+func (t *LoyaltyChaincode) getMerchantSalesReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getMerchantSalesReport is running ")
+
+	/*
+	   args[] - {merchant, fromDate, toDate, bucket (day, week or month)}
+	*/
+	if len(args) != 4 {
+		return nil, argCountError("4", "getMerchantSalesReport")
+	}
+	merchant := args[0]
+	from, err := time.Parse("2006-01-02", args[1])
+	if err != nil {
+		return nil, newError(codeBadArgument, "fromDate", "Invalid from date, expecting YYYY-MM-DD", args[1])
+	}
+	to, err := time.Parse("2006-01-02", args[2])
+	if err != nil {
+		return nil, newError(codeBadArgument, "toDate", "Invalid to date, expecting YYYY-MM-DD", args[2])
+	}
+	to = to.AddDate(0, 0, 1)
+	bucket := args[3]
+	if bucket != "day" && bucket != "week" && bucket != "month" {
+		return nil, newError(codeBadArgument, "bucket", "Bucket must be day, week or month", args[3])
+	}
+
+	keysBytes, err := stub.GetState("TxnGoods")
+	if err != nil {
+		fmt.Println("Error retrieving TxnGoods keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnGoods keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling TxnGoods key")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnGoods keys", "")
+	}
+
+	lines := make(map[string]*SalesLine)
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var txn TxnGoods
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+		upgradeTxnGoods(&txn)
+		// Purchases recorded before the structured fields have no timestamp
+		if txn.Receiver != merchant || txn.Timestamp < from.Unix() || txn.Timestamp >= to.Unix() {
+			continue
+		}
+
+		period := salesPeriod(txn.Timestamp, bucket)
+		line, ok := lines[period+"|"+txn.Product]
+		if !ok {
+			line = &SalesLine{Period: period, Product: txn.Product}
+			lines[period+"|"+txn.Product] = line
+		}
+		line.Units += txn.Qty
+		line.Points += txn.Points
+		line.Currency += txn.Amount
+	}
+
+	report := []SalesLine{}
+	for _, line := range lines {
+		report = append(report, *line)
+	}
+	sort.Slice(report, func(a, b int) bool {
+		if report[a].Period != report[b].Period {
+			return report[a].Period < report[b].Period
+		}
+		return report[a].Product < report[b].Product
+	})
+
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		fmt.Println("Error marshaling sales report")
+		return nil, newError(codeInternal, "", "Error marshaling sales report", "")
+	}
+	return bytes, nil
+}
+
+// loadLeaderboard - reads the customer leaderboard index
+func (t *LoyaltyChaincode) loadLeaderboard(stub shim.ChaincodeStubInterface) (map[string]LeaderboardEntry, error) {
+	leaderboard := make(map[string]LeaderboardEntry)
+	bytes, err := stub.GetState("Leaderboard")
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of Leaderboard", "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &leaderboard)
+		if err != nil {
+			fmt.Println("Error Unmarshaling Leaderboard")
+			return nil, newError(codeCorruptRecord, "", "Error Unmarshaling Leaderboard", "")
+		}
+	}
+	return leaderboard, nil
+}
+
+// updateLeaderboard - refreshes the customer's entry in the leaderboard index
+func (t *LoyaltyChaincode) updateLeaderboard(stub shim.ChaincodeStubInterface, key string, customer Entity) error {
+	leaderboard, err := t.loadLeaderboard(stub)
+	if err != nil {
+		return err
+	}
+	leaderboard[key] = LeaderboardEntry{
+		Customer:     key,
+		Points:       customer.Points,
+		PointsEarned: customer.PointsEarned,
+		Spend:        customer.Spend,
+	}
+
+	bytes, err := json.Marshal(leaderboard)
+	if err != nil {
+		fmt.Println("Error marshaling Leaderboard")
+		return newError(codeInternal, "", "Error marshaling Leaderboard", "")
+	}
+	return stub.PutState("Leaderboard", bytes)
+}
+
+// getTopCustomers - query function ranking customers by points, earned or spend
+func (t *LoyaltyChaincode) getTopCustomers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getTopCustomers is running ")
+
+	/*
+	   args[] - {rankBy (points, earned or spend)[, limit]}
+	*/
+	if len(args) != 1 && len(args) != 2 {
+		return nil, argCountError("1 or 2", "getTopCustomers")
+	}
+	rankBy := args[0]
+	if rankBy != "points" && rankBy != "earned" && rankBy != "spend" {
+		return nil, newError(codeBadArgument, "rankBy", "Customers can be ranked by points, earned or spend", args[0])
+	}
+	limit := 0
+	if len(args) == 2 {
+		var err error
+		limit, err = strconv.Atoi(args[1])
+		if err != nil || limit < 0 {
+			return nil, newError(codeBadArgument, "limit", "Invalid limit for getTopCustomers", args[1])
+		}
+	}
+
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+	leaderboard, err := t.loadLeaderboard(stub)
+	if err != nil {
+		return nil, err
+	}
+	ranking := []LeaderboardEntry{}
+	for _, entry := range leaderboard {
+		ok, err := visible(entry.Customer)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ranking = append(ranking, entry)
+		}
+	}
+
+	value := func(entry LeaderboardEntry) float64 {
+		switch rankBy {
+		case "earned":
+			return float64(entry.PointsEarned)
+		case "spend":
+			return entry.Spend
+		}
+		return float64(entry.Points)
+	}
+	// Ties are broken by customer key so every peer returns the same order
+	sort.Slice(ranking, func(a, b int) bool {
+		if value(ranking[a]) != value(ranking[b]) {
+			return value(ranking[a]) > value(ranking[b])
+		}
+		return ranking[a].Customer < ranking[b].Customer
+	})
+	if limit > 0 && limit < len(ranking) {
+		ranking = ranking[:limit]
+	}
+
+	bytes, err := json.Marshal(ranking)
+	if err != nil {
+		fmt.Println("Error marshaling leaderboard")
+		return nil, newError(codeInternal, "", "Error marshaling leaderboard", "")
+	}
+	return bytes, nil
+}
+
+// adjustBalance - invoke function for an audited correction of an entity's points or balance
+func (t *LoyaltyChaincode) adjustBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("adjustBalance is running ")
+
+	/*
+	   args[] - {entity, asset, delta, reasonCode, note}
+	   delta - signed amount, negative to debit the entity
+	   The calling admin's enrollmentId is recorded as the approver.
+	*/
+	if len(args) != 5 {
+		return nil, argCountError("5", "adjustBalance")
+	}
+	approver, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil || len(approver) == 0 {
+		return nil, newError(codeNotAuthorized, "", "Caller has no enrollmentId to record as approver", "")
+	}
+	key := args[0]
+	asset := args[1]
+	reasonCode := args[3]
+	if asset != "points" && asset != "balance" {
+		return nil, newError(codeBadArgument, "asset", "Asset must be points or balance", asset)
+	}
+	validReason := false
+	for _, reason := range adjustmentReasons {
+		if reason == reasonCode {
+			validReason = true
+		}
+	}
+	if !validReason {
+		return nil, newError(codeBadArgument, "reasonCode", "Unknown reason code for adjustBalance", reasonCode)
+	}
+
+	entity, err := t.getEntity(stub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Perform the adjustment, the difference is minted or burned
+	if asset == "points" {
+		delta, err := strconv.Atoi(args[2])
+		if err != nil || delta == 0 {
+			return nil, newError(codeBadArgument, "delta", "Invalid delta for adjustBalance", args[2])
+		}
+		if entity.Points+delta < entity.HeldPoints {
+			return nil, newError(codeInsufficientPoints, "delta", "Adjustment would make available points negative", args[2])
+		}
+		entity.Points = entity.Points + delta
+		err = t.updateSupply(stub, asset, float64(delta))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		delta, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || delta == 0 {
+			return nil, newError(codeBadArgument, "delta", "Invalid delta for adjustBalance", args[2])
+		}
+		if entity.Balance+delta < entity.HeldBalance {
+			return nil, newError(codeInsufficientBalance, "delta", "Adjustment would make available balance negative", args[2])
+		}
+		entity.Balance = entity.Balance + delta
+		err = t.updateSupply(stub, asset, delta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = t.putEntity(stub, key, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	txn := TxnAdjustment{
+		Version:    schemaVersion,
+		ID:         stub.GetTxID(),
+		Entity:     key,
+		Asset:      asset,
+		Delta:      args[2],
+		ReasonCode: reasonCode,
+		Note:       args[4],
+		Approver:   string(approver),
+		Time:       blockTime.String(),
+	}
+	bytes, err := json.Marshal(txn)
+	if err != nil {
+		fmt.Println("Error marshaling TxnAdjustment")
+		return nil, newError(codeInternal, "", "Error marshaling TxnAdjustment", "")
+	}
+	err = stub.PutState(txn.ID, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.appendKey(stub, "TxnAdjustment", txn.ID)
+}
+
+func (t *LoyaltyChaincode) getAllTxnAdjustment(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getAllTxnAdjustment is running ")
+
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var txns []TxnAdjustment
+
+	// Get list of all the keys - TxnAdjustment
+	keysBytes, err := stub.GetState("TxnAdjustment")
+	if err != nil {
+		fmt.Println("Error retrieving TxnAdjustment keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnAdjustment keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling TxnAdjustment key")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnAdjustment keys", "")
+	}
+
+	// Get each txn from "TxnAdjustment" keys
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var txn TxnAdjustment
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+		upgradeTxnAdjustment(&txn)
+
+		ok, err := visibleParty(visible, txn.Entity)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		fmt.Println("Appending txn adjustment details " + value)
+		txns = append(txns, txn)
+	}
+
+	bytes, err := json.Marshal(txns)
+	if err != nil {
+		fmt.Println("Error marshaling txns TxnAdjustment")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnAdjustment", "")
+	}
+	return bytes, nil
+}
+
+// demoGenesis - the demo customer, merchant, bank and café products
+func demoGenesis(customer string, merchant string, bank string) Genesis {
+	return Genesis{
+		Entities: []Entity{
+			{Type: "customer", Name: customer, Balance: 3000, Points: 30000},
+			{Type: "merchant", Name: merchant, Balance: 6000, Points: 60000},
+			{Type: "bank", Name: bank, Balance: 100000, Points: 100000},
+		},
+		Products: []Product{
+			{Name: "Café Frappe", Points: 495, Amount: 4.95, Entity: merchant, Qty: 500},
+			{Name: "Café Latte", Points: 365, Amount: 3.65, Entity: merchant, Qty: 500},
+			{Name: "Café Mocha", Points: 525, Amount: 5.25, Entity: merchant, Qty: 500},
+			{Name: "Cappuccino", Points: 295, Amount: 2.95, Entity: merchant, Qty: 500},
+		},
+		Rates:  map[string]float64{"encash": 100},
+		Admins: []string{},
+	}
+}
+
+// validateGenesis - checks a genesis document before Init writes any of it
+func validateGenesis(genesis Genesis) error {
+	if len(genesis.Entities) == 0 {
+		return newError(codeBadArgument, "entities", "Genesis document has no entities", "")
+	}
+
+	types := make(map[string]string)
+	for _, entity := range genesis.Entities {
+		if entity.Name == "" {
+			return newError(codeBadArgument, "entities", "Genesis entity without a name", "")
+		}
+		if _, ok := types[entity.Name]; ok {
+			return newError(codeBadArgument, "entities", "Duplicate genesis entity", entity.Name)
+		}
+		if entity.Type != "customer" && entity.Type != "merchant" && entity.Type != "bank" {
+			return newError(codeBadArgument, "entities", "Unknown type "+entity.Type+" for genesis entity", entity.Name)
+		}
+		if entity.Balance < 0 || entity.Points < 0 {
+			return newError(codeBadArgument, "entities", "Negative points or balance for genesis entity", entity.Name)
+		}
+		if entity.HeldBalance != 0 || entity.HeldPoints != 0 {
+			return newError(codeBadArgument, "entities", "Genesis entity cannot start with holds", entity.Name)
+		}
+		types[entity.Name] = entity.Type
+	}
+
+	products := make(map[string]bool)
+	for _, product := range genesis.Products {
+		if product.Name == "" {
+			return newError(codeBadArgument, "products", "Genesis product without a name", "")
+		}
+		if products[product.Name] {
+			return newError(codeBadArgument, "products", "Duplicate genesis product", product.Name)
+		}
+		if _, ok := types[product.Name]; ok {
+			return newError(codeBadArgument, "products", "Genesis product has the name of an entity", product.Name)
+		}
+		if types[product.Entity] != "merchant" {
+			return newError(codeBadArgument, "products", "Genesis product is not sold by a genesis merchant", product.Name)
+		}
+		if product.Points < 0 || product.Amount < 0 || product.Qty < 0 || product.Reserved != 0 {
+			return newError(codeBadArgument, "products", "Invalid price or quantity for genesis product", product.Name)
+		}
+		products[product.Name] = true
+	}
+
+	for name, rate := range genesis.Rates {
+		if name != "encash" {
+			return newError(codeBadArgument, "rates", "Unknown genesis rate", name)
+		}
+		if rate <= 0 {
+			return newError(codeBadArgument, "rates", "Genesis rate must be positive", name)
+		}
+	}
+
+	for _, admin := range genesis.Admins {
+		if admin == "" {
+			return newError(codeBadArgument, "admins", "Empty genesis admin identity", "")
+		}
+	}
+	if genesis.PauseQuorum < 0 {
+		return newError(codeBadArgument, "pauseQuorum", "Genesis pause quorum cannot be negative", "")
+	}
+	if len(genesis.Admins) > 0 && genesis.PauseQuorum > len(genesis.Admins) {
+		return newError(codeBadArgument, "pauseQuorum", "Genesis pause quorum is more than the number of admins", strconv.Itoa(len(genesis.Admins)))
+	}
+
+	organisations := make(map[string]bool)
+	for _, organisation := range genesis.Organisations {
+		if types[organisation] != "bank" && types[organisation] != "merchant" {
+			return newError(codeBadArgument, "organisations", "Organisation is not a genesis bank or merchant", organisation)
+		}
+		if organisations[organisation] {
+			return newError(codeBadArgument, "organisations", "Duplicate genesis organisation", organisation)
+		}
+		organisations[organisation] = true
+	}
+	if genesis.ParamThreshold < 0 || genesis.ParamThreshold > len(genesisOrganisations(genesis)) {
+		return newError(codeBadArgument, "paramThreshold", "Genesis parameter threshold must be between 1 and the number of organisations", "")
+	}
+	return nil
+}
+
+// genesisOrganisations - organisations voting on parameters, every bank and
+// merchant of the document unless they are listed
+func genesisOrganisations(genesis Genesis) []string {
+	if len(genesis.Organisations) > 0 {
+		return genesis.Organisations
 	}
+	organisations := []string{}
+	for _, entity := range genesis.Entities {
+		if entity.Type == "bank" || entity.Type == "merchant" {
+			organisations = append(organisations, entity.Name)
+		}
+	}
+	return organisations
+}
 
-	key1 := args[0] //customer
-	key2 := args[1] //merchant
-	key3 := args[2] //bank
-
-	cust := Entity{
-		Type:    "customer",
-		Name:    key1,
-		Balance: 3000,
-		Points:  30000,
+// putGenesisConfig - writes the parameters, admin identities and voting
+// organisations of a genesis document
+func (t *LoyaltyChaincode) putGenesisConfig(stub shim.ChaincodeStubInterface, genesis Genesis) error {
+	admins := genesis.Admins
+	if admins == nil {
+		admins = []string{}
 	}
-	fmt.Println(cust)
-	bytes, err := json.Marshal(cust)
+	bytes, err := json.Marshal(admins)
 	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
+		fmt.Println("Error marshaling admins")
+		return newError(codeInternal, "", "Error marshaling admins", "")
 	}
-	fmt.Println(bytes)
-	err = stub.PutState(key1, bytes)
+	err = stub.PutState("Admins", bytes)
 	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
+		return err
 	}
 
-	merch := Entity{
-		Type:    "merchant",
-		Name:    key2,
-		Balance: 6000,
-		Points:  60000,
-	}
-	fmt.Println(merch)
-	bytes, err = json.Marshal(merch)
-	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
+	quorum := genesis.PauseQuorum
+	if quorum == 0 {
+		quorum = len(admins)/2 + 1
 	}
-	fmt.Println(bytes)
-	err = stub.PutState(key2, bytes)
+	err = stub.PutState("PauseQuorum", []byte(strconv.Itoa(quorum)))
 	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
+		return err
 	}
 
-	bank := Entity{
-		Type:    "bank",
-		Name:    key3,
-		Balance: 100000,
-		Points:  100000,
-	}
-	fmt.Println(bank)
-	bytes, err = json.Marshal(bank)
+	organisations := genesisOrganisations(genesis)
+	bytes, err = json.Marshal(organisations)
 	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
+		fmt.Println("Error marshaling organisations")
+		return newError(codeInternal, "", "Error marshaling organisations", "")
 	}
-	fmt.Println(bytes)
-	err = stub.PutState(key3, bytes)
+	err = stub.PutState("ParamOrganisations", bytes)
 	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
+		return err
 	}
 
-	// Initialize the collection of  keys for products and various transactions
-	fmt.Println("Initializing keys collection")
-	var blank []string
-	blankBytes, _ := json.Marshal(&blank)
-	err = stub.PutState("Products", blankBytes)
-	if err != nil {
-		fmt.Println("Failed to initialize Products key collection")
+	params := map[string]float64{"encashRate": 100}
+	if rate, ok := genesis.Rates["encash"]; ok {
+		params["encashRate"] = rate
 	}
-	err = stub.PutState("TxnTopup", blankBytes)
-	if err != nil {
-		fmt.Println("Failed to initialize TxnTopUp key collection")
+	params["paramThreshold"] = float64(len(organisations)/2 + 1)
+	if genesis.ParamThreshold > 0 {
+		params["paramThreshold"] = float64(genesis.ParamThreshold)
 	}
-	err = stub.PutState("TxnGoods", blankBytes)
+	return t.putParams(stub, params)
+}
+
+// getParams - current values of the stored parameters. A ledger set up before
+// the parameter store still has its encash rate under Rates.
+func (t *LoyaltyChaincode) getParams(stub shim.ChaincodeStubInterface) (map[string]float64, error) {
+	params := make(map[string]float64)
+	bytes, err := stub.GetState("Params")
 	if err != nil {
-		fmt.Println("Failed to initialize TxnGoods key collection")
+		return params, newError(codeLedger, "", "Failed to get state of Params", "")
 	}
-	err = stub.PutState("TxnEncash", blankBytes)
-	if err != nil {
-		fmt.Println("Failed to initialize TxnEncash key collection")
+	if bytes == nil {
+		rates := make(map[string]float64)
+		bytes, err = stub.GetState("Rates")
+		if err == nil && bytes != nil && json.Unmarshal(bytes, &rates) == nil && rates["encash"] > 0 {
+			params["encashRate"] = rates["encash"]
+		}
+		return params, nil
 	}
-	err = stub.PutState("TxnTransfer", blankBytes)
+	err = json.Unmarshal(bytes, &params)
 	if err != nil {
-		fmt.Println("Failed to initialize TxnTransfer key collection")
+		fmt.Println("Error Unmarshaling Params")
+		return params, newError(codeCorruptRecord, "", "Error Unmarshaling Params", "")
 	}
-
-	fmt.Println("Initialization complete")
-
-	t.addProduct(stub, []string{"Café Frappe", "495", "4.95", key2, "500"})
-	t.addProduct(stub, []string{"Café Latte", "365", "3.65", key2, "500"})
-	t.addProduct(stub, []string{"Café Mocha", "525", "5.25", key2, "500"})
-	t.addProduct(stub, []string{"Cappuccino", "295", "2.95", key2, "500"})
-
-	return nil, nil
+	return params, nil
 }
 
-// Invoke isur entry point to invoke a chaincode function
-func (t *LoyaltyChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("invoke is running " + function)
-
-	// Handle different functions/transactions
-	if function == "init" {
-		return t.Init(stub, "init", args)
-	} else if function == "write" {
-		return t.write(stub, args)
-	} else if function == "buyGoods" {
-		return t.buyGoods(stub, args)
-	} else if function == "add" {
-		return t.add(stub, args)
-	} else if function == "encashMerchant" {
-		return t.encashMerchant(stub, args)
-	} else if function == "approve" {
-		return t.approve(stub, args)
-	} else if function == "transfer" {
-		return t.transfer(stub, args)
+// putParams - writes the parameter values back to the ledger
+func (t *LoyaltyChaincode) putParams(stub shim.ChaincodeStubInterface, params map[string]float64) error {
+	bytes, err := json.Marshal(params)
+	if err != nil {
+		fmt.Println("Error marshaling Params")
+		return newError(codeInternal, "", "Error marshaling Params", "")
 	}
-	fmt.Println("invoke did not find func: " + function)
-
-	return nil, errors.New("Received unknown function invocation: " + function)
+	return stub.PutState("Params", bytes)
 }
 
-// Query is our entry point for queries
-func (t *LoyaltyChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
-
-	// Handle different functions
-	if function == "read" {
-		return t.read(stub, args)
-	} else if function == "getAllProducts" {
-		return t.getAllProducts(stub)
-	} else if function == "getAllTxnTopup" {
-		return t.getAllTxnTopup(stub)
-	} else if function == "getAllTxnGoods" {
-		return t.getAllTxnGoods(stub)
-	} else if function == "getAllTxnEncash" {
-		return t.getAllTxnEncash(stub)
+// getParam - current value of a parameter, its default when it is not stored
+func (t *LoyaltyChaincode) getParam(stub shim.ChaincodeStubInterface, name string) float64 {
+	spec, _, _ := lookupParameter(name)
+	params, err := t.getParams(stub)
+	if err != nil {
+		return spec.Default
 	}
-	fmt.Println("query did not find func: " + function)
-
-	return nil, errors.New("Received unknown function query: " + function)
+	value, ok := params[name]
+	if !ok {
+		return spec.Default
+	}
+	return value
 }
 
-// write - invoke function to write key/value pair
-func (t *LoyaltyChaincode) write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	fmt.Println("running write()")
-
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. expecting 3")
-	}
+// getRate - reads a rate parameter, ex: encash reads encashRate
+func (t *LoyaltyChaincode) getRate(stub shim.ChaincodeStubInterface, name string) float64 {
+	return t.getParam(stub, name+"Rate")
+}
 
-	//writing a new customer to blockchain
-	typeOf := args[0]
-	name := args[1]
-	balance, err := strconv.ParseFloat(args[2], 64)
-	points, err := strconv.Atoi(args[3])
-	entity := Entity{
-		Type:    typeOf,
-		Name:    name,
-		Balance: balance,
-		Points:  points,
+// txTimeSeconds - seconds of a transaction time stored as a timestamp string
+func txTimeSeconds(txTime string) int64 {
+	index := s.Index(txTime, "seconds:")
+	if index < 0 {
+		return 0
 	}
-	fmt.Println(entity)
-	bytes, err := json.Marshal(entity)
-	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
+	fields := s.Fields(txTime[index+len("seconds:"):])
+	if len(fields) == 0 {
+		return 0
 	}
-	fmt.Println(bytes)
-	err = stub.PutState(name, bytes)
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
 	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
+		return 0
 	}
+	return seconds
+}
 
-	return nil, nil
+// upgradeEntity - brings an Entity read from the ledger up to schemaVersion
+func upgradeEntity(entity *Entity) {
+	if entity.Version < 2 {
+		// v2 only added fields whose zero values are correct for v1 records
+		entity.Version = 2
+	}
 }
 
-// read - query function to read key/value pair
-func (t *LoyaltyChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	fmt.Println("read() is running")
+// upgradeProduct - brings a Product read from the ledger up to schemaVersion
+func upgradeProduct(product *Product) {
+	if product.Version < 2 {
+		product.Version = 2
+	}
+}
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. expecting 1")
+// upgradeTxnTopup - brings a TxnTopup read from the ledger up to schemaVersion
+func upgradeTxnTopup(txn *TxnTopup) {
+	if txn.Version < 2 {
+		txn.Version = 2
 	}
+}
 
-	key := args[0] // name of Entity
+// upgradeTxnTransfer - brings a TxnTransfer read from the ledger up to schemaVersion
+func upgradeTxnTransfer(txn *TxnTransfer) {
+	if txn.Version < 2 {
+		txn.Version = 2
+	}
+}
 
-	bytes, err := stub.GetState(key)
-	if err != nil {
-		fmt.Println("Error retrieving " + key)
-		return nil, errors.New("Error retrieving " + key)
+// upgradeTxnGoods - brings a TxnGoods read from the ledger up to schemaVersion
+func upgradeTxnGoods(txn *TxnGoods) {
+	if txn.Version < 2 {
+		// v1 kept the product only in Remarks as "product - remarks", the
+		// quantity is lost and left at 0
+		if txn.Product == "" {
+			txn.Product = s.SplitN(txn.Remarks, " - ", 2)[0]
+		}
+		value, err := strconv.ParseFloat(txn.Value, 64)
+		if err == nil && txn.Points == 0 && txn.Amount == 0 {
+			if txn.Asset == "points" {
+				txn.Points = int(value)
+			} else {
+				txn.Amount = value
+			}
+		}
+		if txn.Timestamp == 0 {
+			txn.Timestamp = txTimeSeconds(txn.Time)
+		}
+		txn.Version = 2
 	}
-	customer := Entity{}
-	err = json.Unmarshal(bytes, &customer)
-	if err != nil {
-		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+}
+
+// upgradeTxnEncash - brings a TxnEncash read from the ledger up to schemaVersion
+func upgradeTxnEncash(txn *TxnEncash) {
+	if txn.Version < 2 {
+		txn.Version = 2
 	}
-	bytes, err = json.Marshal(customer)
-	if err != nil {
-		fmt.Println("Error marshaling customer")
-		return nil, errors.New("Error marshaling customer")
+	// Requests made before settleEncash have no status until they are settled
+	if txn.Status == "" && txn.Remarks == "New Request for Encashment" {
+		txn.Status = "pending"
 	}
-
-	fmt.Println(bytes)
-	return bytes, nil
 }
 
-func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	fmt.Println("buyGoods is running ")
+// upgradeTxnBatch - brings a TxnBatch read from the ledger up to schemaVersion
+func upgradeTxnBatch(txn *TxnBatch) {
+	if txn.Version < 2 {
+		txn.Version = 2
+	}
+}
 
-	if len(args) != 6 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 6 for buy goods")
+// upgradeTxnAdjustment - brings a TxnAdjustment read from the ledger up to schemaVersion
+func upgradeTxnAdjustment(txn *TxnAdjustment) {
+	if txn.Version < 2 {
+		txn.Version = 2
 	}
-	asset := args[0] //points or balance
-	key1 := args[1]  //Entity1 ex: customer
-	key2 := args[2]  //Entity2 ex: merchant
-	key3 := args[3]  //Product Entity
-	qty, err := strconv.Atoi(args[4])
+}
 
-	bytes, err := stub.GetState(key1)
+// upgradeRecord - upgrades one stored record of a key collection, reporting
+// whether it was below schemaVersion
+func upgradeRecord(collection string, bytes []byte) ([]byte, bool, error) {
+	var version struct {
+		Version int `json:"version"`
+	}
+	err := json.Unmarshal(bytes, &version)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key1)
+		return nil, false, err
 	}
-	if bytes == nil {
-		return nil, errors.New("Entity not found")
+	if version.Version >= schemaVersion {
+		return bytes, false, nil
+	}
+
+	var record interface{}
+	switch collection {
+	case "Entities":
+		entity := Entity{}
+		err = json.Unmarshal(bytes, &entity)
+		upgradeEntity(&entity)
+		record = entity
+	case "Products":
+		product := Product{}
+		err = json.Unmarshal(bytes, &product)
+		upgradeProduct(&product)
+		record = product
+	case "TxnTopup":
+		txn := TxnTopup{}
+		err = json.Unmarshal(bytes, &txn)
+		upgradeTxnTopup(&txn)
+		record = txn
+	case "TxnGoods":
+		txn := TxnGoods{}
+		err = json.Unmarshal(bytes, &txn)
+		upgradeTxnGoods(&txn)
+		record = txn
+	case "TxnTransfer":
+		txn := TxnTransfer{}
+		err = json.Unmarshal(bytes, &txn)
+		upgradeTxnTransfer(&txn)
+		record = txn
+	case "TxnEncash":
+		txn := TxnEncash{}
+		err = json.Unmarshal(bytes, &txn)
+		upgradeTxnEncash(&txn)
+		record = txn
+	case "TxnBatch":
+		txn := TxnBatch{}
+		err = json.Unmarshal(bytes, &txn)
+		upgradeTxnBatch(&txn)
+		record = txn
+	case "TxnAdjustment":
+		txn := TxnAdjustment{}
+		err = json.Unmarshal(bytes, &txn)
+		upgradeTxnAdjustment(&txn)
+		record = txn
+	case "Holds", "Disputes", "CreditLines", "FeeRules", "TaxRules", "Receipts", "Aliases", "Journal", "FraudRules", "FraudAlerts",
+		"PauseProposals", "PauseEvents", "ParamProposals", "GiftCards", "RedemptionItems", "TxnRedemption":
+		// These records came in with v2 and only lack the version, so they
+		// are stamped as they are rather than through their struct
+		fields := make(map[string]interface{})
+		decoder := json.NewDecoder(s.NewReader(string(bytes)))
+		decoder.UseNumber()
+		err = decoder.Decode(&fields)
+		fields["version"] = schemaVersion
+		record = fields
+	default:
+		return nil, false, newError(codeBadArgument, "collection", "Unknown collection", collection)
 	}
-	customer := Entity{}
-	err = json.Unmarshal(bytes, &customer)
 	if err != nil {
-		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+		return nil, false, err
 	}
 
-	bytes, err = stub.GetState(key2)
+	bytes, err = json.Marshal(record)
+	if err != nil {
+		return nil, false, err
+	}
+	return bytes, true, nil
+}
+
+// keyList - keys of a key collection, empty when the collection was never created
+func (t *LoyaltyChaincode) keyList(stub shim.ChaincodeStubInterface, collection string) ([]string, error) {
+	var keys []string
+	bytes, err := stub.GetState(collection)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key2)
+		fmt.Println("Error retrieving " + collection + " keys")
+		return nil, newError(codeLedger, "", "Error retrieving "+collection+" keys", "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return keys, nil
 	}
-	merchant := Entity{}
-	err = json.Unmarshal(bytes, &merchant)
+	err = json.Unmarshal(bytes, &keys)
 	if err != nil {
-		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+		fmt.Println("Error unmarshalling " + collection + " keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling "+collection+" keys", "")
 	}
-	bytes, err = stub.GetState(key3)
+	return keys, nil
+}
+
+// entityRefs - fields of the product and transaction records that name an entity
+type entityRefs struct {
+	Entity    string `json:"entity"`
+	Initiator string `json:"initiator"`
+	Sender    string `json:"sender"`
+	Receiver  string `json:"receiver"`
+	Bank      string `json:"bank"`
+}
+
+// indexEntities - adds the entities missing from the Entities collection. The
+// baseline Init kept no Entities collection, so entities are found through the
+// products and transactions that name them, and through the keys given for
+// entities that never transacted.
+func (t *LoyaltyChaincode) indexEntities(stub shim.ChaincodeStubInterface, extra []string) error {
+	keys, err := t.keyList(stub, "Entities")
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key2)
+		return err
 	}
-	product := Product{}
-	err = json.Unmarshal(bytes, &product)
-	if err != nil {
-		fmt.Println("Error Unmarshaling product bytes")
-		return nil, errors.New("Error Unmarshaling product Bytes")
-	}
-	if product.Entity == merchant.Name && product.Qty >= qty {
-		// Perform the transfer
-		if s.Compare(asset, "points") == 0 {
-			fmt.Println("points transfer")
-			//X, err := strconv.Atoi(args[3])
-			if customer.Points >= product.Points*qty {
-				customer.Points = customer.Points - product.Points*qty
-				merchant.Points = merchant.Points + product.Points*qty
-				product.Qty -= qty
-				args[4] = strconv.Itoa(product.Points * qty)
-				fmt.Printf("customer Points = %d, merchant Points = %d\n", customer.Points, merchant.Points)
-			} else {
-				return nil, errors.New("Insufficient points to buy goods")
+	indexed := make(map[string]bool)
+	for _, key := range keys {
+		indexed[key] = true
+	}
+
+	// Keys given explicitly must be entities, the ones found are skipped if not
+	for _, key := range extra {
+		entity, err := t.getEntity(stub, key)
+		if err != nil {
+			return err
+		}
+		if entity.Type == "" {
+			return newError(codeBadArgument, "keys", "Key is not an entity", key)
+		}
+	}
+	candidates := append([]string{}, extra...)
+	for _, collection := range []string{"Products", "TxnTopup", "TxnGoods", "TxnTransfer", "TxnEncash"} {
+		recordKeys, err := t.keyList(stub, collection)
+		if err != nil {
+			return err
+		}
+		for _, recordKey := range recordKeys {
+			bytes, err := stub.GetState(recordKey)
+			if err != nil {
+				return newError(codeLedger, "", "Failed to get state of "+recordKey, "")
 			}
-		} else {
-			fmt.Println("balance to be added")
-			//X, err := strconv.ParseFloat(args[3], 64)
-			if customer.Balance >= product.Amount*float64(qty) {
-				customer.Balance = customer.Balance - product.Amount*float64(qty)
-				merchant.Balance = merchant.Balance + product.Amount*float64(qty)
-				product.Qty -= qty
-				args[4] = strconv.FormatFloat(product.Amount*float64(qty), 'E', -1, 64)
-				fmt.Printf("customer Balance = %f, merchant Balance = %f\n", customer.Balance, merchant.Balance)
-			} else {
-				return nil, errors.New("Insufficient balance to buy goods")
+			if bytes == nil {
+				continue
+			}
+			refs := entityRefs{}
+			err = json.Unmarshal(bytes, &refs)
+			if err != nil {
+				fmt.Println("Error Unmarshaling " + collection + " record")
+				return newError(codeCorruptRecord, "", "Error Unmarshaling "+collection+" record", recordKey)
 			}
+			candidates = append(candidates, refs.Entity, refs.Initiator, refs.Sender, refs.Receiver, refs.Bank)
 		}
-		//product.Entity = customer.Name
-		// Write the customer/entity1 state back to the ledger
-		bytes, err = json.Marshal(customer)
-		if err != nil {
-			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+	}
+
+	added := 0
+	for _, key := range candidates {
+		if key == "" || indexed[key] {
+			continue
 		}
-		err = stub.PutState(key1, bytes)
+		indexed[key] = true
+		bytes, err := stub.GetState(key)
 		if err != nil {
-			return nil, err
+			return newError(codeLedger, "", "Failed to get state of "+key, "")
 		}
+		entity := Entity{}
+		if bytes == nil || json.Unmarshal(bytes, &entity) != nil || entity.Type == "" {
+			continue
+		}
+		keys = append(keys, key)
+		added++
+	}
+	// The collection is written even when empty, so appendKey can extend it
+	if added == 0 && keys != nil {
+		return nil
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	bytes, err := json.Marshal(keys)
+	if err != nil {
+		fmt.Println("Error marshaling Entities")
+		return newError(codeInternal, "", "Error marshaling Entities", "")
+	}
+	return stub.PutState("Entities", bytes)
+}
 
-		// Write the merchant/entity2 state back to the ledger]
-		bytes, err = json.Marshal(merchant)
-		if err != nil {
-			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+// migrate - admin invoke rewriting a batch of a key collection's records at
+// schemaVersion. Run it again from the returned Next until Done. The first
+// batch of Entities, from start 0, first indexes the entities missing from the
+// Entities collection.
+func (t *LoyaltyChaincode) migrate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("migrate is running ")
+
+	/*
+	   args[] - {collection, start, batchSize[, keys]}
+	   keys - JSON array of entity IDs to index, for entities of Entities that
+	          no product or transaction names
+	*/
+	if len(args) != 3 && len(args) != 4 {
+		return nil, argCountError("3 or 4", "migrate")
+	}
+	collection := args[0]
+	known := false
+	for _, name := range migrationCollections {
+		if name == collection {
+			known = true
 		}
-		err = stub.PutState(key2, bytes)
-		if err != nil {
-			return nil, err
+	}
+	if !known {
+		return nil, newError(codeBadArgument, "collection", "Unknown collection for migrate", collection)
+	}
+	start, err := strconv.Atoi(args[1])
+	if err != nil || start < 0 {
+		return nil, newError(codeBadArgument, "start", "Invalid start for migrate", args[1])
+	}
+	batchSize, err := strconv.Atoi(args[2])
+	if err != nil || batchSize <= 0 {
+		return nil, newError(codeBadArgument, "batchSize", "Invalid batch size for migrate", args[2])
+	}
+	var extra []string
+	if len(args) == 4 && args[3] != "" {
+		if collection != "Entities" {
+			return nil, newError(codeBadArgument, "keys", "Keys can only be given for Entities", collection)
 		}
-		// Write the product state back to the ledger
-		bytes, err = json.Marshal(product)
+		err = json.Unmarshal([]byte(args[3]), &extra)
 		if err != nil {
-			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+			return nil, newError(codeBadArgument, "keys", "Keys must be a JSON array of entity IDs", "")
 		}
-		err = stub.PutState(key3, bytes)
+	}
+	if collection == "Entities" && start == 0 {
+		err = t.indexEntities(stub, extra)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		args = append(args, stub.GetTxID())
-		blockTime, err := stub.GetTxTimestamp()
+	keys, err := t.keyList(stub, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	report := MigrationReport{
+		Collection: collection,
+		Total:      len(keys),
+		Start:      start,
+		Next:       start,
+		TxID:       stub.GetTxID(),
+	}
+	for report.Next < len(keys) && report.Next < start+batchSize {
+		key := keys[report.Next]
+		bytes, err := stub.GetState(key)
 		if err != nil {
-			return nil, err
+			return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+		}
+		if bytes != nil && collection == "Entities" {
+			err = t.backfillBalance(stub, key, bytes)
+			if err != nil {
+				return nil, err
+			}
 		}
-		args = append(args, blockTime.String())
-		t.putTxnGoods(stub, args)
+		if bytes != nil {
+			bytes, changed, err := upgradeRecord(collection, bytes)
+			if err != nil {
+				return nil, newError(codeCorruptRecord, "", "Error migrating record", key)
+			}
+			if changed {
+				err = stub.PutState(key, bytes)
+				if err != nil {
+					return nil, err
+				}
+				report.Migrated++
+			}
+		}
+		report.Next++
 	}
+	report.Done = report.Next >= len(keys)
 
-	return nil, nil
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		fmt.Println("Error marshaling migration report")
+		return nil, newError(codeInternal, "", "Error marshaling migration report", "")
+	}
+	err = stub.PutState("Migration_"+collection, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
 }
 
-func (t *LoyaltyChaincode) add(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	fmt.Println("add is running ")
+// getMigrationStatus - query function returning the last migrate report of a collection
+func (t *LoyaltyChaincode) getMigrationStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getMigrationStatus is running ")
 
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 3 for add")
+	if len(args) != 1 {
+		return nil, argCountError("1", "getMigrationStatus")
 	}
 
-	asset := args[0] //points or balance
-	key := args[1]   //Entity ex: customer
-	//amt, err := strconv.Atoi(args[1]) // points to be issued
-
-	// GET the state of entity from the ledger
-	bytes, err := stub.GetState(key)
+	bytes, err := stub.GetState("Migration_" + args[0])
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key)
+		return nil, newError(codeLedger, "", "Failed to get state of Migration_"+args[0], "")
 	}
-
-	entity := Entity{}
-	err = json.Unmarshal(bytes, &entity)
-	if err != nil {
-		fmt.Println("Error Unmarshaling entity Bytes")
-		return nil, errors.New("Error Unmarshaling entity Bytes")
+	if bytes == nil {
+		return nil, newError(codeNotFound, "collection", "No migration has run for collection", args[0])
 	}
+	return bytes, nil
+}
 
-	// Perform the addition of assests
-	if asset == "points" {
-		amt, err := strconv.Atoi(args[2])
-		if err == nil {
-			entity.Points = entity.Points + amt
-			fmt.Println("entity Points = ", entity.Points)
+// describe - query function returning the function registry, or the entry of one function
+func (t *LoyaltyChaincode) describe(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("describe is running ")
+
+	var bytes []byte
+	var err error
+	if len(args) == 1 {
+		spec, ok := lookupFunction(args[0])
+		if !ok {
+			return nil, newError(codeNotFound, "function", "Function not found", args[0])
 		}
+		bytes, err = json.Marshal(spec)
 	} else {
-		amt, err := strconv.ParseFloat(args[2], 64)
-		if err == nil {
-			entity.Balance = entity.Balance + amt
-			fmt.Println("entity Points = ", entity.Points)
-		}
-	}
-
-	// Write the state back to the ledger
-	bytes, err = json.Marshal(entity)
-	if err != nil {
-		fmt.Println("Error marshaling entity")
-		return nil, errors.New("Error marshaling entity")
+		bytes, err = json.Marshal(registry)
 	}
-	err = stub.PutState(key, bytes)
 	if err != nil {
-		return nil, err
+		fmt.Println("Error marshaling registry")
+		return nil, newError(codeInternal, "", "Error marshaling registry", "")
 	}
+	return bytes, nil
+}
 
-	ID := stub.GetTxID()
-	blockTime, err := stub.GetTxTimestamp()
-	args = append(args, ID)
-	args = append(args, blockTime.String())
-	t.putTxnTopup(stub, args)
-
-	return nil, nil
+// argSchema - OpenAPI schema of one argument
+func argSchema(spec ArgSpec) map[string]interface{} {
+	schema := map[string]interface{}{}
+	switch spec.Type {
+	case "int":
+		schema["type"] = "integer"
+	case "number":
+		schema["type"] = "number"
+	case "bool", "flag":
+		schema["type"] = "boolean"
+	case "json":
+		schema["oneOf"] = []interface{}{
+			map[string]interface{}{"type": "object"},
+			map[string]interface{}{"type": "array"},
+		}
+	default:
+		schema["type"] = "string"
+	}
+	if spec.Min != nil {
+		schema["minimum"] = *spec.Min
+	}
+	if spec.Max != nil {
+		schema["maximum"] = *spec.Max
+	}
+	if len(spec.Enum) > 0 {
+		schema["enum"] = spec.Enum
+	}
+	if spec.Entity {
+		schema["description"] = "Entity ID or alias"
+	}
+	if spec.Caller {
+		schema["description"] = "Entity ID or alias of the caller"
+		schema["x-caller"] = true
+	}
+	if spec.Private {
+		schema["x-private"] = true
+	}
+	return schema
 }
 
-func (t *LoyaltyChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// openAPI - OpenAPI document with one operation per registered function. The
+// request body of an operation is the named form of the function's arguments.
+func openAPI() map[string]interface{} {
+	errorSchema := map[string]interface{}{
+		"type":     "object",
+		"required": []string{"code", "message"},
+		"properties": map[string]interface{}{
+			"code":    map[string]interface{}{"type": "string"},
+			"field":   map[string]interface{}{"type": "string"},
+			"message": map[string]interface{}{"type": "string"},
+			"details": map[string]interface{}{"type": "string"},
+		},
+	}
 
-	fmt.Println("transfer is running ")
+	paths := map[string]interface{}{}
+	for _, spec := range registry {
+		body := map[string]interface{}{"type": "object"}
+		if spec.Args != nil {
+			properties := map[string]interface{}{}
+			required := []string{}
+			for _, arg := range spec.Args {
+				properties[arg.Name] = argSchema(arg)
+				if arg.Required {
+					required = append(required, arg.Name)
+				}
+			}
+			body["properties"] = properties
+			body["additionalProperties"] = false
+			if len(required) > 0 {
+				body["required"] = required
+			}
+		}
 
-	if len(args) != 5 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 5 for transfer")
+		paths["/"+spec.Kind+"/"+spec.Name] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"operationId": spec.Name,
+				"summary":     spec.Description,
+				"tags":        []string{spec.Kind},
+				"x-role":      spec.Role,
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": body},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{"description": "Result of " + spec.Name},
+					"400": map[string]interface{}{
+						"description": "ChaincodeError",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": map[string]interface{}{"$ref": "#/components/schemas/ChaincodeError"},
+							},
+						},
+					},
+				},
+			},
+		}
 	}
 
-	key := args[0]   // fromEntity ex: customer
-	key2 := args[1]  // toEntity ex: merchant
-	asset := args[2] // points or balance
-
-	// GET the state of fromEntity from the ledger
-	bytes, err := stub.GetState(key)
-	if err != nil {
-		return nil, errors.New("Failed to get state of " + key)
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "BCF loyalty points chaincode",
+			"version": strconv.Itoa(schemaVersion),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{"ChaincodeError": errorSchema},
+		},
 	}
+}
 
-	fromEntity := Entity{}
-	err = json.Unmarshal(bytes, &fromEntity)
+// getOpenAPI - query function returning the OpenAPI document of the registry
+func (t *LoyaltyChaincode) getOpenAPI(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getOpenAPI is running ")
+
+	bytes, err := json.Marshal(openAPI())
 	if err != nil {
-		fmt.Println("Error Unmarshaling entity Bytes")
-		return nil, errors.New("Error Unmarshaling entity Bytes")
+		fmt.Println("Error marshaling OpenAPI document")
+		return nil, newError(codeInternal, "", "Error marshaling OpenAPI document", "")
 	}
+	return bytes, nil
+}
 
-	// GET the state of toEntity from the ledger
-	bytes, err = stub.GetState(key2)
-	if err != nil {
-		return nil, errors.New("Failed to get state of " + key)
+// putRedemptionItem - admin invoke creating or replacing the mapping of a
+// catalogue item to the AssetMgmt stock it is redeemed for
+func (t *LoyaltyChaincode) putRedemptionItem(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("putRedemptionItem is running ")
+
+	/*
+	   args[] - {item, points, chaincode, assetType, units, stockAccount}
+	*/
+	if len(args) != 6 {
+		return nil, argCountError("6", "putRedemptionItem")
+	}
+	points, err := strconv.Atoi(args[1])
+	if err != nil || points <= 0 {
+		return nil, newError(codeBadArgument, "points", "Invalid points for redemption item", args[1])
+	}
+	units, err := strconv.ParseFloat(args[4], 64)
+	if err != nil || units <= 0 {
+		return nil, newError(codeBadArgument, "units", "Invalid units for redemption item", args[4])
 	}
 
-	toEntity := Entity{}
-	err = json.Unmarshal(bytes, &toEntity)
-	if err != nil {
-		fmt.Println("Error Unmarshaling entity Bytes")
-		return nil, errors.New("Error Unmarshaling entity Bytes")
+	item := RedemptionItem{
+		Version:      schemaVersion,
+		Item:         args[0],
+		Points:       points,
+		Chaincode:    args[2],
+		AssetType:    args[3],
+		Units:        units,
+		StockAccount: args[5],
 	}
 
-	// Perform transfer of assests
-	if asset == "points" {
-		amt, err := strconv.Atoi(args[3])
-		if err == nil {
-			fromEntity.Points = fromEntity.Points - amt
-			toEntity.Points = toEntity.Points + amt
-			fmt.Println("from entity Points = ", fromEntity.Points)
-		}
-	} else {
-		amt, err := strconv.ParseFloat(args[3], 64)
-		if err == nil {
-			fromEntity.Balance = fromEntity.Balance - amt
-			toEntity.Balance = toEntity.Balance + amt
-			fmt.Println("from entity Points = ", fromEntity.Points)
-		}
+	key := "RedemptionItem_" + item.Item
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
 	}
 
-	// Write the state back to the ledger
-	bytes, err = json.Marshal(fromEntity)
+	bytes, err := json.Marshal(item)
 	if err != nil {
-		fmt.Println("Error marshaling fromEntity")
-		return nil, errors.New("Error marshaling fromEntity")
+		fmt.Println("Error marshaling redemption item")
+		return nil, newError(codeInternal, "", "Error marshaling redemption item", "")
 	}
 	err = stub.PutState(key, bytes)
 	if err != nil {
 		return nil, err
 	}
 
-	bytes, err = json.Marshal(toEntity)
+	if existing != nil {
+		return nil, nil
+	}
+	return t.appendKey(stub, "RedemptionItems", key)
+}
+
+// getRedemptionItem - redemption mapping of a catalogue item
+func (t *LoyaltyChaincode) getRedemptionItem(stub shim.ChaincodeStubInterface, name string) (RedemptionItem, error) {
+	item := RedemptionItem{}
+	bytes, err := stub.GetState("RedemptionItem_" + name)
 	if err != nil {
-		fmt.Println("Error marshaling toEntity")
-		return nil, errors.New("Error marshaling toEntity")
+		return item, newError(codeLedger, "", "Failed to get state of RedemptionItem_"+name, "")
+	}
+	if bytes == nil {
+		return item, newError(codeNotFound, "item", "Redemption item not found", name)
 	}
-	err = stub.PutState(key2, bytes)
+	err = json.Unmarshal(bytes, &item)
 	if err != nil {
-		return nil, err
+		fmt.Println("Error Unmarshaling redemption item")
+		return item, newError(codeCorruptRecord, "", "Error Unmarshaling redemption item", name)
 	}
-
-	ID := stub.GetTxID()
-	blockTime, err := stub.GetTxTimestamp()
-	args = append(args, ID)
-	args = append(args, blockTime.String())
-	t.putTxnTransfer(stub, args)
-
-	return nil, nil
+	return item, nil
 }
 
-func (t *LoyaltyChaincode) encashMerchant(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	fmt.Println("encashMerchant is running ")
-
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 3 for encashMerchant")
-	}
-
-	points, err := strconv.Atoi(args[2])
-	blockTime, err := stub.GetTxTimestamp()
-	//time.Unix(blockTime.Seconds, 0)
+// getRedemptionItems - query function to list the redeemable catalogue items
+func (t *LoyaltyChaincode) getRedemptionItems(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getRedemptionItems is running ")
 
-	i++
-	key := "encash" + strconv.Itoa(i)
-	txn := TxnEncash{
-		Key:       key,
-		ID:        stub.GetTxID(),
-		Initiator: args[0],
-		Bank:      args[1],
-		Points:    points,
-		Amount:    points / 100,
-		Remarks:   "New Request for Encashment",
-		Time:      blockTime.String(),
-	}
+	var items []RedemptionItem
 
-	bytes, err := json.Marshal(txn)
+	keysBytes, err := stub.GetState("RedemptionItems")
 	if err != nil {
-		fmt.Println("Error marshaling encashMerchant")
-		return nil, errors.New("Error marshaling encashMerchant")
+		fmt.Println("Error retrieving RedemptionItems keys")
+		return nil, newError(codeLedger, "", "Error retrieving RedemptionItems keys", "")
 	}
-
-	err = stub.PutState(key, bytes)
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
-		return nil, err
+		fmt.Println("Error unmarshalling RedemptionItems keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling RedemptionItems keys", "")
 	}
 
-	return t.appendKey(stub, "TxnEncash", key)
-}
-
-func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	fmt.Println("approve is running ")
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
 
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 3 for encashMerchant")
+		var item RedemptionItem
+		err = json.Unmarshal(bytes, &item)
+		if err != nil {
+			fmt.Println("Error retrieving redemption item " + value)
+			return nil, newError(codeLedger, "", "Error retrieving redemption item "+value, "")
+		}
+		items = append(items, item)
 	}
 
-	points, err := strconv.Atoi(args[2])
-	balance, err := strconv.Atoi(args[3]) //ParseFloat(args[3], 64)
+	bytes, err := json.Marshal(items)
+	if err != nil {
+		fmt.Println("Error marshaling redemption items")
+		return nil, newError(codeInternal, "", "Error marshaling redemption items", "")
+	}
+	return bytes, nil
+}
 
-	bytes, err := stub.GetState(args[0])
+// checkAssetAccount - rejects an AssetMgmt account that is not held by the
+// AssetMgmt user with the customer's entity ID
+func (t *LoyaltyChaincode) checkAssetAccount(stub shim.ChaincodeStubInterface, chaincode string, customer string, account string) error {
+	bytes, err := stub.QueryChaincode(chaincode, [][]byte{[]byte("getEntity"), []byte(customer)})
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + args[0])
+		fmt.Println("AssetMgmt user lookup failed: " + err.Error())
+		return newError(codeAssetTransferFailed, "toAccount", "AssetMgmt user lookup failed", err.Error())
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return newError(codeNotAuthorized, "toAccount", "Customer has no AssetMgmt user", customer)
 	}
-	merchant := Entity{}
-	err = json.Unmarshal(bytes, &merchant)
+	var user struct {
+		Accounts []string `json:"accounts"`
+	}
+	err = json.Unmarshal(bytes, &user)
 	if err != nil {
-		fmt.Println("Error Unmarshaling merchant encash")
-		return nil, errors.New("Error Unmarshaling encash merchant")
+		fmt.Println("Error Unmarshaling AssetMgmt user")
+		return newError(codeCorruptRecord, "", "Error Unmarshaling AssetMgmt user", customer)
+	}
+	for _, held := range user.Accounts {
+		if held == account {
+			return nil
+		}
 	}
+	return newError(codeNotAuthorized, "toAccount", "AssetMgmt account is not held by the customer", account)
+}
 
-	bytes, err = stub.GetState(args[1])
-	if err != nil {
-		return nil, errors.New("Failed to get state of " + args[1])
+// redeemForAsset - invoke function burning a customer's points for stock of the
+// AssetMgmt asset type mapped to a catalogue item. The stock is moved by calling
+// the AssetMgmt transfer in the same transaction, so if that call fails the
+// error is returned and the burn is not committed either. The stock can only go
+// to an account of the customer's own AssetMgmt user. AssetMgmt does not check
+// who calls its transfer, so the stock account is not protected against direct
+// invokes of that chaincode.
+func (t *LoyaltyChaincode) redeemForAsset(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("redeemForAsset is running ")
+
+	/*
+	   args[] - {customer, item, qty, toAccount}
+	*/
+	if len(args) != 4 {
+		return nil, argCountError("4", "redeemForAsset")
 	}
-	if bytes == nil {
-		return nil, errors.New("Entity not found")
+	key := args[0]
+	qty, err := strconv.Atoi(args[2])
+	if err != nil || qty <= 0 {
+		return nil, newError(codeBadArgument, "qty", "Invalid quantity for redeemForAsset", args[2])
 	}
-	bank := Entity{}
-	err = json.Unmarshal(bytes, &bank)
+	toAccount := args[3]
+
+	item, err := t.getRedemptionItem(stub, args[1])
 	if err != nil {
-		fmt.Println("Error Unmarshaling bank encash")
-		return nil, errors.New("Error Unmarshaling encash bank")
+		return nil, err
+	}
+	err = t.checkAssetAccount(stub, item.Chaincode, key, toAccount)
+	if err != nil {
+		return nil, err
 	}
 
-	// Perform encashment
-	bank.Points = bank.Points + points
-	merchant.Points = merchant.Points - points
-	bank.Balance = bank.Balance - float64(balance)
-	merchant.Balance = merchant.Balance + float64(balance)
-
-	// Write the merchant/entity1 state back to the ledger
-	bytes, err = json.Marshal(merchant)
+	// Release the customer's expired holds so their points are available again
+	err = t.releaseExpiredHolds(stub, key)
 	if err != nil {
-		fmt.Println("Error marshaling merchant")
-		return nil, errors.New("Error marshaling merchant")
+		return nil, err
 	}
-	err = stub.PutState(args[0], bytes)
+	customer, err := t.getEntity(stub, key)
 	if err != nil {
 		return nil, err
 	}
+	if customer.Type != "customer" {
+		return nil, newError(codeBadArgument, "customer", "Only customers can redeem points", key)
+	}
+	points := item.Points * qty
+	if customer.Points-customer.HeldPoints < points {
+		return nil, newError(codeInsufficientPoints, "qty", "Insufficient points to redeem "+item.Item, strconv.Itoa(points))
+	}
 
-	// Write the bank/entity2 state back to the ledger]
-	bytes, err = json.Marshal(bank)
+	// Burn the points
+	customer.Points = customer.Points - points
+	err = t.putEntity(stub, key, customer)
 	if err != nil {
-		fmt.Println("Error marshaling bank")
-		return nil, errors.New("Error marshaling bank")
+		return nil, err
 	}
-	err = stub.PutState(args[1], bytes)
+	err = t.updateSupply(stub, "points", -float64(points))
 	if err != nil {
 		return nil, err
 	}
 
 	blockTime, err := stub.GetTxTimestamp()
-	// Write the TxnEncash state back to the ledger
-	i++
-	key := "encash" + strconv.Itoa(i)
-	txn := TxnEncash{
-		Key:       key,
+	if err != nil {
+		return nil, err
+	}
+	txn := TxnRedemption{
+		Version:   schemaVersion,
 		ID:        stub.GetTxID(),
-		Initiator: args[0],
-		Bank:      args[1],
+		Customer:  key,
+		Item:      item.Item,
+		Qty:       qty,
 		Points:    points,
-		Amount:    balance,
-		Remarks:   "Encashment Completed",
+		AssetType: item.AssetType,
+		Units:     item.Units * float64(qty),
+		From:      item.StockAccount,
+		To:        toAccount,
 		Time:      blockTime.String(),
 	}
-	bytes, err = json.Marshal(txn)
+
+	// Move the stock: AssetMgmt transfer takes {fromAccount, toAccount, assetName, amount, remarks}
+	_, err = stub.InvokeChaincode(item.Chaincode, [][]byte{
+		[]byte("transfer"),
+		[]byte(txn.From),
+		[]byte(txn.To),
+		[]byte(txn.AssetType),
+		[]byte(strconv.FormatFloat(txn.Units, 'f', -1, 64)),
+		[]byte("Loyalty redemption " + txn.ID),
+	})
+	if err != nil {
+		fmt.Println("AssetMgmt transfer failed: " + err.Error())
+		return nil, newError(codeAssetTransferFailed, "item", "AssetMgmt transfer failed", err.Error())
+	}
+
+	bytes, err := json.Marshal(txn)
 	if err != nil {
-		fmt.Println("Error marshaling TxnGoods")
-		return nil, errors.New("Error marshaling TxnGoods")
+		fmt.Println("Error marshaling TxnRedemption")
+		return nil, newError(codeInternal, "", "Error marshaling TxnRedemption", "")
 	}
-	err = stub.PutState(txn.Key, bytes)
+	key = "Redemption_" + txn.ID
+	err = stub.PutState(key, bytes)
 	if err != nil {
 		return nil, err
 	}
-
-	return t.appendKey(stub, "TxnEncash", key)
+	_, err = t.appendKey(stub, "TxnRedemption", key)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
 }
 
-func (t *LoyaltyChaincode) addProduct(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	fmt.Println("adding product information")
-	if len(args) != 5 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 5 for addProduct")
-	}
-	amt, err := strconv.ParseFloat(args[2], 64)
-	points, err := strconv.Atoi(args[1])
-	qty, err := strconv.Atoi(args[4])
+// getAllTxnRedemption - query function to list all redemptions for AssetMgmt stock
+func (t *LoyaltyChaincode) getAllTxnRedemption(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getAllTxnRedemption is running ")
 
-	product := Product{
-		Name:   args[0],
-		Points: points,
-		Amount: amt,
-		Entity: args[3],
-		Qty:    qty,
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
 	}
 
-	bytes, err := json.Marshal(product)
+	var txns []TxnRedemption
+
+	keysBytes, err := stub.GetState("TxnRedemption")
 	if err != nil {
-		fmt.Println("Error marshaling product")
-		return nil, errors.New("Error marshaling product")
+		fmt.Println("Error retrieving TxnRedemption keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnRedemption keys", "")
 	}
-
-	err = stub.PutState(product.Name, bytes)
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
-		return nil, err
+		fmt.Println("Error unmarshalling TxnRedemption keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnRedemption keys", "")
 	}
 
-	bytes, err = stub.GetState("Products")
-	if err != nil {
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
 
+		var txn TxnRedemption
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+		ok, err := visibleParty(visible, txn.Customer)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		txns = append(txns, txn)
 	}
-	var keys []string
-	err = json.Unmarshal(bytes, &keys)
+
+	bytes, err := json.Marshal(txns)
 	if err != nil {
+		fmt.Println("Error marshaling txns TxnRedemption")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnRedemption", "")
+	}
+	return bytes, nil
+}
 
+// putFeeRule - invoke function setting the fee of an event, by default or for
+// one merchant. A percent rate is a share of the value, a fixed rate is
+// charged as is in the asset of the transaction.
+func (t *LoyaltyChaincode) putFeeRule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("putFeeRule is running ")
+
+	/*
+	   args[] - {event, merchant, kind, rate, account}
+	*/
+	if len(args) != 5 {
+		return nil, argCountError("5", "putFeeRule")
 	}
-	keys = append(keys, args[0])
-	bytes, err = json.Marshal(keys)
+	rate, err := strconv.ParseFloat(args[3], 64)
+	if err != nil || rate < 0 {
+		return nil, newError(codeBadArgument, "rate", "Invalid rate for fee rule", args[3])
+	}
+	if args[2] == "percent" && rate > 100 {
+		return nil, newError(codeBadArgument, "rate", "Percent fee cannot exceed 100", args[3])
+	}
+	if args[1] != "" {
+		merchant, err := t.getEntity(stub, args[1])
+		if err != nil {
+			return nil, err
+		}
+		if merchant.Type != "merchant" {
+			return nil, newError(codeBadArgument, "merchant", "Fee rates can only be set per merchant", args[1])
+		}
+	}
+	_, err = t.getEntity(stub, args[4])
 	if err != nil {
-		fmt.Println("Error marshaling product keys")
-		return nil, errors.New("Error marshaling product keys")
+		return nil, err
 	}
-	err = stub.PutState("Products", bytes)
+
+	rule := FeeRule{
+		Version:  schemaVersion,
+		Event:    args[0],
+		Merchant: args[1],
+		Kind:     args[2],
+		Rate:     rate,
+		Account:  args[4],
+	}
+
+	key := "Fee_" + rule.Event + "_" + rule.Merchant
+	existing, err := stub.GetState(key)
 	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
 
+	bytes, err := json.Marshal(rule)
+	if err != nil {
+		fmt.Println("Error marshaling fee rule")
+		return nil, newError(codeInternal, "", "Error marshaling fee rule", "")
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	if existing != nil {
+		return nil, nil
+	}
+	return t.appendKey(stub, "FeeRules", key)
 }
 
-func (t *LoyaltyChaincode) getAllProducts(stub shim.ChaincodeStubInterface) ([]byte, error) {
-
-	fmt.Println("getAllProducts is running ")
+// getFeeSchedule - query function listing every fee rule
+func (t *LoyaltyChaincode) getFeeSchedule(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getFeeSchedule is running ")
 
-	var products []Product
+	var rules []FeeRule
 
-	// Get list of all the keys - Products
-	keysBytes, err := stub.GetState("Products")
+	keysBytes, err := stub.GetState("FeeRules")
 	if err != nil {
-		fmt.Println("Error retrieving Products")
-		return nil, errors.New("Error retrieving Products")
+		fmt.Println("Error retrieving FeeRules keys")
+		return nil, newError(codeLedger, "", "Error retrieving FeeRules keys", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
-		fmt.Println("Error unmarshalling Products")
-		return nil, errors.New("Error unmarshalling Products")
+		fmt.Println("Error unmarshalling FeeRules keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling FeeRules keys", "")
 	}
 
-	// Get each product from "Products" keys
 	for _, value := range keys {
 		bytes, err := stub.GetState(value)
 
-		var product Product
-		err = json.Unmarshal(bytes, &product)
+		var rule FeeRule
+		err = json.Unmarshal(bytes, &rule)
 		if err != nil {
-			fmt.Println("Error retrieving product " + value)
-			return nil, errors.New("Error retrieving product " + value)
+			fmt.Println("Error retrieving fee rule " + value)
+			return nil, newError(codeLedger, "", "Error retrieving fee rule "+value, "")
 		}
-
-		fmt.Println("Appending product " + value)
-		products = append(products, product)
+		rules = append(rules, rule)
 	}
 
-	bytes, err := json.Marshal(products)
+	bytes, err := json.Marshal(rules)
 	if err != nil {
-		fmt.Println("Error marshaling product")
-		return nil, errors.New("Error marshaling product")
+		fmt.Println("Error marshaling fee rules")
+		return nil, newError(codeInternal, "", "Error marshaling fee rules", "")
 	}
 	return bytes, nil
 }
 
-func (t *LoyaltyChaincode) putTxnTopup(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	fmt.Println("putTxnTopup is running ")
+// feeFor - fee due on a value for an event, with the account it is paid to.
+// The merchant's own rule wins over the default one; with no rule there is no
+// fee. The fee never exceeds the value and is whole when charged in points.
+func (t *LoyaltyChaincode) feeFor(stub shim.ChaincodeStubInterface, event string, merchant string, value float64, whole bool) (float64, string, error) {
+	bytes, err := stub.GetState("Fee_" + event + "_" + merchant)
+	if err != nil {
+		return 0, "", newError(codeLedger, "", "Failed to get state of Fee_"+event+"_"+merchant, "")
+	}
+	if bytes == nil && merchant != "" {
+		bytes, err = stub.GetState("Fee_" + event + "_")
+		if err != nil {
+			return 0, "", newError(codeLedger, "", "Failed to get state of Fee_"+event+"_", "")
+		}
+	}
+	if bytes == nil {
+		return 0, "", nil
+	}
 
-	if len(args) != 5 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 5 for putTxnTopup")
+	var rule FeeRule
+	err = json.Unmarshal(bytes, &rule)
+	if err != nil {
+		fmt.Println("Error Unmarshaling fee rule")
+		return 0, "", newError(codeCorruptRecord, "", "Error Unmarshaling fee rule", "")
 	}
-	txn := TxnTopup{
-		Initiator: args[1],
-		Remarks:   args[0] + " addedd",
-		ID:        args[3],
-		Time:      args[4],
-		Value:     args[2],
-		Asset:     args[0],
+
+	fee := rule.Rate
+	if rule.Kind == "percent" {
+		fee = value * rule.Rate / 100
+	}
+	if fee > value {
+		fee = value
+	}
+	if whole {
+		fee = math.Floor(fee)
+	}
+	return fee, rule.Account, nil
+}
+
+// payFee - credits a fee to the fee account. Called after the parties of the
+// transaction are written so the account is read with their changes.
+func (t *LoyaltyChaincode) payFee(stub shim.ChaincodeStubInterface, account string, asset string, fee float64) error {
+	if fee <= 0 || account == "" {
+		return nil
+	}
+	entity, err := t.getEntity(stub, account)
+	if err != nil {
+		return err
+	}
+	if asset == "points" {
+		entity.Points += int(fee)
+	} else {
+		entity.Balance += fee
+	}
+	return t.writeEntity(stub, account, entity, accountFees)
+}
+
+// putTaxRule - invoke function setting the taxes of a product category in a
+// jurisdiction. An empty category is the default of the jurisdiction.
+func (t *LoyaltyChaincode) putTaxRule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("putTaxRule is running ")
+
+	/*
+	   args[] - {jurisdiction, category, components}
+	   components - [{"name": "VAT", "rate": 20}]
+	*/
+	if len(args) != 3 {
+		return nil, argCountError("3", "putTaxRule")
+	}
+	if args[0] == "" {
+		return nil, newError(codeBadArgument, "jurisdiction", "Jurisdiction is required", "")
+	}
+	var components []TaxRate
+	err := json.Unmarshal([]byte(args[2]), &components)
+	if err != nil {
+		return nil, newError(codeBadArgument, "components", "Invalid tax components", err.Error())
+	}
+	for _, component := range components {
+		if component.Name == "" || component.Rate < 0 {
+			return nil, newError(codeBadArgument, "components", "Tax components need a name and a rate of 0 or more", component.Name)
+		}
 	}
 
-	bytes, err := json.Marshal(txn)
+	rule := TaxRule{
+		Version:      schemaVersion,
+		Jurisdiction: args[0],
+		Category:     args[1],
+		Components:   components,
+	}
+
+	key := "Tax_" + rule.Jurisdiction + "_" + rule.Category
+	existing, err := stub.GetState(key)
 	if err != nil {
-		fmt.Println("Error marshaling TxnTopup")
-		return nil, errors.New("Error marshaling TxnTopup")
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
 	}
 
-	err = stub.PutState(txn.ID, bytes)
+	bytes, err := json.Marshal(rule)
+	if err != nil {
+		fmt.Println("Error marshaling tax rule")
+		return nil, newError(codeInternal, "", "Error marshaling tax rule", "")
+	}
+	err = stub.PutState(key, bytes)
 	if err != nil {
 		return nil, err
 	}
 
-	return t.appendKey(stub, "TxnTopup", txn.ID)
+	if existing != nil {
+		return nil, nil
+	}
+	return t.appendKey(stub, "TaxRules", key)
 }
 
-func (t *LoyaltyChaincode) getAllTxnTopup(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	fmt.Println("getAllTxnTopup is running ")
+// getTaxRules - query function listing every tax rule
+func (t *LoyaltyChaincode) getTaxRules(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getTaxRules is running ")
 
-	var txns []TxnTopup
+	var rules []TaxRule
 
-	// Get list of all the keys - TxnTopup
-	keysBytes, err := stub.GetState("TxnTopup")
+	keysBytes, err := stub.GetState("TaxRules")
 	if err != nil {
-		fmt.Println("Error retrieving TxnTopup keys")
-		return nil, errors.New("Error retrieving TxnTopup keys")
+		fmt.Println("Error retrieving TaxRules keys")
+		return nil, newError(codeLedger, "", "Error retrieving TaxRules keys", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
-		fmt.Println("Error unmarshalling TxnTopup key")
-		return nil, errors.New("Error unmarshalling TxnTopup keys")
+		fmt.Println("Error unmarshalling TaxRules keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TaxRules keys", "")
 	}
 
-	// Get each product txn "TxnTopup" keys
 	for _, value := range keys {
 		bytes, err := stub.GetState(value)
 
-		var txn TxnTopup
-		err = json.Unmarshal(bytes, &txn)
+		var rule TaxRule
+		err = json.Unmarshal(bytes, &rule)
 		if err != nil {
-			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			fmt.Println("Error retrieving tax rule " + value)
+			return nil, newError(codeLedger, "", "Error retrieving tax rule "+value, "")
 		}
-
-		fmt.Println("Appending txn" + value)
-		txns = append(txns, txn)
+		rules = append(rules, rule)
 	}
 
-	bytes, err := json.Marshal(txns)
+	bytes, err := json.Marshal(rules)
 	if err != nil {
-		fmt.Println("Error marshaling txns topup")
-		return nil, errors.New("Error marshaling txns topup")
+		fmt.Println("Error marshaling tax rules")
+		return nil, newError(codeInternal, "", "Error marshaling tax rules", "")
 	}
 	return bytes, nil
 }
 
-func (t *LoyaltyChaincode) putTxnGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	fmt.Println("putTxnGoods is running ")
+// priceGoods - net, tax and gross of a quantity of a product. The product
+// amount is net of tax; the taxes are those of the merchant's jurisdiction for
+// the product category, falling back to the jurisdiction default.
+func (t *LoyaltyChaincode) priceGoods(stub shim.ChaincodeStubInterface, merchant Entity, product Product, qty int) (ReceiptLine, []TaxLine, error) {
+	line := ReceiptLine{
+		Product:   product.Name,
+		Category:  product.Category,
+		Qty:       qty,
+		UnitPrice: product.Amount,
+		Net:       product.Amount * float64(qty),
+	}
+	line.Gross = line.Net
 
-	if len(args) != 8 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 8 for putTxnGoods")
+	taxes := []TaxLine{}
+	if merchant.Jurisdiction == "" {
+		return line, taxes, nil
 	}
-	txn := TxnGoods{
-		Sender:   args[1],
-		Receiver: args[2],
-		Remarks:  args[3] + " - " + args[5],
-		ID:       args[6],
-		Time:     args[7],
-		Value:    args[4],
-		Asset:    args[0],
+	key := "Tax_" + merchant.Jurisdiction + "_" + product.Category
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return line, taxes, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil && product.Category != "" {
+		key = "Tax_" + merchant.Jurisdiction + "_"
+		bytes, err = stub.GetState(key)
+		if err != nil {
+			return line, taxes, newError(codeLedger, "", "Failed to get state of "+key, "")
+		}
+	}
+	if bytes == nil {
+		return line, taxes, nil
 	}
 
-	bytes, err := json.Marshal(txn)
+	var rule TaxRule
+	err = json.Unmarshal(bytes, &rule)
 	if err != nil {
-		fmt.Println("Error marshaling TxnGoods")
-		return nil, errors.New("Error marshaling TxnGoods")
+		fmt.Println("Error Unmarshaling tax rule")
+		return line, taxes, newError(codeCorruptRecord, "", "Error Unmarshaling tax rule", key)
 	}
+	for _, component := range rule.Components {
+		amount := roundCents(line.Net * component.Rate / 100)
+		taxes = append(taxes, TaxLine{Name: component.Name, Rate: component.Rate, Amount: amount})
+		line.Tax += amount
+	}
+	line.Tax = roundCents(line.Tax)
+	line.Gross = roundCents(line.Net + line.Tax)
+	return line, taxes, nil
+}
 
-	err = stub.PutState(txn.ID, bytes)
-	if err != nil {
-		return nil, err
+// roundCents - rounds an amount to two decimals, half away from zero
+func roundCents(amount float64) float64 {
+	if amount < 0 {
+		return -math.Floor(-amount*100+0.5) / 100
+	}
+	return math.Floor(amount*100+0.5) / 100
+}
+
+// putReceipt - records the receipt of a purchase under its transaction ID
+func (t *LoyaltyChaincode) putReceipt(stub shim.ChaincodeStubInterface, customer string, merchant Entity, merchantKey string, asset string, line ReceiptLine, taxes []TaxLine, timestamp string) error {
+	receipt := Receipt{
+		Version:      schemaVersion,
+		TxID:         stub.GetTxID(),
+		Merchant:     merchantKey,
+		Customer:     customer,
+		Jurisdiction: merchant.Jurisdiction,
+		Asset:        asset,
+		Lines:        []ReceiptLine{line},
+		Taxes:        taxes,
+		Net:          line.Net,
+		Tax:          line.Tax,
+		Gross:        line.Gross,
+		Time:         timestamp,
 	}
 
-	return t.appendKey(stub, "TxnGoods", txn.ID)
+	bytes, err := json.Marshal(receipt)
+	if err != nil {
+		fmt.Println("Error marshaling receipt")
+		return newError(codeInternal, "", "Error marshaling receipt", "")
+	}
+	key := "Receipt_" + receipt.TxID
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		return err
+	}
+	_, err = t.appendKey(stub, "Receipts", key)
+	return err
 }
 
-func (t *LoyaltyChaincode) getAllTxnGoods(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	fmt.Println("getAllTxnGoods is running ")
+// getReceipt - query function returning the receipt of a purchase
+func (t *LoyaltyChaincode) getReceipt(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getReceipt is running ")
 
-	var txns []TxnGoods
+	if len(args) != 1 {
+		return nil, argCountError("1", "getReceipt")
+	}
+	bytes, err := stub.GetState("Receipt_" + args[0])
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of Receipt_"+args[0], "")
+	}
+	if bytes == nil {
+		return nil, newError(codeNotFound, "txID", "Receipt not found", args[0])
+	}
+	receipt := Receipt{}
+	err = json.Unmarshal(bytes, &receipt)
+	if err != nil {
+		fmt.Println("Error Unmarshaling receipt")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling receipt", args[0])
+	}
+	visible, err := t.visibleFilter(stub)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := visibleParty(visible, receipt.Customer, receipt.Merchant)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, newError(codeNotAuthorized, "txID", "Only the parties of a purchase can read its receipt", args[0])
+	}
+	return bytes, nil
+}
 
-	// Get list of all the keys - TxnGoods
-	keysBytes, err := stub.GetState("TxnGoods")
+// giftCardHash - hex sha256 of a gift card salt followed by its code
+func giftCardHash(salt string, code string) string {
+	sum := sha256.Sum256([]byte(salt + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// getGiftCard - reads a gift card from the ledger
+func (t *LoyaltyChaincode) getGiftCard(stub shim.ChaincodeStubInterface, id string) (GiftCard, error) {
+	card := GiftCard{}
+	bytes, err := stub.GetState("GiftCard_" + id)
 	if err != nil {
-		fmt.Println("Error retrieving TxnGoods keys")
-		return nil, errors.New("Error retrieving TxnGoods keys")
+		return card, newError(codeLedger, "", "Failed to get state of GiftCard_"+id, "")
 	}
-	var keys []string
-	err = json.Unmarshal(keysBytes, &keys)
+	if bytes == nil {
+		return card, newError(codeNotFound, "cardID", "Gift card not found", id)
+	}
+	err = json.Unmarshal(bytes, &card)
 	if err != nil {
-		fmt.Println("Error unmarshalling TxnGoods key")
-		return nil, errors.New("Error unmarshalling TxnGoods keys")
+		fmt.Println("Error Unmarshaling gift card")
+		return card, newError(codeCorruptRecord, "", "Error Unmarshaling gift card", id)
 	}
+	return card, nil
+}
 
-	// Get each txn from "TxnGoods" keys
-	for _, value := range keys {
-		bytes, err := stub.GetState(value)
+// putGiftCard - writes a gift card to the ledger
+func (t *LoyaltyChaincode) putGiftCard(stub shim.ChaincodeStubInterface, card GiftCard) error {
+	card.Version = schemaVersion
+	if card.Balance <= 0 && card.Status == "active" {
+		card.Status = "spent"
+	}
 
-		var txn TxnGoods
-		err = json.Unmarshal(bytes, &txn)
+	// Journal the change in the value stored on the card
+	previous := GiftCard{}
+	bytes, err := stub.GetState("GiftCard_" + card.ID)
+	if err != nil {
+		return newError(codeLedger, "", "Failed to get state of GiftCard_"+card.ID, "")
+	}
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &previous)
 		if err != nil {
-			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			fmt.Println("Error Unmarshaling gift card")
+			return newError(codeCorruptRecord, "", "Error Unmarshaling gift card", card.ID)
 		}
+	}
+	err = t.post(stub, accountGiftCards, card.ID, "balance", card.Balance-previous.Balance)
+	if err != nil {
+		return err
+	}
 
-		fmt.Println("Appending txn goods details " + value)
-		txns = append(txns, txn)
+	bytes, err = json.Marshal(card)
+	if err != nil {
+		fmt.Println("Error marshaling gift card")
+		return newError(codeInternal, "", "Error marshaling gift card", "")
 	}
+	return stub.PutState("GiftCard_"+card.ID, bytes)
+}
 
-	bytes, err := json.Marshal(txns)
+// unlockGiftCard - reads a gift card for spending, checking its code and expiry
+func (t *LoyaltyChaincode) unlockGiftCard(stub shim.ChaincodeStubInterface, id string, code string) (GiftCard, error) {
+	card, err := t.getGiftCard(stub, id)
 	if err != nil {
-		fmt.Println("Error marshaling txns TxnGoods")
-		return nil, errors.New("Error marshaling txns TxnGoods")
+		return card, err
 	}
-	return bytes, nil
+	if giftCardHash(card.Salt, code) != card.CodeHash {
+		return card, newError(codeNotAuthorized, "code", "Invalid gift card code", id)
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return card, err
+	}
+	if blockTime.Seconds > card.Expiry {
+		return card, newError(codeInvalidState, "cardID", "Gift card has expired", id)
+	}
+	if card.Status != "active" {
+		return card, newError(codeInvalidState, "cardID", "Gift card is "+card.Status, id)
+	}
+	return card, nil
 }
 
-func (t *LoyaltyChaincode) putTxnTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	fmt.Println("putTxnTransfer is running ")
+// checkCodeHash - normalises a gift card code hash, which must be a hex
+// encoded sha256
+func checkCodeHash(field string, codeHash string) (string, error) {
+	codeHash = s.ToLower(codeHash)
+	hashBytes, err := hex.DecodeString(codeHash)
+	if err != nil || len(hashBytes) != sha256.Size {
+		return "", newError(codeBadArgument, field, "Code hash must be a hex encoded sha256", "")
+	}
+	return codeHash, nil
+}
 
-	if len(args) != 7 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 8 for putTxnTransfer")
+// rotateGiftCardCode - replaces the code of a card that keeps a balance after
+// it is spent. The spent code is public once its transaction is on the ledger,
+// so only the holder of the new code can spend what is left.
+func rotateGiftCardCode(card *GiftCard, nextCodeHash string) error {
+	if card.Balance <= 0 {
+		return nil
 	}
-	txn := TxnTransfer{
-		Sender:   args[0],
-		Receiver: args[1],
-		Remarks:  args[4],
-		ID:       args[5],
-		Time:     args[6],
-		Value:    args[3],
-		Asset:    args[2],
+	if nextCodeHash == "" {
+		return newError(codeBadArgument, "nextCodeHash", "A new code hash is required while the gift card keeps a balance", card.ID)
 	}
-
-	bytes, err := json.Marshal(txn)
+	codeHash, err := checkCodeHash("nextCodeHash", nextCodeHash)
 	if err != nil {
-		fmt.Println("Error marshaling TxnTransfer")
-		return nil, errors.New("Error marshaling TxnTransfer")
+		return err
 	}
+	if codeHash == card.CodeHash {
+		return newError(codeBadArgument, "nextCodeHash", "The new code must differ from the spent code", card.ID)
+	}
+	card.CodeHash = codeHash
+	return nil
+}
 
-	err = stub.PutState(txn.ID, bytes)
+// issueGiftCard - invoke function for a merchant to issue a gift card. The value
+// is taken from the merchant's balance and only a salted hash of the code, which
+// the merchant generates off the ledger, is stored.
+func (t *LoyaltyChaincode) issueGiftCard(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("issueGiftCard is running ")
+
+	/*
+	   args[] - {merchant, cardID, codeHash, salt, value, expiryDays}
+	*/
+	if len(args) != 6 {
+		return nil, argCountError("6", "issueGiftCard")
+	}
+	key := args[0]
+	codeHash, err := checkCodeHash("codeHash", args[2])
 	if err != nil {
 		return nil, err
 	}
+	value, err := strconv.ParseFloat(args[4], 64)
+	if err != nil || value <= 0 {
+		return nil, newError(codeBadArgument, "value", "Invalid value for issueGiftCard", args[4])
+	}
+	days, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil || days <= 0 {
+		return nil, newError(codeBadArgument, "expiryDays", "Invalid expiry for issueGiftCard", args[5])
+	}
 
-	return t.appendKey(stub, "TxnTransfer", txn.ID)
-}
-
-func (t *LoyaltyChaincode) getAllTxnTransfer(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	fmt.Println("getAllTxnTransfer is running ")
+	merchant, err := t.getEntity(stub, key)
+	if err != nil {
+		return nil, err
+	}
+	if merchant.Type != "merchant" {
+		return nil, newError(codeNotAuthorized, "merchant", "Only a merchant can issue gift cards", key)
+	}
+	existing, err := stub.GetState("GiftCard_" + args[1])
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of GiftCard_"+args[1], "")
+	}
+	if existing != nil {
+		return nil, newError(codeBadArgument, "cardID", "Gift card already exists", args[1])
+	}
+	if merchant.Balance-merchant.HeldBalance < value {
+		return nil, newError(codeInsufficientBalance, "value", "Insufficient balance to issue gift card", args[4])
+	}
 
-	var txns []TxnTransfer
+	// The card holds the value until it is spent or loaded
+	merchant.Balance = merchant.Balance - value
+	err = t.putEntity(stub, key, merchant)
+	if err != nil {
+		return nil, err
+	}
 
-	// Get list of all the keys - TxnGoods
-	keysBytes, err := stub.GetState("TxnTransfer")
+	blockTime, err := stub.GetTxTimestamp()
 	if err != nil {
-		fmt.Println("Error retrieving TxnTransfer keys")
-		return nil, errors.New("Error retrieving TxnTransfer keys")
+		return nil, err
 	}
-	var keys []string
-	err = json.Unmarshal(keysBytes, &keys)
+	card := GiftCard{
+		ID:          args[1],
+		Merchant:    key,
+		CodeHash:    codeHash,
+		Salt:        args[3],
+		Value:       value,
+		Balance:     value,
+		Expiry:      blockTime.Seconds + days*24*60*60,
+		Status:      "active",
+		Redemptions: []string{},
+		Time:        blockTime.String(),
+	}
+	err = t.putGiftCard(stub, card)
 	if err != nil {
-		fmt.Println("Error unmarshalling TxnTransfer key")
-		return nil, errors.New("Error unmarshalling TxnTransfer keys")
+		return nil, err
+	}
+	_, err = t.appendKey(stub, "GiftCards", "GiftCard_"+card.ID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get each txn from "TxnTransfer" keys
-	for _, value := range keys {
-		bytes, err := stub.GetState(value)
+	return t.putTxnTransfer(stub, []string{key, "GiftCard_" + card.ID, "balance", args[4], "Gift card issued", stub.GetTxID(), blockTime.String()})
+}
 
-		var txn TxnTransfer
-		err = json.Unmarshal(bytes, &txn)
-		if err != nil {
-			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+// loadGiftCard - invoke function moving some or all of a gift card's balance
+// into the balance of the entity holding its code. A card that keeps a balance
+// needs the hash of a new code.
+func (t *LoyaltyChaincode) loadGiftCard(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("loadGiftCard is running ")
+
+	/*
+	   args[] - {cardID, code, entity[, amount[, nextCodeHash]]}
+	   amount - empty for the whole balance
+	*/
+	if len(args) < 3 || len(args) > 5 {
+		return nil, argCountError("3 to 5", "loadGiftCard")
+	}
+	card, err := t.unlockGiftCard(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	amount := card.Balance
+	if len(args) >= 4 && args[3] != "" {
+		amount, err = strconv.ParseFloat(args[3], 64)
+		if err != nil || amount <= 0 {
+			return nil, newError(codeBadArgument, "amount", "Invalid amount for loadGiftCard", args[3])
 		}
+	}
+	if amount > card.Balance {
+		return nil, newError(codeInsufficientBalance, "amount", "Insufficient gift card balance", strconv.FormatFloat(card.Balance, 'f', -1, 64))
+	}
 
-		fmt.Println("Appending txn goods details " + value)
-		txns = append(txns, txn)
+	key := args[2]
+	entity, err := t.getEntity(stub, key)
+	if err != nil {
+		return nil, err
+	}
+	entity.Balance = entity.Balance + amount
+	card.Balance = card.Balance - amount
+	card.Redemptions = append(card.Redemptions, stub.GetTxID())
+	nextCodeHash := ""
+	if len(args) == 5 {
+		nextCodeHash = args[4]
+	}
+	err = rotateGiftCardCode(&card, nextCodeHash)
+	if err != nil {
+		return nil, err
+	}
+	err = t.putEntity(stub, key, entity)
+	if err != nil {
+		return nil, err
+	}
+	err = t.putGiftCard(stub, card)
+	if err != nil {
+		return nil, err
 	}
 
-	bytes, err := json.Marshal(txns)
+	blockTime, err := stub.GetTxTimestamp()
 	if err != nil {
-		fmt.Println("Error marshaling txns TxnTransfer")
-		return nil, errors.New("Error marshaling txns TxnTransfer")
+		return nil, err
 	}
-	return bytes, nil
+	return t.putTxnTransfer(stub, []string{"GiftCard_" + card.ID, key, "balance", strconv.FormatFloat(amount, 'f', -1, 64), "Gift card loaded", stub.GetTxID(), blockTime.String()})
 }
 
-func (t *LoyaltyChaincode) getAllTxnEncash(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	fmt.Println("getAllTxnEncash is running ")
+// expireGiftCards - invoke function returning the balance left on a merchant's
+// expired gift cards to the merchant. The cards are marked expired so the value
+// is no longer counted as outstanding.
+func (t *LoyaltyChaincode) expireGiftCards(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("expireGiftCards is running ")
 
-	var txns []TxnEncash
+	/*
+	   args[] - {merchant}
+	*/
+	if len(args) != 1 {
+		return nil, argCountError("1", "expireGiftCards")
+	}
+	key := args[0]
+	merchant, err := t.getEntity(stub, key)
+	if err != nil {
+		return nil, err
+	}
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
 
-	// Get list of all the keys - TxnGoods
-	keysBytes, err := stub.GetState("TxnEncash")
+	bytes, err := stub.GetState("GiftCards")
 	if err != nil {
-		fmt.Println("Error retrieving TxnEncash keys")
-		return nil, errors.New("Error retrieving TxnEncash keys")
+		return nil, newError(codeLedger, "", "Error retrieving GiftCards keys", "")
 	}
 	var keys []string
-	err = json.Unmarshal(keysBytes, &keys)
+	err = json.Unmarshal(bytes, &keys)
 	if err != nil {
-		fmt.Println("Error unmarshalling TxnEncash key")
-		return nil, errors.New("Error unmarshalling TxnEncash keys")
+		fmt.Println("Error unmarshalling GiftCards keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling GiftCards keys", "")
 	}
 
-	// Get each txn from "TxnGoods" keys
+	expired := []string{}
 	for _, value := range keys {
-		bytes, err := stub.GetState(value)
-
-		var txn TxnEncash
-		err = json.Unmarshal(bytes, &txn)
+		card, err := t.getGiftCard(stub, s.TrimPrefix(value, "GiftCard_"))
 		if err != nil {
-			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			return nil, err
 		}
-
-		fmt.Println("Appending txn encash details " + value)
-		txns = append(txns, txn)
+		if card.Merchant != key || card.Status != "active" || blockTime.Seconds <= card.Expiry {
+			continue
+		}
+		refund := card.Balance
+		merchant.Balance = merchant.Balance + refund
+		card.Balance = 0
+		card.Status = "expired"
+		err = t.putGiftCard(stub, card)
+		if err != nil {
+			return nil, err
+		}
+		if refund > 0 {
+			_, err = t.putTxnTransfer(stub, []string{"GiftCard_" + card.ID, key, "balance", strconv.FormatFloat(refund, 'f', -1, 64), "Gift card expired", stub.GetTxID() + "_" + card.ID, blockTime.String()})
+			if err != nil {
+				return nil, err
+			}
+		}
+		expired = append(expired, card.ID)
+	}
+	err = t.putEntity(stub, key, merchant)
+	if err != nil {
+		return nil, err
 	}
 
-	bytes, err := json.Marshal(txns)
+	bytes, err = json.Marshal(expired)
 	if err != nil {
-		fmt.Println("Error marshaling txns TxnEncash")
-		return nil, errors.New("Error marshaling txns TxnEncash")
+		fmt.Println("Error marshaling expired gift cards")
+		return nil, newError(codeInternal, "", "Error marshaling expired gift cards", "")
 	}
 	return bytes, nil
 }
-func (t *LoyaltyChaincode) appendKey(stub shim.ChaincodeStubInterface, primeKey string, key string) ([]byte, error) {
-	fmt.Println("appendKey is running " + primeKey + " " + key)
 
-	bytes, err := stub.GetState(primeKey)
-	if err != nil {
-		return nil, err
+// getGiftCardBalance - query function returning the balance of a gift card to
+// the holder of its code
+func (t *LoyaltyChaincode) getGiftCardBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("getGiftCardBalance is running ")
+
+	if len(args) != 2 {
+		return nil, argCountError("2", "getGiftCardBalance")
 	}
-	var keys []string
-	err = json.Unmarshal(bytes, &keys)
+	card, err := t.getGiftCard(stub, args[0])
 	if err != nil {
 		return nil, err
 	}
-	keys = append(keys, key)
-	bytes, err = json.Marshal(keys)
-	if err != nil {
-		fmt.Println("Error marshaling " + primeKey)
-		return nil, errors.New("Error marshaling keys" + primeKey)
+	if giftCardHash(card.Salt, args[1]) != card.CodeHash {
+		return nil, newError(codeNotAuthorized, "code", "Invalid gift card code", args[0])
 	}
-	err = stub.PutState(primeKey, bytes)
+
+	balance := GiftCardBalance{
+		ID:       card.ID,
+		Merchant: card.Merchant,
+		Value:    card.Value,
+		Balance:  card.Balance,
+		Expiry:   card.Expiry,
+		Status:   card.Status,
+	}
+	bytes, err := json.Marshal(balance)
 	if err != nil {
-		return nil, err
+		fmt.Println("Error marshaling gift card balance")
+		return nil, newError(codeInternal, "", "Error marshaling gift card balance", "")
 	}
-	return nil, nil
+	return bytes, nil
 }
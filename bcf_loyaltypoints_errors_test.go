@@ -0,0 +1,136 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// errorCodes - every code a client can match on
+var errorCodes = map[string]bool{
+	codeBadArgument: true, codeArgumentCount: true, codeUnknownFunction: true,
+	codeEntityNotFound: true, codeNotFound: true, codeInsufficientPoints: true,
+	codeInsufficientBalance: true, codeInsufficientQuantity: true, codeInsufficientBudget: true,
+	codeAssetTransferFailed: true, codeNotAuthorized: true, codeInvalidState: true,
+	codeLedger: true, codeCorruptRecord: true, codeInternal: true,
+	codeDuplicate: true, codePaused: true,
+}
+
+// decodeError - fails the test unless the error is a ChaincodeError in JSON
+// with a known code
+func decodeError(t *testing.T, function string, err error) ChaincodeError {
+	t.Helper()
+	var ccErr ChaincodeError
+	if jsonErr := json.Unmarshal([]byte(err.Error()), &ccErr); jsonErr != nil {
+		t.Fatalf("%s: error is not JSON: %v", function, err)
+	}
+	if !errorCodes[ccErr.Code] || ccErr.Message == "" {
+		t.Fatalf("%s: error has no known code and message: %v", function, err)
+	}
+	return ccErr
+}
+
+func TestArgumentCountErrorsNameTheFunction(t *testing.T) {
+	m := newDemoLedger(t)
+	for _, spec := range registry {
+		if spec.Args == nil {
+			continue
+		}
+		args := append(validArgs(spec, "cust"), "extra")
+		_, err := callSpec(m, spec, args)
+		if err == nil {
+			t.Fatalf("%s accepted %d arguments", spec.Name, len(args))
+		}
+		ccErr := decodeError(t, spec.Name, err)
+		if ccErr.Code != codeArgumentCount || ccErr.Field != "args" {
+			t.Fatalf("%s: %v", spec.Name, err)
+		}
+		if !strings.HasSuffix(ccErr.Message, " for "+spec.Name) {
+			t.Fatalf("%s: %v", spec.Name, err)
+		}
+	}
+
+	// approve once reported the argument count of encashMerchant
+	bytes, err := call(m, "invoke", "approve", "bank")
+	ccErr := expectError(t, codeArgumentCount, bytes, err)
+	if ccErr.Message != "Incorrect number of arguments. Expecting 2 to 3 for approve" {
+		t.Fatal(err)
+	}
+}
+
+func TestUnknownFunctionError(t *testing.T) {
+	m := newDemoLedger(t)
+	bytes, err := call(m, "invoke", "drain", "cust")
+	ccErr := expectError(t, codeUnknownFunction, bytes, err)
+	if ccErr.Field != "function" || ccErr.Details != "drain" {
+		t.Fatal(err)
+	}
+	// an invoke is not reachable as a query
+	bytes, err = call(m, "query", "transfer", "cust", "merch", "points", "1", "x")
+	expectError(t, codeUnknownFunction, bytes, err)
+}
+
+func TestBuyGoodsErrors(t *testing.T) {
+	m := newDemoLedger(t)
+	mustCall(t, m, "invoke", "write", "merchant", "merch2", "0", "0")
+	m.as("cust")
+	mustCall(t, m, "invoke", "transfer", "cust", "merch", "balance", "2990", "x")
+	for _, test := range []struct {
+		args  []string
+		code  string
+		field string
+	}{
+		{[]string{"points", "cust", "merch", "Espresso", "1", "x"}, codeNotFound, "product"},
+		{[]string{"points", "cust", "nobody", "Cappuccino", "1", "x"}, codeEntityNotFound, "merchant"},
+		{[]string{"points", "cust", "merch2", "Cappuccino", "1", "x"}, codeBadArgument, "merchant"},
+		{[]string{"points", "cust", "merch", "Cappuccino", "501", "x"}, codeInsufficientQuantity, "qty"},
+		{[]string{"points", "cust", "merch", "Cappuccino", "200", "x"}, codeInsufficientPoints, ""},
+		{[]string{"balance", "cust", "merch", "Cappuccino", "4", "x"}, codeInsufficientBalance, ""},
+	} {
+		bytes, err := call(m, "invoke", "buyGoods", test.args...)
+		ccErr := expectError(t, test.code, bytes, err)
+		if ccErr.Field != test.field {
+			t.Fatalf("buyGoods %v: %v", test.args, err)
+		}
+	}
+}
+
+func TestShimErrorsAreChaincodeErrors(t *testing.T) {
+	m := newDemoLedger(t)
+	m.as("cust")
+	for index := 1; index <= 3; index++ {
+		// fail a different write of the purchase each time
+		m.failPut = index
+		_, err := call(m, "invoke", "buyGoods", "points", "cust", "merch", "Cappuccino", "1", "x")
+		if err == nil {
+			t.Fatalf("write %d failed but buyGoods succeeded", index)
+		}
+		decodeError(t, "buyGoods write "+strconv.Itoa(index), err)
+	}
+	m.failPut = 0
+
+	m.timeErr = errors.New("no timestamp")
+	_, err := call(m, "invoke", "buyGoods", "points", "cust", "merch", "Cappuccino", "1", "x")
+	if err == nil {
+		t.Fatal("buyGoods succeeded without a timestamp")
+	}
+	decodeError(t, "buyGoods timestamp", err)
+}
@@ -0,0 +1,237 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// journalStep - one invoke of a flow, made by the enrollment ID, or by an
+// admin when the caller is admin
+type journalStep struct {
+	caller   string
+	function string
+	args     []string
+}
+
+// checkLedgerInvariants - fails the test unless every journal entry and the
+// trial balance balance, and the supply counters reconcile with the holdings.
+// The checks are made by an admin, so the caller has to be set again after.
+func checkLedgerInvariants(t *testing.T, m *mockStub, after string) {
+	t.Helper()
+	m.asAdmin("auditor")
+
+	for key, bytes := range m.state {
+		if !strings.HasPrefix(key, "Journal_") {
+			continue
+		}
+		var entry JournalEntry
+		err := json.Unmarshal(bytes, &entry)
+		if err != nil {
+			t.Fatalf("after %s: %s is not a journal entry: %v", after, key, err)
+		}
+		net := make(map[string]float64)
+		for _, posting := range entry.Postings {
+			net[posting.Asset] += posting.Credit - posting.Debit
+		}
+		for asset, amount := range net {
+			if math.Abs(amount) >= journalTolerance {
+				t.Fatalf("after %s: %s does not balance for %s by %v", after, key, asset, amount)
+			}
+		}
+	}
+
+	var trial TrialBalance
+	err := json.Unmarshal(mustCall(t, m, "query", "getTrialBalance", "detail"), &trial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !trial.Balanced {
+		t.Fatalf("after %s: trial balance does not balance: %+v", after, trial.Totals)
+	}
+	// each entity's sub-ledger carries its holdings
+	ledger := make(map[string]float64)
+	for _, line := range trial.Lines {
+		if line.Entity != "" {
+			ledger[line.Entity+"|"+line.Asset] += line.Balance
+		}
+	}
+	var keys []string
+	err = json.Unmarshal(m.state["Entities"], &keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		entity, err := new(LoyaltyChaincode).getEntity(m, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(ledger[key+"|points"]-float64(entity.Points)) >= journalTolerance || math.Abs(ledger[key+"|balance"]-entity.Balance) >= journalTolerance {
+			t.Fatalf("after %s: journal of %s shows %v points and %v balance, holdings are %+v", after, key, ledger[key+"|points"], ledger[key+"|balance"], entity)
+		}
+	}
+
+	var reconciliation Reconciliation
+	err = json.Unmarshal(mustCall(t, m, "query", "reconcile"), &reconciliation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reconciliation.Balanced {
+		t.Fatalf("after %s: supply does not reconcile: %+v", after, reconciliation)
+	}
+}
+
+// runJournalSteps - runs each step of a flow and checks the invariants after it
+func runJournalSteps(t *testing.T, m *mockStub, steps []journalStep) {
+	t.Helper()
+	for _, step := range steps {
+		if step.caller == "admin" {
+			m.asAdmin("admin1")
+		} else {
+			m.as(step.caller)
+		}
+		mustCall(t, m, "invoke", step.function, step.args...)
+		checkLedgerInvariants(t, m, step.function)
+	}
+}
+
+func TestJournalBalancesAfterEveryMovement(t *testing.T) {
+	m := newDemoLedger(t)
+	checkLedgerInvariants(t, m, "init")
+
+	runJournalSteps(t, m, []journalStep{
+		{"admin", "add", []string{"points", "cust", "100"}},
+		{"admin", "add", []string{"balance", "cust", "50"}},
+		{"admin", "adjustBalance", []string{"cust", "points", "-5", "CORRECTION", "typo"}},
+		{"admin", "putFeeRule", []string{"transfer", "", "percent", "1", "bank"}},
+		{"admin", "putFeeRule", []string{"encash", "", "fixed", "0.5", "bank"}},
+		{"cust", "transfer", []string{"cust", "merch", "balance", "33.33", "gift"}},
+		{"cust", "transfer", []string{"cust", "merch", "points", "10", "gift"}},
+		{"cust", "buyGoods", []string{"points", "cust", "merch", "Cappuccino", "2", "coffee"}},
+		{"cust", "buyGoods", []string{"balance", "cust", "merch", "Cappuccino", "1", "coffee"}},
+		{"merch", "bulkIssue", []string{"merch", "points", "c1", `[{"entity":"cust","amount":10}]`}},
+		{"merch", "issueGiftCard", []string{"merch", "gc1", giftCardHash("salt", "code"), "salt", "25", "30"}},
+	})
+
+	m.as("merch")
+	mustCall(t, m, "invoke", "encashMerchant", "merch", "bank", "100")
+	request := "Encash_" + m.GetTxID()
+	checkLedgerInvariants(t, m, "encashMerchant")
+	m.as("bank")
+	mustCall(t, m, "invoke", "approve", "bank", request, "50")
+	checkLedgerInvariants(t, m, "approve")
+
+	m.as("cust")
+	hold := string(mustCall(t, m, "invoke", "authorizeGoods", "points", "cust", "merch", "Cappuccino", "1", "10"))
+	checkLedgerInvariants(t, m, "authorizeGoods")
+	m.as("merch")
+	mustCall(t, m, "invoke", "captureGoods", hold)
+	checkLedgerInvariants(t, m, "captureGoods")
+}
+
+func TestJournalRejectsUnbalancedEntry(t *testing.T) {
+	m := newDemoLedger(t)
+	cc := new(LoyaltyChaincode)
+	m.tx++
+	// a credit to the customer with no matching debit
+	err := cc.post(m, accountCustomers, "cust", "points", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cc.closeJournal(m, "add", "")
+	expectError(t, codeInvalidState, nil, err)
+	if _, ok := m.state["Journal_"+m.GetTxID()]; ok {
+		t.Fatal("unbalanced entry recorded")
+	}
+
+	// a balancing account takes up the difference
+	err = cc.post(m, accountCustomers, "cust", "points", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cc.closeJournal(m, "add", accountIssuance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.state["Journal_"+m.GetTxID()]; !ok {
+		t.Fatal("balanced entry not recorded")
+	}
+}
+
+func TestJournalSelfTransferRejected(t *testing.T) {
+	m := newDemoLedger(t)
+	m.as("cust")
+	bytes, err := call(m, "invoke", "transfer", "cust", "cust", "points", "100", "self")
+	expectError(t, codeBadArgument, bytes, err)
+	bytes, err = call(m, "invoke", "transfer", "cust", "merch", "points", "100000000", "too much")
+	expectError(t, codeInsufficientPoints, bytes, err)
+	checkLedgerInvariants(t, m, "rejected transfers")
+}
+
+func TestReconcileReportsTamperedHoldings(t *testing.T) {
+	m := newDemoLedger(t)
+	entity, err := new(LoyaltyChaincode).getEntity(m, "cust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// points minted outside any invoke
+	entity.Points += 7
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.state["cust"] = bytes
+
+	var reconciliation Reconciliation
+	err = json.Unmarshal(mustCall(t, m, "query", "reconcile"), &reconciliation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconciliation.Balanced || reconciliation.PointsDiscrepancy != 7 {
+		t.Fatalf("tampering not reported: %+v", reconciliation)
+	}
+}
+
+func TestSalesReportTotalsPurchases(t *testing.T) {
+	m := newDemoLedger(t)
+	product, err := new(LoyaltyChaincode).getProduct(m, "Cappuccino")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.as("cust")
+	mustCall(t, m, "invoke", "buyGoods", "points", "cust", "merch", "Cappuccino", "2", "coffee")
+	mustCall(t, m, "invoke", "buyGoods", "balance", "cust", "merch", "Cappuccino", "1", "coffee")
+
+	var report []SalesLine
+	err = json.Unmarshal(mustCall(t, m, "query", "getMerchantSalesReport", "merch", "2023-01-01", "2023-12-31", "month"), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 1 {
+		t.Fatalf("expected one line, got %+v", report)
+	}
+	line := report[0]
+	if line.Product != "Cappuccino" || line.Units != 3 || line.Points != 2*product.Points {
+		t.Fatalf("report does not match the purchases: %+v", line)
+	}
+	if math.Abs(line.Currency-product.Amount) >= 0.005 {
+		t.Fatalf("report does not match the purchases: %+v", line)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// mockStub - in memory ledger standing in for the v0.6 shim. Each call runs as
+// its own transaction and a failed invoke leaves the state untouched, as a
+// rejected transaction would.
+type mockStub struct {
+	state map[string][]byte
+	tx    int
+	now   int64
+	attrs map[string]string // certificate attributes of the caller
+	// failures injected into the shim
+	failPut int // fails the nth PutState of each call, none when 0
+	puts    int
+	timeErr error // returned by GetTxTimestamp
+}
+
+// newMockStub - empty ledger called by an admin
+func newMockStub() *mockStub {
+	return &mockStub{
+		state: make(map[string][]byte),
+		now:   1700000000,
+		attrs: map[string]string{"role": "admin"},
+	}
+}
+
+// as - makes the caller the holder of an enrollment ID, without the admin role
+func (m *mockStub) as(enrollmentID string) {
+	delete(m.attrs, "role")
+	m.attrs["enrollmentId"] = enrollmentID
+}
+
+// asAdmin - makes the caller an admin with an enrollment ID
+func (m *mockStub) asAdmin(enrollmentID string) {
+	m.attrs["role"] = "admin"
+	m.attrs["enrollmentId"] = enrollmentID
+}
+
+func (m *mockStub) GetArgs() [][]byte       { return nil }
+func (m *mockStub) GetStringArgs() []string { return nil }
+
+func (m *mockStub) InvokeChaincode(chaincodeName string, args [][]byte) ([]byte, error) {
+	return nil, nil
+}
+
+// QueryChaincode - answers the AssetMgmt getEntity query with a user holding
+// the account "acct"
+func (m *mockStub) QueryChaincode(chaincodeName string, args [][]byte) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"userId": string(args[1]), "accounts": []string{"acct"}})
+}
+
+func (m *mockStub) GetState(key string) ([]byte, error) { return m.state[key], nil }
+
+func (m *mockStub) PutState(key string, value []byte) error {
+	m.puts++
+	if m.puts == m.failPut {
+		return errors.New("PutState failed for " + key)
+	}
+	m.state[key] = value
+	return nil
+}
+
+func (m *mockStub) DelState(key string) error {
+	delete(m.state, key)
+	return nil
+}
+
+func (m *mockStub) RangeQueryState(startKey, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	iter := &mockIterator{stub: m}
+	for key := range m.state {
+		if key >= startKey && key < endKey {
+			iter.keys = append(iter.keys, key)
+		}
+	}
+	sort.Strings(iter.keys)
+	return iter, nil
+}
+
+func (m *mockStub) GetCallerCertificate() ([]byte, error) { return nil, nil }
+func (m *mockStub) GetCallerMetadata() ([]byte, error)    { return nil, nil }
+func (m *mockStub) GetBinding() ([]byte, error)           { return nil, nil }
+func (m *mockStub) GetPayload() ([]byte, error)           { return nil, nil }
+func (m *mockStub) GetTxID() string                       { return "tx" + strconv.Itoa(m.tx) }
+
+func (m *mockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	if m.timeErr != nil {
+		return nil, m.timeErr
+	}
+	return &timestamp.Timestamp{Seconds: m.now}, nil
+}
+
+func (m *mockStub) SetEvent(name string, payload []byte) error { return nil }
+
+func (m *mockStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	value, ok := m.attrs[attributeName]
+	if !ok {
+		return nil, errors.New("No attribute " + attributeName)
+	}
+	return []byte(value), nil
+}
+
+func (m *mockStub) VerifyAttribute(attributeName string, attributeValue []byte) (bool, error) {
+	value, ok := m.attrs[attributeName]
+	return ok && value == string(attributeValue), nil
+}
+
+// mockIterator - range query over a snapshot of the keys
+type mockIterator struct {
+	stub *mockStub
+	keys []string
+}
+
+func (i *mockIterator) HasNext() bool { return len(i.keys) > 0 }
+
+func (i *mockIterator) Next() (string, []byte, error) {
+	key := i.keys[0]
+	i.keys = i.keys[1:]
+	return key, i.stub.state[key], nil
+}
+
+func (i *mockIterator) Close() error { return nil }
+
+// call - runs an init, invoke or query in a new transaction and rolls the state
+// back if it fails
+func call(m *mockStub, kind string, function string, args ...string) ([]byte, error) {
+	m.tx++
+	m.now++
+	m.puts = 0
+	snapshot := make(map[string][]byte, len(m.state))
+	for key, value := range m.state {
+		snapshot[key] = value
+	}
+
+	t := new(LoyaltyChaincode)
+	var bytes []byte
+	var err error
+	switch kind {
+	case "init":
+		bytes, err = t.Init(m, function, args)
+	case "query":
+		bytes, err = t.Query(m, function, args)
+	default:
+		bytes, err = t.Invoke(m, function, args)
+	}
+	if err != nil {
+		m.state = snapshot
+	}
+	return bytes, err
+}
+
+// mustCall - call that fails the test on an error
+func mustCall(tb testing.TB, m *mockStub, kind string, function string, args ...string) []byte {
+	tb.Helper()
+	bytes, err := call(m, kind, function, args...)
+	if err != nil {
+		tb.Fatalf("%s %s failed: %v", kind, function, err)
+	}
+	return bytes
+}
+
+// expectError - fails the test unless the call failed with the error code
+func expectError(tb testing.TB, code string, bytes []byte, err error) *ChaincodeError {
+	tb.Helper()
+	if err == nil {
+		tb.Fatalf("expected %s, got %s", code, bytes)
+	}
+	var ccErr ChaincodeError
+	if json.Unmarshal([]byte(err.Error()), &ccErr) != nil {
+		tb.Fatalf("expected %s, got an error that is not JSON: %v", code, err)
+	}
+	if ccErr.Code != code {
+		tb.Fatalf("expected %s, got %v", code, err)
+	}
+	return &ccErr
+}
+
+// newDemoLedger - ledger seeded by the deploy with the demo customer, merchant
+// and bank
+func newDemoLedger(tb testing.TB) *mockStub {
+	tb.Helper()
+	m := newMockStub()
+	mustCall(tb, m, "init", "init", "cust", "merch", "bank")
+	return m
+}
@@ -0,0 +1,178 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// validArgs - positional arguments that pass checkArgs for a function, with
+// the entity given for every entity argument
+func validArgs(spec FunctionSpec, entity string) []string {
+	args := make([]string, len(spec.Args))
+	for index, arg := range spec.Args {
+		switch {
+		case len(arg.Enum) > 0:
+			args[index] = arg.Enum[0]
+		case arg.Entity:
+			args[index] = entity
+		case arg.Type == "int" || arg.Type == "number":
+			args[index] = "1"
+		case arg.Type == "bool":
+			args[index] = "true"
+		case arg.Type == "flag":
+			args[index] = arg.Name
+		case arg.Type == "json":
+			args[index] = "[]"
+		default:
+			args[index] = "x"
+		}
+	}
+	return args
+}
+
+// callSpec - calls a function of the registry as an invoke or a query
+func callSpec(m *mockStub, spec FunctionSpec, args []string) ([]byte, error) {
+	return call(m, spec.Kind, spec.Name, args...)
+}
+
+func TestRegistryRolesAreKnown(t *testing.T) {
+	known := map[string]bool{"any": true, "admin": true, "organisation": true, "customer": true, "merchant": true, "bank": true}
+	for _, spec := range registry {
+		for _, role := range strings.Split(spec.Role, ",") {
+			if !known[role] {
+				t.Errorf("%s has unknown role %q", spec.Name, role)
+			}
+		}
+	}
+}
+
+func TestAdminFunctionsRejectOtherCallers(t *testing.T) {
+	m := newDemoLedger(t)
+	m.as("merch")
+	for _, spec := range registry {
+		if spec.Role != "admin" {
+			continue
+		}
+		bytes, err := callSpec(m, spec, validArgs(spec, "cust"))
+		expectError(t, codeNotAuthorized, bytes, err)
+	}
+}
+
+func TestEntityRoleFunctionsRejectOtherTypes(t *testing.T) {
+	m := newDemoLedger(t)
+	// a caller of each type that is never the one the function is for
+	other := map[string]string{"customer": "merch", "merchant": "bank", "bank": "cust"}
+	for _, spec := range registry {
+		caller, ok := other[spec.Role]
+		if !ok {
+			continue
+		}
+		m.as(caller)
+		bytes, err := callSpec(m, spec, validArgs(spec, caller))
+		ccErr := expectError(t, codeNotAuthorized, bytes, err)
+		if ccErr.Message != "Only a "+spec.Role+" can call "+spec.Name {
+			t.Errorf("%s: %v", spec.Name, err)
+		}
+	}
+}
+
+func TestRoleListAcceptsEachRole(t *testing.T) {
+	m := newDemoLedger(t)
+	m.as("cust")
+	bytes, err := call(m, "query", "getTopCustomers", "points")
+	ccErr := expectError(t, codeNotAuthorized, bytes, err)
+	if ccErr.Message != "Callers of getTopCustomers must be one of admin,merchant" {
+		t.Fatal(err)
+	}
+	m.as("merch")
+	mustCall(t, m, "query", "getTopCustomers", "points")
+	m.asAdmin("admin1")
+	mustCall(t, m, "query", "getTopCustomers", "points")
+}
+
+func TestCallerArgumentMustBeCaller(t *testing.T) {
+	m := newDemoLedger(t)
+	mustCall(t, m, "invoke", "write", "merchant", "merch2", "0", "0")
+
+	m.as("cust")
+	bytes, err := call(m, "invoke", "transfer", "merch", "cust", "points", "10", "x")
+	ccErr := expectError(t, codeNotAuthorized, bytes, err)
+	if ccErr.Field == "" || ccErr.Details != "merch" {
+		t.Fatalf("expected the offending argument, got %v", err)
+	}
+	// a merchant of the right type, but not the one named
+	m.as("merch2")
+	bytes, err = call(m, "invoke", "bulkIssue", "merch", "points", "c1", `[{"entity":"cust","amount":10}]`)
+	expectError(t, codeNotAuthorized, bytes, err)
+	m.as("merch")
+	bytes, err = call(m, "invoke", "buyGoods", "points", "cust", "merch", "Cappuccino", "1", "x")
+	expectError(t, codeNotAuthorized, bytes, err)
+
+	// a hold is captured by its merchant, and voided by its customer
+	m.as("cust")
+	hold := string(mustCall(t, m, "invoke", "authorizeGoods", "points", "cust", "merch", "Cappuccino", "1", "10"))
+	bytes, err = call(m, "invoke", "captureGoods", hold)
+	expectError(t, codeNotAuthorized, bytes, err)
+	m.as("merch2")
+	bytes, err = call(m, "invoke", "captureGoods", hold)
+	expectError(t, codeNotAuthorized, bytes, err)
+	m.as("cust")
+	mustCall(t, m, "invoke", "voidGoods", hold)
+}
+
+func TestCustomerRecordsVisibleToTheirOrganisations(t *testing.T) {
+	m := newDemoLedger(t)
+	mustCall(t, m, "invoke", "write", "merchant", "merch2", "0", "0")
+	m.as("merch")
+	customer := string(mustCall(t, m, "invoke", "registerCustomer", strings.Repeat("a", 64), "merch", "bank"))
+	mustCall(t, m, "invoke", "transfer", "merch", customer, "points", "500", "welcome")
+	m.as("cust")
+	mustCall(t, m, "invoke", "buyGoods", "balance", "cust", "merch", "Cappuccino", "1", "coffee")
+	receipt := m.GetTxID()
+
+	// merchants rank only their own customers
+	m.as("merch")
+	bytes := string(mustCall(t, m, "query", "getTopCustomers", "points"))
+	if !strings.Contains(bytes, customer) || strings.Contains(bytes, `"cust"`) {
+		t.Fatalf("merch sees %s", bytes)
+	}
+	m.as("merch2")
+	if bytes := string(mustCall(t, m, "query", "getTopCustomers", "points")); bytes != "[]" {
+		t.Fatalf("merch2 sees %s", bytes)
+	}
+	if bytes := string(mustCall(t, m, "query", "getAllTxnTransfer")); bytes != "null" {
+		t.Fatalf("merch2 sees %s", bytes)
+	}
+
+	// another customer cannot read the purchase
+	m.as(customer)
+	if bytes := string(mustCall(t, m, "query", "getAllTxnGoods")); bytes != "null" {
+		t.Fatalf("%s sees %s", customer, bytes)
+	}
+	bytes2, err := call(m, "query", "getReceipt", receipt)
+	expectError(t, codeNotAuthorized, bytes2, err)
+	bytes2, err = call(m, "query", "getJournalEntry", receipt)
+	expectError(t, codeNotAuthorized, bytes2, err)
+	bytes2, err = call(m, "query", "getTrialBalance", "detail")
+	expectError(t, codeNotAuthorized, bytes2, err)
+
+	m.as("cust")
+	mustCall(t, m, "query", "getReceipt", receipt)
+	mustCall(t, m, "query", "getJournalEntry", receipt)
+}
@@ -18,7 +18,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"strconv"
 	s "strings"
@@ -90,6 +89,67 @@ type TxnEncash struct {
 // 	Points   int     `json:"points"`
 // }
 
+//Genesis - starting data for Init: entities, products and rates
+type Genesis struct {
+	Entities []Entity           `json:"entities"`
+	Products []Product          `json:"products"`
+	Rates    map[string]float64 `json:"rates"` // encash - points per unit of balance
+}
+
+// Error codes returned in the code of a ChaincodeError. Clients match on these,
+// so existing codes must not be renamed.
+const (
+	codeBadArgument         = "BAD_ARGUMENT"
+	codeArgumentCount       = "ARGUMENT_COUNT"
+	codeUnknownFunction     = "UNKNOWN_FUNCTION"
+	codeEntityNotFound      = "ENTITY_NOT_FOUND"
+	codeNotFound            = "NOT_FOUND"
+	codeInsufficientPoints  = "INSUFFICIENT_POINTS"
+	codeInsufficientBalance = "INSUFFICIENT_BALANCE"
+	codeLedger              = "LEDGER_ERROR"
+	codeCorruptRecord       = "CORRUPT_RECORD"
+	codeInternal            = "INTERNAL_ERROR"
+)
+
+//ChaincodeError - machine readable error returned by every Invoke and Query function
+type ChaincodeError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"` // argument that caused the error
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"` // offending value or key
+}
+
+// Error - the error as JSON, which is what the client receives
+func (e *ChaincodeError) Error() string {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Code + ": " + e.Message
+	}
+	return string(bytes)
+}
+
+// newError - builds a ChaincodeError
+func newError(code string, field string, message string, details string) error {
+	return &ChaincodeError{Code: code, Field: field, Message: message, Details: details}
+}
+
+// argCountError - error for a call with the wrong number of arguments
+func argCountError(expecting string, function string) error {
+	return newError(codeArgumentCount, "args", "Incorrect number of arguments. Expecting "+expecting+" for "+function, "")
+}
+
+// toChaincodeError - passes a ChaincodeError through and wraps any other error,
+// such as one returned by the shim, as an internal error
+func toChaincodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ChaincodeError); ok {
+		return err
+	}
+	return newError(codeInternal, "", err.Error(), "")
+}
+
 // LoyaltyChaincode example simple Chaincode implementation
 type LoyaltyChaincode struct {
 }
@@ -104,76 +164,47 @@ func main() {
 // Init resets all the things
 func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
-	}
-
-	key1 := args[0] //customer
-	key2 := args[1] //merchant
-	key3 := args[2] //bank
-
-	cust := Entity{
-		Type:    "customer",
-		Name:    key1,
-		Balance: 3000,
-		Points:  3000,
-	}
-	fmt.Println(cust)
-	bytes, err := json.Marshal(cust)
-	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
-	}
-	fmt.Println(bytes)
-	err = stub.PutState(key1, bytes)
-	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
-	}
-
-	merch := Entity{
-		Type:    "merchant",
-		Name:    key2,
-		Balance: 6000,
-		Points:  6000,
-	}
-	fmt.Println(merch)
-	bytes, err = json.Marshal(merch)
-	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
-	}
-	fmt.Println(bytes)
-	err = stub.PutState(key2, bytes)
-	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
+	/*
+	   args[] - {customer, merchant, bank} to seed the demo data
+	            or {genesisJSON} to seed from a genesis document
+	*/
+	var genesis Genesis
+	if len(args) == 3 {
+		genesis = demoGenesis(args[0], args[1], args[2])
+	} else if len(args) == 1 {
+		err := json.Unmarshal([]byte(args[0]), &genesis)
+		if err != nil {
+			return nil, newError(codeBadArgument, "genesis", "Invalid genesis document", err.Error())
+		}
+		// Nothing is written unless the whole document is valid
+		err = validateGenesis(genesis)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, argCountError("3 or a genesis document", "init")
 	}
 
-	bank := Entity{
-		Type:    "bank",
-		Name:    key3,
-		Balance: 10000,
-		Points:  10000,
-	}
-	fmt.Println(bank)
-	bytes, err = json.Marshal(bank)
-	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
-	}
-	fmt.Println(bytes)
-	err = stub.PutState(key3, bytes)
-	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
+	for _, entity := range genesis.Entities {
+		fmt.Println(entity)
+		bytes, err := json.Marshal(entity)
+		if err != nil {
+			fmt.Println("Error marsalling")
+			return nil, newError(codeInternal, "", "Error marshalling", "")
+		}
+		fmt.Println(bytes)
+		err = stub.PutState(entity.Name, bytes)
+		if err != nil {
+			fmt.Println("Error writing state")
+			return nil, err
+		}
 	}
 
 	// Initialize the collection of  keys for products and various transactions
 	fmt.Println("Initializing keys collection")
 	var blank []string
 	blankBytes, _ := json.Marshal(&blank)
-	err = stub.PutState("Products", blankBytes)
+	err := stub.PutState("Products", blankBytes)
 	if err != nil {
 		fmt.Println("Failed to initialize Products key collection")
 	}
@@ -190,18 +221,28 @@ func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface, function strin
 		fmt.Println("Failed to initialize TxnEncash key collection")
 	}
 
+	err = t.putGenesisConfig(stub, genesis)
+	if err != nil {
+		return nil, err
+	}
+
 	fmt.Println("Initialization complete")
 
-	t.addProduct(stub, []string{"Speakers", "2000", "200", "AcmeMart", "100"})
-	t.addProduct(stub, []string{"Headphones", "3000", "300", "AcmeMart", "100"})
-	t.addProduct(stub, []string{"Mobile", "4000", "400", "AcmeMart", "100"})
-	t.addProduct(stub, []string{"BagPack", "1000", "100", "AcmeMart", "100"})
+	for _, product := range genesis.Products {
+		t.addProduct(stub, []string{product.Name, strconv.Itoa(product.Points), strconv.FormatFloat(product.Amount, 'f', -1, 64), product.Entity, strconv.Itoa(product.Qty)})
+	}
 
 	return nil, nil
 }
 
 // Invoke isur entry point to invoke a chaincode function
 func (t *LoyaltyChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	bytes, err := t.invoke(stub, function, args)
+	return bytes, toChaincodeError(err)
+}
+
+// invoke - dispatches an Invoke call to its function
+func (t *LoyaltyChaincode) invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
 
 	// Handle different functions/transactions
@@ -220,11 +261,17 @@ func (t *LoyaltyChaincode) Invoke(stub shim.ChaincodeStubInterface, function str
 	}
 	fmt.Println("invoke did not find func: " + function)
 
-	return nil, errors.New("Received unknown function invocation: " + function)
+	return nil, newError(codeUnknownFunction, "function", "Received unknown function invocation", function)
 }
 
 // Query is our entry point for queries
 func (t *LoyaltyChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	bytes, err := t.query(stub, function, args)
+	return bytes, toChaincodeError(err)
+}
+
+// query - dispatches a Query call to its function
+func (t *LoyaltyChaincode) query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("query is running " + function)
 
 	// Handle different functions
@@ -241,7 +288,7 @@ func (t *LoyaltyChaincode) Query(stub shim.ChaincodeStubInterface, function stri
 	}
 	fmt.Println("query did not find func: " + function)
 
-	return nil, errors.New("Received unknown function query: " + function)
+	return nil, newError(codeUnknownFunction, "function", "Received unknown function query", function)
 }
 
 // write - invoke function to write key/value pair
@@ -250,7 +297,7 @@ func (t *LoyaltyChaincode) write(stub shim.ChaincodeStubInterface, args []string
 	fmt.Println("running write()")
 
 	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. expecting 3")
+		return nil, argCountError("4", "write")
 	}
 
 	//writing a new customer to blockchain
@@ -268,7 +315,7 @@ func (t *LoyaltyChaincode) write(stub shim.ChaincodeStubInterface, args []string
 	bytes, err := json.Marshal(entity)
 	if err != nil {
 		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
+		return nil, newError(codeInternal, "", "Error marshalling", "")
 	}
 	fmt.Println(bytes)
 	err = stub.PutState(name, bytes)
@@ -285,7 +332,7 @@ func (t *LoyaltyChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 	fmt.Println("read() is running")
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. expecting 1")
+		return nil, argCountError("1", "read")
 	}
 
 	key := args[0] // name of Entity
@@ -293,18 +340,18 @@ func (t *LoyaltyChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 	bytes, err := stub.GetState(key)
 	if err != nil {
 		fmt.Println("Error retrieving " + key)
-		return nil, errors.New("Error retrieving " + key)
+		return nil, newError(codeLedger, "", "Error retrieving "+key, "")
 	}
 	customer := Entity{}
 	err = json.Unmarshal(bytes, &customer)
 	if err != nil {
 		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling customerBytes", "")
 	}
 	bytes, err = json.Marshal(customer)
 	if err != nil {
 		fmt.Println("Error marshaling customer")
-		return nil, errors.New("Error marshaling customer")
+		return nil, newError(codeInternal, "", "Error marshaling customer", "")
 	}
 
 	fmt.Println(bytes)
@@ -316,7 +363,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 	fmt.Println("buyGoods is running ")
 
 	if len(args) != 6 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 6 for buy goods")
+		return nil, argCountError("6", "buyGoods")
 	}
 	asset := args[0] //points or balance
 	key1 := args[1]  //Entity1 ex: customer
@@ -326,40 +373,40 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 
 	bytes, err := stub.GetState(key1)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key1)
+		return nil, newError(codeLedger, "", "Failed to get state of "+key1, "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeEntityNotFound, "", "Entity not found", key1)
 	}
 	customer := Entity{}
 	err = json.Unmarshal(bytes, &customer)
 	if err != nil {
 		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling customerBytes", "")
 	}
 
 	bytes, err = stub.GetState(key2)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key2)
+		return nil, newError(codeLedger, "", "Failed to get state of "+key2, "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeEntityNotFound, "", "Entity not found", key2)
 	}
 	merchant := Entity{}
 	err = json.Unmarshal(bytes, &merchant)
 	if err != nil {
 		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling customerBytes", "")
 	}
 	bytes, err = stub.GetState(key3)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key2)
+		return nil, newError(codeLedger, "", "Failed to get state of "+key3, "")
 	}
 	product := Product{}
 	err = json.Unmarshal(bytes, &product)
 	if err != nil {
 		fmt.Println("Error Unmarshaling product bytes")
-		return nil, errors.New("Error Unmarshaling product Bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling product Bytes", "")
 	}
 	if product.Entity == merchant.Name && product.Qty >= qty {
 		// Perform the transfer
@@ -373,7 +420,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 				args[4] = strconv.Itoa(product.Points * qty)
 				fmt.Printf("customer Points = %d, merchant Points = %d\n", customer.Points, merchant.Points)
 			} else {
-				return nil, errors.New("Insufficient points to buy goods")
+				return nil, newError(codeInsufficientPoints, "", "Insufficient points to buy goods", "")
 			}
 		} else {
 			fmt.Println("balance to be added")
@@ -385,7 +432,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 				args[4] = strconv.FormatFloat(product.Amount*float64(qty), 'f', -1, 64)
 				fmt.Printf("customer Balance = %f, merchant Balance = %f\n", customer.Balance, merchant.Balance)
 			} else {
-				return nil, errors.New("Insufficient balance to buy goods")
+				return nil, newError(codeInsufficientBalance, "", "Insufficient balance to buy goods", "")
 			}
 		}
 		//product.Entity = customer.Name
@@ -393,7 +440,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 		bytes, err = json.Marshal(customer)
 		if err != nil {
 			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+			return nil, newError(codeInternal, "", "Error marshaling customer", "")
 		}
 		err = stub.PutState(key1, bytes)
 		if err != nil {
@@ -404,7 +451,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 		bytes, err = json.Marshal(merchant)
 		if err != nil {
 			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+			return nil, newError(codeInternal, "", "Error marshaling customer", "")
 		}
 		err = stub.PutState(key2, bytes)
 		if err != nil {
@@ -414,7 +461,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 		bytes, err = json.Marshal(product)
 		if err != nil {
 			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+			return nil, newError(codeInternal, "", "Error marshaling customer", "")
 		}
 		err = stub.PutState(key3, bytes)
 		if err != nil {
@@ -438,7 +485,7 @@ func (t *LoyaltyChaincode) add(stub shim.ChaincodeStubInterface, args []string)
 	fmt.Println("add is running ")
 
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 3 for add")
+		return nil, argCountError("3", "add")
 	}
 
 	asset := args[0] //points or balance
@@ -448,14 +495,14 @@ func (t *LoyaltyChaincode) add(stub shim.ChaincodeStubInterface, args []string)
 	// GET the state of entity from the ledger
 	bytes, err := stub.GetState(key)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key)
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
 	}
 
 	entity := Entity{}
 	err = json.Unmarshal(bytes, &entity)
 	if err != nil {
 		fmt.Println("Error Unmarshaling entity Bytes")
-		return nil, errors.New("Error Unmarshaling entity Bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", "")
 	}
 
 	// Perform the addition of assests
@@ -477,7 +524,7 @@ func (t *LoyaltyChaincode) add(stub shim.ChaincodeStubInterface, args []string)
 	bytes, err = json.Marshal(entity)
 	if err != nil {
 		fmt.Println("Error marshaling entity")
-		return nil, errors.New("Error marshaling entity")
+		return nil, newError(codeInternal, "", "Error marshaling entity", "")
 	}
 	err = stub.PutState(key, bytes)
 	if err != nil {
@@ -544,7 +591,7 @@ func (t *LoyaltyChaincode) encashMerchant(stub shim.ChaincodeStubInterface, args
 	fmt.Println("encashMerchant is running ")
 
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 3 for encashMerchant")
+		return nil, argCountError("3", "encashMerchant")
 	}
 
 	points, err := strconv.Atoi(args[2])
@@ -559,7 +606,7 @@ func (t *LoyaltyChaincode) encashMerchant(stub shim.ChaincodeStubInterface, args
 		Initiator: args[0],
 		Bank:      args[1],
 		Points:    points,
-		Amount:    points / 100,
+		Amount:    int(float64(points) / t.getRate(stub, "encash")),
 		Remarks:   "New Request for Encashment",
 		Time:      blockTime.String(),
 	}
@@ -567,7 +614,7 @@ func (t *LoyaltyChaincode) encashMerchant(stub shim.ChaincodeStubInterface, args
 	bytes, err := json.Marshal(txn)
 	if err != nil {
 		fmt.Println("Error marshaling encashMerchant")
-		return nil, errors.New("Error marshaling encashMerchant")
+		return nil, newError(codeInternal, "", "Error marshaling encashMerchant", "")
 	}
 
 	err = stub.PutState(key, bytes)
@@ -583,49 +630,49 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 	fmt.Println("approve is running ")
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 1 for approve")
+		return nil, argCountError("1", "approve")
 	}
 
 	bytes, err := stub.GetState(args[0])
 	if err != nil {
-		return nil, errors.New("Failed to get state of encash key")
+		return nil, newError(codeLedger, "", "Failed to get state of encash key", "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeNotFound, "encashKey", "Encash request not found", args[0])
 	}
 	txn := TxnEncash{}
 	err = json.Unmarshal(bytes, &txn)
 	if err != nil {
 		fmt.Println("Error Unmarshaling TxnEncash")
-		return nil, errors.New("Error Unmarshaling TxnEncash")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling TxnEncash", "")
 	}
 
 	bytes, err = stub.GetState(txn.Initiator)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + txn.Initiator)
+		return nil, newError(codeLedger, "", "Failed to get state of "+txn.Initiator, "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeEntityNotFound, "", "Entity not found", txn.Initiator)
 	}
 	merchant := Entity{}
 	err = json.Unmarshal(bytes, &merchant)
 	if err != nil {
 		fmt.Println("Error Unmarshaling merchant encash")
-		return nil, errors.New("Error Unmarshaling encash merchant")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling encash merchant", "")
 	}
 
 	bytes, err = stub.GetState(txn.Bank)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + txn.Bank)
+		return nil, newError(codeLedger, "", "Failed to get state of "+txn.Bank, "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeEntityNotFound, "", "Entity not found", txn.Bank)
 	}
 	bank := Entity{}
 	err = json.Unmarshal(bytes, &bank)
 	if err != nil {
 		fmt.Println("Error Unmarshaling bank encash")
-		return nil, errors.New("Error Unmarshaling encash bank")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling encash bank", "")
 	}
 
 	// Perform encashment
@@ -638,7 +685,7 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 	bytes, err = json.Marshal(merchant)
 	if err != nil {
 		fmt.Println("Error marshaling merchant")
-		return nil, errors.New("Error marshaling merchant")
+		return nil, newError(codeInternal, "", "Error marshaling merchant", "")
 	}
 	err = stub.PutState(txn.Initiator, bytes)
 	if err != nil {
@@ -649,7 +696,7 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 	bytes, err = json.Marshal(bank)
 	if err != nil {
 		fmt.Println("Error marshaling bank")
-		return nil, errors.New("Error marshaling bank")
+		return nil, newError(codeInternal, "", "Error marshaling bank", "")
 	}
 	err = stub.PutState(txn.Bank, bytes)
 	if err != nil {
@@ -664,7 +711,7 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 	bytes, err = json.Marshal(txn)
 	if err != nil {
 		fmt.Println("Error marshaling TxnGoods")
-		return nil, errors.New("Error marshaling TxnGoods")
+		return nil, newError(codeInternal, "", "Error marshaling TxnGoods", "")
 	}
 	err = stub.PutState(txn.Key, bytes)
 	if err != nil {
@@ -677,7 +724,7 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 func (t *LoyaltyChaincode) addProduct(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("adding product information")
 	if len(args) != 5 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 5 for addProduct")
+		return nil, argCountError("5", "addProduct")
 	}
 	amt, err := strconv.ParseFloat(args[2], 64)
 	points, err := strconv.Atoi(args[1])
@@ -694,7 +741,7 @@ func (t *LoyaltyChaincode) addProduct(stub shim.ChaincodeStubInterface, args []s
 	bytes, err := json.Marshal(product)
 	if err != nil {
 		fmt.Println("Error marshaling product")
-		return nil, errors.New("Error marshaling product")
+		return nil, newError(codeInternal, "", "Error marshaling product", "")
 	}
 
 	err = stub.PutState(product.Name, bytes)
@@ -715,7 +762,7 @@ func (t *LoyaltyChaincode) addProduct(stub shim.ChaincodeStubInterface, args []s
 	bytes, err = json.Marshal(keys)
 	if err != nil {
 		fmt.Println("Error marshaling product keys")
-		return nil, errors.New("Error marshaling product keys")
+		return nil, newError(codeInternal, "", "Error marshaling product keys", "")
 	}
 	err = stub.PutState("Products", bytes)
 	if err != nil {
@@ -735,13 +782,13 @@ func (t *LoyaltyChaincode) getAllProducts(stub shim.ChaincodeStubInterface) ([]b
 	keysBytes, err := stub.GetState("Products")
 	if err != nil {
 		fmt.Println("Error retrieving Products")
-		return nil, errors.New("Error retrieving Products")
+		return nil, newError(codeLedger, "", "Error retrieving Products", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
 		fmt.Println("Error unmarshalling Products")
-		return nil, errors.New("Error unmarshalling Products")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling Products", "")
 	}
 
 	// Get each product from "Products" keys
@@ -752,7 +799,7 @@ func (t *LoyaltyChaincode) getAllProducts(stub shim.ChaincodeStubInterface) ([]b
 		err = json.Unmarshal(bytes, &product)
 		if err != nil {
 			fmt.Println("Error retrieving product " + value)
-			return nil, errors.New("Error retrieving product " + value)
+			return nil, newError(codeLedger, "", "Error retrieving product "+value, "")
 		}
 
 		fmt.Println("Appending product " + value)
@@ -762,7 +809,7 @@ func (t *LoyaltyChaincode) getAllProducts(stub shim.ChaincodeStubInterface) ([]b
 	bytes, err := json.Marshal(products)
 	if err != nil {
 		fmt.Println("Error marshaling product")
-		return nil, errors.New("Error marshaling product")
+		return nil, newError(codeInternal, "", "Error marshaling product", "")
 	}
 	return bytes, nil
 }
@@ -771,7 +818,7 @@ func (t *LoyaltyChaincode) putTxnTopup(stub shim.ChaincodeStubInterface, args []
 	fmt.Println("putTxnTopup is running ")
 
 	if len(args) != 5 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 5 for putTxnTopup")
+		return nil, argCountError("5", "putTxnTopup")
 	}
 	txn := TxnTopup{
 		Initiator: args[1],
@@ -785,7 +832,7 @@ func (t *LoyaltyChaincode) putTxnTopup(stub shim.ChaincodeStubInterface, args []
 	bytes, err := json.Marshal(txn)
 	if err != nil {
 		fmt.Println("Error marshaling TxnTopup")
-		return nil, errors.New("Error marshaling TxnTopup")
+		return nil, newError(codeInternal, "", "Error marshaling TxnTopup", "")
 	}
 
 	err = stub.PutState(txn.ID, bytes)
@@ -805,13 +852,13 @@ func (t *LoyaltyChaincode) getAllTxnTopup(stub shim.ChaincodeStubInterface) ([]b
 	keysBytes, err := stub.GetState("TxnTopup")
 	if err != nil {
 		fmt.Println("Error retrieving TxnTopup keys")
-		return nil, errors.New("Error retrieving TxnTopup keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnTopup keys", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
 		fmt.Println("Error unmarshalling TxnTopup key")
-		return nil, errors.New("Error unmarshalling TxnTopup keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnTopup keys", "")
 	}
 
 	// Get each product txn "TxnTopup" keys
@@ -822,7 +869,7 @@ func (t *LoyaltyChaincode) getAllTxnTopup(stub shim.ChaincodeStubInterface) ([]b
 		err = json.Unmarshal(bytes, &txn)
 		if err != nil {
 			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
 		}
 
 		fmt.Println("Appending txn" + value)
@@ -832,7 +879,7 @@ func (t *LoyaltyChaincode) getAllTxnTopup(stub shim.ChaincodeStubInterface) ([]b
 	bytes, err := json.Marshal(txns)
 	if err != nil {
 		fmt.Println("Error marshaling txns topup")
-		return nil, errors.New("Error marshaling txns topup")
+		return nil, newError(codeInternal, "", "Error marshaling txns topup", "")
 	}
 	return bytes, nil
 }
@@ -841,7 +888,7 @@ func (t *LoyaltyChaincode) putTxnGoods(stub shim.ChaincodeStubInterface, args []
 	fmt.Println("putTxnGoods is running ")
 
 	if len(args) != 8 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 8 for putTxnGoods")
+		return nil, argCountError("8", "putTxnGoods")
 	}
 	txn := TxnGoods{
 		Sender:   args[1],
@@ -856,7 +903,7 @@ func (t *LoyaltyChaincode) putTxnGoods(stub shim.ChaincodeStubInterface, args []
 	bytes, err := json.Marshal(txn)
 	if err != nil {
 		fmt.Println("Error marshaling TxnGoods")
-		return nil, errors.New("Error marshaling TxnGoods")
+		return nil, newError(codeInternal, "", "Error marshaling TxnGoods", "")
 	}
 
 	err = stub.PutState(txn.ID, bytes)
@@ -876,13 +923,13 @@ func (t *LoyaltyChaincode) getAllTxnGoods(stub shim.ChaincodeStubInterface) ([]b
 	keysBytes, err := stub.GetState("TxnGoods")
 	if err != nil {
 		fmt.Println("Error retrieving TxnGoods keys")
-		return nil, errors.New("Error retrieving TxnGoods keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnGoods keys", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
 		fmt.Println("Error unmarshalling TxnGoods key")
-		return nil, errors.New("Error unmarshalling TxnGoods keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnGoods keys", "")
 	}
 
 	// Get each txn from "TxnGoods" keys
@@ -893,7 +940,7 @@ func (t *LoyaltyChaincode) getAllTxnGoods(stub shim.ChaincodeStubInterface) ([]b
 		err = json.Unmarshal(bytes, &txn)
 		if err != nil {
 			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
 		}
 
 		fmt.Println("Appending txn goods details " + value)
@@ -903,7 +950,7 @@ func (t *LoyaltyChaincode) getAllTxnGoods(stub shim.ChaincodeStubInterface) ([]b
 	bytes, err := json.Marshal(txns)
 	if err != nil {
 		fmt.Println("Error marshaling txns TxnGoods")
-		return nil, errors.New("Error marshaling txns TxnGoods")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnGoods", "")
 	}
 	return bytes, nil
 }
@@ -917,13 +964,13 @@ func (t *LoyaltyChaincode) getAllTxnEncash(stub shim.ChaincodeStubInterface) ([]
 	keysBytes, err := stub.GetState("TxnEncash")
 	if err != nil {
 		fmt.Println("Error retrieving TxnEncash keys")
-		return nil, errors.New("Error retrieving TxnEncash keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnEncash keys", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
 		fmt.Println("Error unmarshalling TxnEncash key")
-		return nil, errors.New("Error unmarshalling TxnEncash keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnEncash keys", "")
 	}
 
 	// Get each txn from "TxnGoods" keys
@@ -934,7 +981,7 @@ func (t *LoyaltyChaincode) getAllTxnEncash(stub shim.ChaincodeStubInterface) ([]
 		err = json.Unmarshal(bytes, &txn)
 		if err != nil {
 			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
 		}
 
 		fmt.Println("Appending txn encash details " + value)
@@ -944,7 +991,7 @@ func (t *LoyaltyChaincode) getAllTxnEncash(stub shim.ChaincodeStubInterface) ([]
 	bytes, err := json.Marshal(txns)
 	if err != nil {
 		fmt.Println("Error marshaling txns TxnEncash")
-		return nil, errors.New("Error marshaling txns TxnEncash")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnEncash", "")
 	}
 	return bytes, nil
 }
@@ -964,7 +1011,7 @@ func (t *LoyaltyChaincode) appendKey(stub shim.ChaincodeStubInterface, primeKey
 	bytes, err = json.Marshal(keys)
 	if err != nil {
 		fmt.Println("Error marshaling " + primeKey)
-		return nil, errors.New("Error marshaling keys" + primeKey)
+		return nil, newError(codeInternal, "", "Error marshaling keys"+primeKey, "")
 	}
 	err = stub.PutState(primeKey, bytes)
 	if err != nil {
@@ -972,3 +1019,103 @@ func (t *LoyaltyChaincode) appendKey(stub shim.ChaincodeStubInterface, primeKey
 	}
 	return nil, nil
 }
+
+// demoGenesis - the demo customer, merchant, bank and products
+func demoGenesis(customer string, merchant string, bank string) Genesis {
+	return Genesis{
+		Entities: []Entity{
+			{Type: "customer", Name: customer, Balance: 3000, Points: 3000},
+			{Type: "merchant", Name: merchant, Balance: 6000, Points: 6000},
+			{Type: "bank", Name: bank, Balance: 10000, Points: 10000},
+		},
+		Products: []Product{
+			{Name: "Speakers", Points: 2000, Amount: 200, Entity: "AcmeMart", Qty: 100},
+			{Name: "Headphones", Points: 3000, Amount: 300, Entity: "AcmeMart", Qty: 100},
+			{Name: "Mobile", Points: 4000, Amount: 400, Entity: "AcmeMart", Qty: 100},
+			{Name: "BagPack", Points: 1000, Amount: 100, Entity: "AcmeMart", Qty: 100},
+		},
+		Rates: map[string]float64{"encash": 100},
+	}
+}
+
+// validateGenesis - checks a genesis document before Init writes any of it
+func validateGenesis(genesis Genesis) error {
+	if len(genesis.Entities) == 0 {
+		return newError(codeBadArgument, "entities", "Genesis document has no entities", "")
+	}
+
+	types := make(map[string]string)
+	for _, entity := range genesis.Entities {
+		if entity.Name == "" {
+			return newError(codeBadArgument, "entities", "Genesis entity without a name", "")
+		}
+		if _, ok := types[entity.Name]; ok {
+			return newError(codeBadArgument, "entities", "Duplicate genesis entity", entity.Name)
+		}
+		if entity.Type != "customer" && entity.Type != "merchant" && entity.Type != "bank" {
+			return newError(codeBadArgument, "entities", "Unknown type "+entity.Type+" for genesis entity", entity.Name)
+		}
+		if entity.Balance < 0 || entity.Points < 0 {
+			return newError(codeBadArgument, "entities", "Negative points or balance for genesis entity", entity.Name)
+		}
+		types[entity.Name] = entity.Type
+	}
+
+	products := make(map[string]bool)
+	for _, product := range genesis.Products {
+		if product.Name == "" {
+			return newError(codeBadArgument, "products", "Genesis product without a name", "")
+		}
+		if products[product.Name] {
+			return newError(codeBadArgument, "products", "Duplicate genesis product", product.Name)
+		}
+		if _, ok := types[product.Name]; ok {
+			return newError(codeBadArgument, "products", "Genesis product has the name of an entity", product.Name)
+		}
+		if types[product.Entity] != "merchant" {
+			return newError(codeBadArgument, "products", "Genesis product is not sold by a genesis merchant", product.Name)
+		}
+		if product.Points < 0 || product.Amount < 0 || product.Qty < 0 {
+			return newError(codeBadArgument, "products", "Invalid price or quantity for genesis product", product.Name)
+		}
+		products[product.Name] = true
+	}
+
+	for name, rate := range genesis.Rates {
+		if name != "encash" {
+			return newError(codeBadArgument, "rates", "Unknown genesis rate", name)
+		}
+		if rate <= 0 {
+			return newError(codeBadArgument, "rates", "Genesis rate must be positive", name)
+		}
+	}
+	return nil
+}
+
+// putGenesisConfig - writes the rates of a genesis document
+func (t *LoyaltyChaincode) putGenesisConfig(stub shim.ChaincodeStubInterface, genesis Genesis) error {
+	rates := map[string]float64{"encash": 100}
+	for name, rate := range genesis.Rates {
+		rates[name] = rate
+	}
+	bytes, err := json.Marshal(rates)
+	if err != nil {
+		fmt.Println("Error marshaling rates")
+		return newError(codeInternal, "", "Error marshaling rates", "")
+	}
+	return stub.PutState("Rates", bytes)
+}
+
+// getRate - reads a rate set at Init, 100 points per unit when it is missing
+func (t *LoyaltyChaincode) getRate(stub shim.ChaincodeStubInterface, name string) float64 {
+	bytes, err := stub.GetState("Rates")
+	if err != nil || bytes == nil {
+		return 100
+	}
+	rates := make(map[string]float64)
+	err = json.Unmarshal(bytes, &rates)
+	if err != nil || rates[name] <= 0 {
+		return 100
+	}
+	return rates[name]
+}
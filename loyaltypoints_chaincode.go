@@ -18,7 +18,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"strconv"
 	s "strings"
@@ -78,6 +77,85 @@ type TxnEncash struct {
 	Time      string `json:"time"`
 }
 
+//TxnAdjustment - audited admin correction of an entity's points or balance
+type TxnAdjustment struct {
+	ID         string `json:"id"`
+	Entity     string `json:"entity"`
+	Asset      string `json:"asset"`
+	Delta      string `json:"delta"`
+	ReasonCode string `json:"reasonCode"`
+	Note       string `json:"note"`
+	Approver   string `json:"approver"`
+	Time       string `json:"time"`
+}
+
+// adjustmentReasons - reason codes accepted by adjustBalance
+var adjustmentReasons = []string{"CORRECTION", "GOODWILL", "CHARGEBACK", "FRAUD", "MIGRATION"}
+
+//Genesis - starting data for Init: entities, products, rates and admin identities
+type Genesis struct {
+	Entities []Entity           `json:"entities"`
+	Products []Product          `json:"products"`
+	Rates    map[string]float64 `json:"rates"`  // encash - points per unit of balance
+	Admins   []string           `json:"admins"` // enrollment IDs allowed to administer
+}
+
+// Error codes returned in the code of a ChaincodeError. Clients match on these,
+// so existing codes must not be renamed.
+const (
+	codeBadArgument         = "BAD_ARGUMENT"
+	codeArgumentCount       = "ARGUMENT_COUNT"
+	codeUnknownFunction     = "UNKNOWN_FUNCTION"
+	codeEntityNotFound      = "ENTITY_NOT_FOUND"
+	codeNotFound            = "NOT_FOUND"
+	codeInsufficientPoints  = "INSUFFICIENT_POINTS"
+	codeInsufficientBalance = "INSUFFICIENT_BALANCE"
+	codeNotAuthorized       = "NOT_AUTHORIZED"
+	codeDuplicate           = "DUPLICATE"
+	codeLedger              = "LEDGER_ERROR"
+	codeCorruptRecord       = "CORRUPT_RECORD"
+	codeInternal            = "INTERNAL_ERROR"
+)
+
+//ChaincodeError - machine readable error returned by every Invoke and Query function
+type ChaincodeError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"` // argument that caused the error
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"` // offending value or key
+}
+
+// Error - the error as JSON, which is what the client receives
+func (e *ChaincodeError) Error() string {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Code + ": " + e.Message
+	}
+	return string(bytes)
+}
+
+// newError - builds a ChaincodeError
+func newError(code string, field string, message string, details string) error {
+	return &ChaincodeError{Code: code, Field: field, Message: message, Details: details}
+}
+
+// argCountError - error for a call with the wrong number of arguments
+func argCountError(expecting string, function string) error {
+	return newError(codeArgumentCount, "args", "Incorrect number of arguments. Expecting "+expecting+" for "+function, "")
+}
+
+// toChaincodeError - passes a ChaincodeError through and wraps any other error,
+// such as one returned by the shim, as an internal error
+func toChaincodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ChaincodeError); ok {
+		return err
+	}
+	return newError(codeInternal, "", err.Error(), "")
+}
+
 //LoyaltyChaincode  - struct consisting of all the chaincode funcs
 type LoyaltyChaincode struct {
 }
@@ -91,77 +169,60 @@ func main() {
 
 // Init resets all the things
 func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return t.initLedger(stub, args, true)
+}
 
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
-	}
-
-	key1 := args[0] //customer
-	key2 := args[1] //merchant
-	key3 := args[2] //bank
-
-	cust := Entity{
-		Type:    "customer",
-		Name:    key1,
-		Balance: 3000,
-		Points:  3000,
-	}
-	fmt.Println(cust)
-	bytes, err := json.Marshal(cust)
-	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
-	}
-	fmt.Println(bytes)
-	err = stub.PutState(key1, bytes)
-	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
-	}
-
-	merch := Entity{
-		Type:    "merchant",
-		Name:    key2,
-		Balance: 6000,
-		Points:  6000,
-	}
-	fmt.Println(merch)
-	bytes, err = json.Marshal(merch)
-	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
-	}
-	fmt.Println(bytes)
-	err = stub.PutState(key2, bytes)
-	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
+// initLedger - seeds the ledger at deploy, or reseeds it for an admin through
+// the init invoke. Only the deploy sets the rates and admins.
+func (t *LoyaltyChaincode) initLedger(stub shim.ChaincodeStubInterface, args []string, deploy bool) ([]byte, error) {
+
+	/*
+	   args[] - {customer, merchant, bank} to seed the demo data
+	            or {genesisJSON} to seed from a genesis document
+	*/
+	if !deploy && !t.isAdmin(stub) {
+		return nil, newError(codeNotAuthorized, "", "Only an admin can reseed the ledger", "")
+	}
+	var genesis Genesis
+	if len(args) == 3 {
+		genesis = demoGenesis(args[0], args[1], args[2])
+	} else if len(args) == 1 {
+		err := json.Unmarshal([]byte(args[0]), &genesis)
+		if err != nil {
+			return nil, newError(codeBadArgument, "genesis", "Invalid genesis document", err.Error())
+		}
+		if !deploy && (genesis.Admins != nil || genesis.Rates != nil) {
+			return nil, newError(codeBadArgument, "genesis", "Admins and rates can only be set when the chaincode is deployed", "")
+		}
+		// Nothing is written unless the whole document is valid
+		err = validateGenesis(genesis)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, argCountError("3 or a genesis document", "init")
 	}
 
-	bank := Entity{
-		Type:    "bank",
-		Name:    key3,
-		Balance: 10000,
-		Points:  10000,
-	}
-	fmt.Println(bank)
-	bytes, err = json.Marshal(bank)
-	if err != nil {
-		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
-	}
-	fmt.Println(bytes)
-	err = stub.PutState(key3, bytes)
-	if err != nil {
-		fmt.Println("Error writing state")
-		return nil, err
+	for _, entity := range genesis.Entities {
+		fmt.Println(entity)
+		bytes, err := json.Marshal(entity)
+		if err != nil {
+			fmt.Println("Error marsalling")
+			return nil, newError(codeInternal, "", "Error marshalling", "")
+		}
+		fmt.Println(bytes)
+		err = stub.PutState(entity.Name, bytes)
+		if err != nil {
+			fmt.Println("Error writing state")
+			return nil, err
+		}
 	}
 
 	// Initialize the collection of  keys for products and various transactions
 	fmt.Println("Initializing keys collection")
 	var blank []string
 	blankBytes, _ := json.Marshal(&blank)
-	err = stub.PutState("Products", blankBytes)
+	err := stub.PutState("Products", blankBytes)
 	if err != nil {
 		fmt.Println("Failed to initialize Products key collection")
 	}
@@ -177,24 +238,40 @@ func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface, function strin
 	if err != nil {
 		fmt.Println("Failed to initialize TxnEncash key collection")
 	}
+	err = stub.PutState("TxnAdjustment", blankBytes)
+	if err != nil {
+		fmt.Println("Failed to initialize TxnAdjustment key collection")
+	}
+
+	if deploy {
+		err = t.putGenesisConfig(stub, genesis)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	fmt.Println("Initialization complete")
 
-	t.addProduct(stub, []string{"Speakers", "2000", "200", key2, "100"})
-	t.addProduct(stub, []string{"Headphones", "3000", "300",  key2, "100"})
-	t.addProduct(stub, []string{"Mobile", "4000", "400", key2, "100"})
-	t.addProduct(stub, []string{"BagPack", "1000", "100", key2, "100"})
+	for _, product := range genesis.Products {
+		t.addProduct(stub, []string{product.Name, strconv.Itoa(product.Points), strconv.FormatFloat(product.Amount, 'f', -1, 64), product.Entity, strconv.Itoa(product.Qty)})
+	}
 
 	return nil, nil
 }
 
 // Invoke isur entry point to invoke a chaincode function
 func (t *LoyaltyChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	bytes, err := t.invoke(stub, function, args)
+	return bytes, toChaincodeError(err)
+}
+
+// invoke - dispatches an Invoke call to its function
+func (t *LoyaltyChaincode) invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
 
 	// Handle different functions/transactions
 	if function == "init" {
-		return t.Init(stub, "init", args)
+		return t.initLedger(stub, args, false)
 	} else if function == "write" {
 		return t.write(stub, args)
 	} else if function == "buyGoods" {
@@ -205,14 +282,22 @@ func (t *LoyaltyChaincode) Invoke(stub shim.ChaincodeStubInterface, function str
 		return t.encashMerchant(stub, args)
 	} else if function == "approve" {
 		return t.approve(stub, args)
+	} else if function == "adjustBalance" {
+		return t.adjustBalance(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)
 
-	return nil, errors.New("Received unknown function invocation: " + function)
+	return nil, newError(codeUnknownFunction, "function", "Received unknown function invocation", function)
 }
 
 // Query is our entry point for queries
 func (t *LoyaltyChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	bytes, err := t.query(stub, function, args)
+	return bytes, toChaincodeError(err)
+}
+
+// query - dispatches a Query call to its function
+func (t *LoyaltyChaincode) query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("query is running " + function)
 
 	// Handle different functions
@@ -226,19 +311,25 @@ func (t *LoyaltyChaincode) Query(stub shim.ChaincodeStubInterface, function stri
 		return t.getAllTxnGoods(stub)
 	} else if function == "getAllTxnEncash" {
 		return t.getAllTxnEncash(stub)
+	} else if function == "getAllTxnAdjustment" {
+		return t.getAllTxnAdjustment(stub)
 	}
 	fmt.Println("query did not find func: " + function)
 
-	return nil, errors.New("Received unknown function query: " + function)
+	return nil, newError(codeUnknownFunction, "function", "Received unknown function query", function)
 }
 
-// write - invoke function to write key/value pair
+// write - admin invoke function creating an entity with its opening points and balance.
+// Use adjustBalance to correct the points or balance of an existing entity.
 func (t *LoyaltyChaincode) write(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	fmt.Println("running write()")
 
 	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. expecting 4")
+		return nil, argCountError("4", "write")
+	}
+	if !t.isAdmin(stub) {
+		return nil, newError(codeNotAuthorized, "", "Only an admin can create entities", "")
 	}
 
 	//writing a new customer to blockchain
@@ -253,10 +344,20 @@ func (t *LoyaltyChaincode) write(stub shim.ChaincodeStubInterface, args []string
 		Points:  points,
 	}
 	fmt.Println(entity)
-	bytes, err := json.Marshal(entity)
+
+	// Existing entities are only changed through adjustBalance
+	bytes, err := stub.GetState(name)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+name, "")
+	}
+	if bytes != nil {
+		return nil, newError(codeDuplicate, "name", "Entity already exists, use adjustBalance to correct its points or balance", name)
+	}
+
+	bytes, err = json.Marshal(entity)
 	if err != nil {
 		fmt.Println("Error marsalling")
-		return nil, errors.New("Error marshalling")
+		return nil, newError(codeInternal, "", "Error marshalling", "")
 	}
 	fmt.Println(bytes)
 	err = stub.PutState(name, bytes)
@@ -273,7 +374,7 @@ func (t *LoyaltyChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 	fmt.Println("read() is running")
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. expecting 1")
+		return nil, argCountError("1", "read")
 	}
 
 	key := args[0] // name of Entity
@@ -281,18 +382,18 @@ func (t *LoyaltyChaincode) read(stub shim.ChaincodeStubInterface, args []string)
 	bytes, err := stub.GetState(key)
 	if err != nil {
 		fmt.Println("Error retrieving " + key)
-		return nil, errors.New("Error retrieving " + key)
+		return nil, newError(codeLedger, "", "Error retrieving "+key, "")
 	}
 	customer := Entity{}
 	err = json.Unmarshal(bytes, &customer)
 	if err != nil {
 		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling customerBytes", "")
 	}
 	bytes, err = json.Marshal(customer)
 	if err != nil {
 		fmt.Println("Error marshaling customer")
-		return nil, errors.New("Error marshaling customer")
+		return nil, newError(codeInternal, "", "Error marshaling customer", "")
 	}
 
 	fmt.Println(bytes)
@@ -304,7 +405,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 	fmt.Println("buyGoods is running ")
 
 	if len(args) != 6 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 6 for buy goods")
+		return nil, argCountError("6", "buyGoods")
 	}
 	asset := args[0] //points or balance
 	key1 := args[1]  //Entity1 ex: customer
@@ -314,40 +415,40 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 
 	bytes, err := stub.GetState(key1)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key1)
+		return nil, newError(codeLedger, "", "Failed to get state of "+key1, "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeEntityNotFound, "", "Entity not found", key1)
 	}
 	customer := Entity{}
 	err = json.Unmarshal(bytes, &customer)
 	if err != nil {
 		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling customerBytes", "")
 	}
 
 	bytes, err = stub.GetState(key2)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key2)
+		return nil, newError(codeLedger, "", "Failed to get state of "+key2, "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeEntityNotFound, "", "Entity not found", key2)
 	}
 	merchant := Entity{}
 	err = json.Unmarshal(bytes, &merchant)
 	if err != nil {
 		fmt.Println("Error Unmarshaling customerBytes")
-		return nil, errors.New("Error Unmarshaling customerBytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling customerBytes", "")
 	}
 	bytes, err = stub.GetState(key3)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key2)
+		return nil, newError(codeLedger, "", "Failed to get state of "+key3, "")
 	}
 	product := Product{}
 	err = json.Unmarshal(bytes, &product)
 	if err != nil {
 		fmt.Println("Error Unmarshaling product bytes")
-		return nil, errors.New("Error Unmarshaling product Bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling product Bytes", "")
 	}
 	if product.Entity == merchant.Name && product.Qty >= qty {
 		// Perform the transfer
@@ -361,7 +462,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 				args[4] = strconv.Itoa(product.Points * qty)
 				fmt.Printf("customer Points = %d, merchant Points = %d\n", customer.Points, merchant.Points)
 			} else {
-				return nil, errors.New("Insufficient points to buy goods")
+				return nil, newError(codeInsufficientPoints, "", "Insufficient points to buy goods", "")
 			}
 		} else {
 			fmt.Println("balance to be added")
@@ -373,7 +474,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 				args[4] = strconv.FormatFloat(product.Amount*float64(qty), 'f', -1, 64)
 				fmt.Printf("customer Balance = %f, merchant Balance = %f\n", customer.Balance, merchant.Balance)
 			} else {
-				return nil, errors.New("Insufficient balance to buy goods")
+				return nil, newError(codeInsufficientBalance, "", "Insufficient balance to buy goods", "")
 			}
 		}
 		//product.Entity = customer.Name
@@ -381,7 +482,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 		bytes, err = json.Marshal(customer)
 		if err != nil {
 			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+			return nil, newError(codeInternal, "", "Error marshaling customer", "")
 		}
 		err = stub.PutState(key1, bytes)
 		if err != nil {
@@ -392,7 +493,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 		bytes, err = json.Marshal(merchant)
 		if err != nil {
 			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+			return nil, newError(codeInternal, "", "Error marshaling customer", "")
 		}
 		err = stub.PutState(key2, bytes)
 		if err != nil {
@@ -402,7 +503,7 @@ func (t *LoyaltyChaincode) buyGoods(stub shim.ChaincodeStubInterface, args []str
 		bytes, err = json.Marshal(product)
 		if err != nil {
 			fmt.Println("Error marshaling customer")
-			return nil, errors.New("Error marshaling customer")
+			return nil, newError(codeInternal, "", "Error marshaling customer", "")
 		}
 		err = stub.PutState(key3, bytes)
 		if err != nil {
@@ -426,7 +527,7 @@ func (t *LoyaltyChaincode) add(stub shim.ChaincodeStubInterface, args []string)
 	fmt.Println("add is running ")
 
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 3 for add")
+		return nil, argCountError("3", "add")
 	}
 
 	asset := args[0] //points or balance
@@ -436,14 +537,14 @@ func (t *LoyaltyChaincode) add(stub shim.ChaincodeStubInterface, args []string)
 	// GET the state of entity from the ledger
 	bytes, err := stub.GetState(key)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + key)
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
 	}
 
 	entity := Entity{}
 	err = json.Unmarshal(bytes, &entity)
 	if err != nil {
 		fmt.Println("Error Unmarshaling entity Bytes")
-		return nil, errors.New("Error Unmarshaling entity Bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", "")
 	}
 
 	// Perform the addition of assests
@@ -465,7 +566,7 @@ func (t *LoyaltyChaincode) add(stub shim.ChaincodeStubInterface, args []string)
 	bytes, err = json.Marshal(entity)
 	if err != nil {
 		fmt.Println("Error marshaling entity")
-		return nil, errors.New("Error marshaling entity")
+		return nil, newError(codeInternal, "", "Error marshaling entity", "")
 	}
 	err = stub.PutState(key, bytes)
 	if err != nil {
@@ -486,7 +587,7 @@ func (t *LoyaltyChaincode) encashMerchant(stub shim.ChaincodeStubInterface, args
 	fmt.Println("encashMerchant is running ")
 
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 3 for encashMerchant")
+		return nil, argCountError("3", "encashMerchant")
 	}
 
 	points, err := strconv.Atoi(args[2])
@@ -501,7 +602,7 @@ func (t *LoyaltyChaincode) encashMerchant(stub shim.ChaincodeStubInterface, args
 		Initiator: args[0],
 		Bank:      args[1],
 		Points:    points,
-		Amount:    points / 100,
+		Amount:    int(float64(points) / t.getRate(stub, "encash")),
 		Remarks:   "New Request for Encashment",
 		Time:      blockTime.String(),
 	}
@@ -509,7 +610,7 @@ func (t *LoyaltyChaincode) encashMerchant(stub shim.ChaincodeStubInterface, args
 	bytes, err := json.Marshal(txn)
 	if err != nil {
 		fmt.Println("Error marshaling encashMerchant")
-		return nil, errors.New("Error marshaling encashMerchant")
+		return nil, newError(codeInternal, "", "Error marshaling encashMerchant", "")
 	}
 
 	err = stub.PutState(key, bytes)
@@ -525,49 +626,49 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 	fmt.Println("approve is running ")
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 1 for approve")
+		return nil, argCountError("1", "approve")
 	}
 
 	bytes, err := stub.GetState(args[0])
 	if err != nil {
-		return nil, errors.New("Failed to get state of encash key")
+		return nil, newError(codeLedger, "", "Failed to get state of encash key", "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeNotFound, "encashKey", "Encash request not found", args[0])
 	}
 	txn := TxnEncash{}
 	err = json.Unmarshal(bytes, &txn)
 	if err != nil {
 		fmt.Println("Error Unmarshaling TxnEncash")
-		return nil, errors.New("Error Unmarshaling TxnEncash")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling TxnEncash", "")
 	}
 
 	bytes, err = stub.GetState(txn.Initiator)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + txn.Initiator)
+		return nil, newError(codeLedger, "", "Failed to get state of "+txn.Initiator, "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeEntityNotFound, "", "Entity not found", txn.Initiator)
 	}
 	merchant := Entity{}
 	err = json.Unmarshal(bytes, &merchant)
 	if err != nil {
 		fmt.Println("Error Unmarshaling merchant encash")
-		return nil, errors.New("Error Unmarshaling encash merchant")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling encash merchant", "")
 	}
 
 	bytes, err = stub.GetState(txn.Bank)
 	if err != nil {
-		return nil, errors.New("Failed to get state of " + txn.Bank)
+		return nil, newError(codeLedger, "", "Failed to get state of "+txn.Bank, "")
 	}
 	if bytes == nil {
-		return nil, errors.New("Entity not found")
+		return nil, newError(codeEntityNotFound, "", "Entity not found", txn.Bank)
 	}
 	bank := Entity{}
 	err = json.Unmarshal(bytes, &bank)
 	if err != nil {
 		fmt.Println("Error Unmarshaling bank encash")
-		return nil, errors.New("Error Unmarshaling encash bank")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling encash bank", "")
 	}
 
 	// Perform encashment
@@ -580,7 +681,7 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 	bytes, err = json.Marshal(merchant)
 	if err != nil {
 		fmt.Println("Error marshaling merchant")
-		return nil, errors.New("Error marshaling merchant")
+		return nil, newError(codeInternal, "", "Error marshaling merchant", "")
 	}
 	err = stub.PutState(txn.Initiator, bytes)
 	if err != nil {
@@ -591,7 +692,7 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 	bytes, err = json.Marshal(bank)
 	if err != nil {
 		fmt.Println("Error marshaling bank")
-		return nil, errors.New("Error marshaling bank")
+		return nil, newError(codeInternal, "", "Error marshaling bank", "")
 	}
 	err = stub.PutState(txn.Bank, bytes)
 	if err != nil {
@@ -606,7 +707,7 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 	bytes, err = json.Marshal(txn)
 	if err != nil {
 		fmt.Println("Error marshaling TxnGoods")
-		return nil, errors.New("Error marshaling TxnGoods")
+		return nil, newError(codeInternal, "", "Error marshaling TxnGoods", "")
 	}
 	err = stub.PutState(txn.Key, bytes)
 	if err != nil {
@@ -618,9 +719,9 @@ func (t *LoyaltyChaincode) approve(stub shim.ChaincodeStubInterface, args []stri
 
 func (t *LoyaltyChaincode) addProduct(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("adding product information")
-	
+
 	if len(args) != 5 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 5 for addProduct")
+		return nil, argCountError("5", "addProduct")
 	}
 	amt, err := strconv.ParseFloat(args[2], 64)
 	points, err := strconv.Atoi(args[1])
@@ -637,7 +738,7 @@ func (t *LoyaltyChaincode) addProduct(stub shim.ChaincodeStubInterface, args []s
 	bytes, err := json.Marshal(product)
 	if err != nil {
 		fmt.Println("Error marshaling product")
-		return nil, errors.New("Error marshaling product")
+		return nil, newError(codeInternal, "", "Error marshaling product", "")
 	}
 
 	err = stub.PutState(product.Name, bytes)
@@ -658,7 +759,7 @@ func (t *LoyaltyChaincode) addProduct(stub shim.ChaincodeStubInterface, args []s
 	bytes, err = json.Marshal(keys)
 	if err != nil {
 		fmt.Println("Error marshaling product keys")
-		return nil, errors.New("Error marshaling product keys")
+		return nil, newError(codeInternal, "", "Error marshaling product keys", "")
 	}
 	err = stub.PutState("Products", bytes)
 	if err != nil {
@@ -678,13 +779,13 @@ func (t *LoyaltyChaincode) getAllProducts(stub shim.ChaincodeStubInterface) ([]b
 	keysBytes, err := stub.GetState("Products")
 	if err != nil {
 		fmt.Println("Error retrieving Products")
-		return nil, errors.New("Error retrieving Products")
+		return nil, newError(codeLedger, "", "Error retrieving Products", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
 		fmt.Println("Error unmarshalling Products")
-		return nil, errors.New("Error unmarshalling Products")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling Products", "")
 	}
 
 	// Get each product from "Products" keys
@@ -695,7 +796,7 @@ func (t *LoyaltyChaincode) getAllProducts(stub shim.ChaincodeStubInterface) ([]b
 		err = json.Unmarshal(bytes, &product)
 		if err != nil {
 			fmt.Println("Error retrieving product " + value)
-			return nil, errors.New("Error retrieving product " + value)
+			return nil, newError(codeLedger, "", "Error retrieving product "+value, "")
 		}
 
 		fmt.Println("Appending product " + value)
@@ -705,7 +806,7 @@ func (t *LoyaltyChaincode) getAllProducts(stub shim.ChaincodeStubInterface) ([]b
 	bytes, err := json.Marshal(products)
 	if err != nil {
 		fmt.Println("Error marshaling product")
-		return nil, errors.New("Error marshaling product")
+		return nil, newError(codeInternal, "", "Error marshaling product", "")
 	}
 	return bytes, nil
 }
@@ -714,7 +815,7 @@ func (t *LoyaltyChaincode) putTxnTopup(stub shim.ChaincodeStubInterface, args []
 	fmt.Println("putTxnTopup is running ")
 
 	if len(args) != 5 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 5 for putTxnTopup")
+		return nil, argCountError("5", "putTxnTopup")
 	}
 	txn := TxnTopup{
 		Initiator: args[1],
@@ -728,7 +829,7 @@ func (t *LoyaltyChaincode) putTxnTopup(stub shim.ChaincodeStubInterface, args []
 	bytes, err := json.Marshal(txn)
 	if err != nil {
 		fmt.Println("Error marshaling TxnTopup")
-		return nil, errors.New("Error marshaling TxnTopup")
+		return nil, newError(codeInternal, "", "Error marshaling TxnTopup", "")
 	}
 
 	err = stub.PutState(txn.ID, bytes)
@@ -748,13 +849,13 @@ func (t *LoyaltyChaincode) getAllTxnTopup(stub shim.ChaincodeStubInterface) ([]b
 	keysBytes, err := stub.GetState("TxnTopup")
 	if err != nil {
 		fmt.Println("Error retrieving TxnTopup keys")
-		return nil, errors.New("Error retrieving TxnTopup keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnTopup keys", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
 		fmt.Println("Error unmarshalling TxnTopup key")
-		return nil, errors.New("Error unmarshalling TxnTopup keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnTopup keys", "")
 	}
 
 	// Get each product txn "TxnTopup" keys
@@ -765,7 +866,7 @@ func (t *LoyaltyChaincode) getAllTxnTopup(stub shim.ChaincodeStubInterface) ([]b
 		err = json.Unmarshal(bytes, &txn)
 		if err != nil {
 			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
 		}
 
 		fmt.Println("Appending txn" + value)
@@ -775,7 +876,7 @@ func (t *LoyaltyChaincode) getAllTxnTopup(stub shim.ChaincodeStubInterface) ([]b
 	bytes, err := json.Marshal(txns)
 	if err != nil {
 		fmt.Println("Error marshaling txns topup")
-		return nil, errors.New("Error marshaling txns topup")
+		return nil, newError(codeInternal, "", "Error marshaling txns topup", "")
 	}
 	return bytes, nil
 }
@@ -784,7 +885,7 @@ func (t *LoyaltyChaincode) putTxnGoods(stub shim.ChaincodeStubInterface, args []
 	fmt.Println("putTxnGoods is running ")
 
 	if len(args) != 8 {
-		return nil, errors.New("Incorrect Number of arguments.Expecting 8 for putTxnGoods")
+		return nil, argCountError("8", "putTxnGoods")
 	}
 	txn := TxnGoods{
 		Sender:   args[1],
@@ -799,7 +900,7 @@ func (t *LoyaltyChaincode) putTxnGoods(stub shim.ChaincodeStubInterface, args []
 	bytes, err := json.Marshal(txn)
 	if err != nil {
 		fmt.Println("Error marshaling TxnGoods")
-		return nil, errors.New("Error marshaling TxnGoods")
+		return nil, newError(codeInternal, "", "Error marshaling TxnGoods", "")
 	}
 
 	err = stub.PutState(txn.ID, bytes)
@@ -819,13 +920,13 @@ func (t *LoyaltyChaincode) getAllTxnGoods(stub shim.ChaincodeStubInterface) ([]b
 	keysBytes, err := stub.GetState("TxnGoods")
 	if err != nil {
 		fmt.Println("Error retrieving TxnGoods keys")
-		return nil, errors.New("Error retrieving TxnGoods keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnGoods keys", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
 		fmt.Println("Error unmarshalling TxnGoods key")
-		return nil, errors.New("Error unmarshalling TxnGoods keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnGoods keys", "")
 	}
 
 	// Get each txn from "TxnGoods" keys
@@ -836,7 +937,7 @@ func (t *LoyaltyChaincode) getAllTxnGoods(stub shim.ChaincodeStubInterface) ([]b
 		err = json.Unmarshal(bytes, &txn)
 		if err != nil {
 			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
 		}
 
 		fmt.Println("Appending txn goods details " + value)
@@ -846,7 +947,7 @@ func (t *LoyaltyChaincode) getAllTxnGoods(stub shim.ChaincodeStubInterface) ([]b
 	bytes, err := json.Marshal(txns)
 	if err != nil {
 		fmt.Println("Error marshaling txns TxnGoods")
-		return nil, errors.New("Error marshaling txns TxnGoods")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnGoods", "")
 	}
 	return bytes, nil
 }
@@ -860,13 +961,13 @@ func (t *LoyaltyChaincode) getAllTxnEncash(stub shim.ChaincodeStubInterface) ([]
 	keysBytes, err := stub.GetState("TxnEncash")
 	if err != nil {
 		fmt.Println("Error retrieving TxnEncash keys")
-		return nil, errors.New("Error retrieving TxnEncash keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnEncash keys", "")
 	}
 	var keys []string
 	err = json.Unmarshal(keysBytes, &keys)
 	if err != nil {
 		fmt.Println("Error unmarshalling TxnEncash key")
-		return nil, errors.New("Error unmarshalling TxnEncash keys")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnEncash keys", "")
 	}
 
 	// Get each txn from "TxnGoods" keys
@@ -877,7 +978,7 @@ func (t *LoyaltyChaincode) getAllTxnEncash(stub shim.ChaincodeStubInterface) ([]
 		err = json.Unmarshal(bytes, &txn)
 		if err != nil {
 			fmt.Println("Error retrieving txn " + value)
-			return nil, errors.New("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
 		}
 
 		fmt.Println("Appending txn encash details " + value)
@@ -887,7 +988,7 @@ func (t *LoyaltyChaincode) getAllTxnEncash(stub shim.ChaincodeStubInterface) ([]
 	bytes, err := json.Marshal(txns)
 	if err != nil {
 		fmt.Println("Error marshaling txns TxnEncash")
-		return nil, errors.New("Error marshaling txns TxnEncash")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnEncash", "")
 	}
 	return bytes, nil
 }
@@ -907,7 +1008,7 @@ func (t *LoyaltyChaincode) appendKey(stub shim.ChaincodeStubInterface, primeKey
 	bytes, err = json.Marshal(keys)
 	if err != nil {
 		fmt.Println("Error marshaling " + primeKey)
-		return nil, errors.New("Error marshaling keys" + primeKey)
+		return nil, newError(codeInternal, "", "Error marshaling keys"+primeKey, "")
 	}
 	err = stub.PutState(primeKey, bytes)
 	if err != nil {
@@ -915,3 +1016,303 @@ func (t *LoyaltyChaincode) appendKey(stub shim.ChaincodeStubInterface, primeKey
 	}
 	return nil, nil
 }
+
+// isAdmin - checks the role attribute of the caller's certificate, or its
+// enrollment ID against the admins listed in the genesis document
+func (t *LoyaltyChaincode) isAdmin(stub shim.ChaincodeStubInterface) bool {
+	role, err := stub.ReadCertAttribute("role")
+	if err == nil && string(role) == "admin" {
+		return true
+	}
+
+	enrollmentID, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil {
+		fmt.Println("Error reading enrollmentId attribute of caller")
+		return false
+	}
+	bytes, err := stub.GetState("Admins")
+	if err != nil || bytes == nil {
+		return false
+	}
+	var admins []string
+	err = json.Unmarshal(bytes, &admins)
+	if err != nil {
+		fmt.Println("Error unmarshalling Admins")
+		return false
+	}
+	for _, admin := range admins {
+		if admin == string(enrollmentID) {
+			return true
+		}
+	}
+	return false
+}
+
+// adjustBalance - admin invoke function for an audited correction of an entity's points or balance
+func (t *LoyaltyChaincode) adjustBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("adjustBalance is running ")
+
+	/*
+	   args[] - {entity, asset, delta, reasonCode, note}
+	   delta - signed amount, negative to debit the entity
+	   The calling admin's enrollmentId is recorded as the approver.
+	*/
+	if len(args) != 5 {
+		return nil, argCountError("5", "adjustBalance")
+	}
+	if !t.isAdmin(stub) {
+		return nil, newError(codeNotAuthorized, "", "Only an admin can adjust balances", "")
+	}
+	approver, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil || len(approver) == 0 {
+		return nil, newError(codeNotAuthorized, "", "Caller has no enrollmentId to record as approver", "")
+	}
+	key := args[0]
+	asset := args[1]
+	reasonCode := args[3]
+	if asset != "points" && asset != "balance" {
+		return nil, newError(codeBadArgument, "asset", "Asset must be points or balance", asset)
+	}
+	validReason := false
+	for _, reason := range adjustmentReasons {
+		if reason == reasonCode {
+			validReason = true
+		}
+	}
+	if !validReason {
+		return nil, newError(codeBadArgument, "reasonCode", "Unknown reason code for adjustBalance", reasonCode)
+	}
+
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(codeLedger, "", "Failed to get state of "+key, "")
+	}
+	if bytes == nil {
+		return nil, newError(codeEntityNotFound, "", "Entity not found", key)
+	}
+	entity := Entity{}
+	err = json.Unmarshal(bytes, &entity)
+	if err != nil {
+		fmt.Println("Error Unmarshaling entity Bytes")
+		return nil, newError(codeCorruptRecord, "", "Error Unmarshaling entity Bytes", "")
+	}
+
+	// Perform the adjustment
+	if asset == "points" {
+		delta, err := strconv.Atoi(args[2])
+		if err != nil || delta == 0 {
+			return nil, newError(codeBadArgument, "delta", "Invalid delta for adjustBalance", args[2])
+		}
+		if entity.Points+delta < 0 {
+			return nil, newError(codeInsufficientPoints, "delta", "Adjustment would make points negative", args[2])
+		}
+		entity.Points = entity.Points + delta
+	} else {
+		delta, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || delta == 0 {
+			return nil, newError(codeBadArgument, "delta", "Invalid delta for adjustBalance", args[2])
+		}
+		if entity.Balance+delta < 0 {
+			return nil, newError(codeInsufficientBalance, "delta", "Adjustment would make balance negative", args[2])
+		}
+		entity.Balance = entity.Balance + delta
+	}
+
+	bytes, err = json.Marshal(entity)
+	if err != nil {
+		fmt.Println("Error marshaling entity")
+		return nil, newError(codeInternal, "", "Error marshaling entity", "")
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	blockTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	txn := TxnAdjustment{
+		ID:         stub.GetTxID(),
+		Entity:     key,
+		Asset:      asset,
+		Delta:      args[2],
+		ReasonCode: reasonCode,
+		Note:       args[4],
+		Approver:   string(approver),
+		Time:       blockTime.String(),
+	}
+	bytes, err = json.Marshal(txn)
+	if err != nil {
+		fmt.Println("Error marshaling TxnAdjustment")
+		return nil, newError(codeInternal, "", "Error marshaling TxnAdjustment", "")
+	}
+	err = stub.PutState(txn.ID, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.appendKey(stub, "TxnAdjustment", txn.ID)
+}
+
+func (t *LoyaltyChaincode) getAllTxnAdjustment(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	fmt.Println("getAllTxnAdjustment is running ")
+
+	var txns []TxnAdjustment
+
+	// Get list of all the keys - TxnAdjustment
+	keysBytes, err := stub.GetState("TxnAdjustment")
+	if err != nil {
+		fmt.Println("Error retrieving TxnAdjustment keys")
+		return nil, newError(codeLedger, "", "Error retrieving TxnAdjustment keys", "")
+	}
+	var keys []string
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling TxnAdjustment key")
+		return nil, newError(codeCorruptRecord, "", "Error unmarshalling TxnAdjustment keys", "")
+	}
+
+	// Get each txn from "TxnAdjustment" keys
+	for _, value := range keys {
+		bytes, err := stub.GetState(value)
+
+		var txn TxnAdjustment
+		err = json.Unmarshal(bytes, &txn)
+		if err != nil {
+			fmt.Println("Error retrieving txn " + value)
+			return nil, newError(codeLedger, "", "Error retrieving txn "+value, "")
+		}
+
+		fmt.Println("Appending txn adjustment details " + value)
+		txns = append(txns, txn)
+	}
+
+	bytes, err := json.Marshal(txns)
+	if err != nil {
+		fmt.Println("Error marshaling txns TxnAdjustment")
+		return nil, newError(codeInternal, "", "Error marshaling txns TxnAdjustment", "")
+	}
+	return bytes, nil
+}
+
+// demoGenesis - the demo customer, merchant, bank and products
+func demoGenesis(customer string, merchant string, bank string) Genesis {
+	return Genesis{
+		Entities: []Entity{
+			{Type: "customer", Name: customer, Balance: 3000, Points: 3000},
+			{Type: "merchant", Name: merchant, Balance: 6000, Points: 6000},
+			{Type: "bank", Name: bank, Balance: 10000, Points: 10000},
+		},
+		Products: []Product{
+			{Name: "Speakers", Points: 2000, Amount: 200, Entity: merchant, Qty: 100},
+			{Name: "Headphones", Points: 3000, Amount: 300, Entity: merchant, Qty: 100},
+			{Name: "Mobile", Points: 4000, Amount: 400, Entity: merchant, Qty: 100},
+			{Name: "BagPack", Points: 1000, Amount: 100, Entity: merchant, Qty: 100},
+		},
+		Rates:  map[string]float64{"encash": 100},
+		Admins: []string{},
+	}
+}
+
+// validateGenesis - checks a genesis document before Init writes any of it
+func validateGenesis(genesis Genesis) error {
+	if len(genesis.Entities) == 0 {
+		return newError(codeBadArgument, "entities", "Genesis document has no entities", "")
+	}
+
+	types := make(map[string]string)
+	for _, entity := range genesis.Entities {
+		if entity.Name == "" {
+			return newError(codeBadArgument, "entities", "Genesis entity without a name", "")
+		}
+		if _, ok := types[entity.Name]; ok {
+			return newError(codeBadArgument, "entities", "Duplicate genesis entity", entity.Name)
+		}
+		if entity.Type != "customer" && entity.Type != "merchant" && entity.Type != "bank" {
+			return newError(codeBadArgument, "entities", "Unknown type "+entity.Type+" for genesis entity", entity.Name)
+		}
+		if entity.Balance < 0 || entity.Points < 0 {
+			return newError(codeBadArgument, "entities", "Negative points or balance for genesis entity", entity.Name)
+		}
+		types[entity.Name] = entity.Type
+	}
+
+	products := make(map[string]bool)
+	for _, product := range genesis.Products {
+		if product.Name == "" {
+			return newError(codeBadArgument, "products", "Genesis product without a name", "")
+		}
+		if products[product.Name] {
+			return newError(codeBadArgument, "products", "Duplicate genesis product", product.Name)
+		}
+		if _, ok := types[product.Name]; ok {
+			return newError(codeBadArgument, "products", "Genesis product has the name of an entity", product.Name)
+		}
+		if types[product.Entity] != "merchant" {
+			return newError(codeBadArgument, "products", "Genesis product is not sold by a genesis merchant", product.Name)
+		}
+		if product.Points < 0 || product.Amount < 0 || product.Qty < 0 {
+			return newError(codeBadArgument, "products", "Invalid price or quantity for genesis product", product.Name)
+		}
+		products[product.Name] = true
+	}
+
+	for name, rate := range genesis.Rates {
+		if name != "encash" {
+			return newError(codeBadArgument, "rates", "Unknown genesis rate", name)
+		}
+		if rate <= 0 {
+			return newError(codeBadArgument, "rates", "Genesis rate must be positive", name)
+		}
+	}
+
+	for _, admin := range genesis.Admins {
+		if admin == "" {
+			return newError(codeBadArgument, "admins", "Empty genesis admin identity", "")
+		}
+	}
+	return nil
+}
+
+// putGenesisConfig - writes the rates and admin identities of a genesis document
+func (t *LoyaltyChaincode) putGenesisConfig(stub shim.ChaincodeStubInterface, genesis Genesis) error {
+	rates := map[string]float64{"encash": 100}
+	for name, rate := range genesis.Rates {
+		rates[name] = rate
+	}
+	bytes, err := json.Marshal(rates)
+	if err != nil {
+		fmt.Println("Error marshaling rates")
+		return newError(codeInternal, "", "Error marshaling rates", "")
+	}
+	err = stub.PutState("Rates", bytes)
+	if err != nil {
+		return err
+	}
+
+	admins := genesis.Admins
+	if admins == nil {
+		admins = []string{}
+	}
+	bytes, err = json.Marshal(admins)
+	if err != nil {
+		fmt.Println("Error marshaling admins")
+		return newError(codeInternal, "", "Error marshaling admins", "")
+	}
+	return stub.PutState("Admins", bytes)
+}
+
+// getRate - reads a rate set at Init, 100 points per unit when it is missing
+func (t *LoyaltyChaincode) getRate(stub shim.ChaincodeStubInterface, name string) float64 {
+	bytes, err := stub.GetState("Rates")
+	if err != nil || bytes == nil {
+		return 100
+	}
+	rates := make(map[string]float64)
+	err = json.Unmarshal(bytes, &rates)
+	if err != nil || rates[name] <= 0 {
+		return 100
+	}
+	return rates[name]
+}
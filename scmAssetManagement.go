@@ -7,19 +7,18 @@ import (
 	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"github.com/hyperledger/fabric/protos/peer"
 )
 
 // Account - Structure for an entity account
 type Account struct {
-	AccountNum           string             `json:"num"` //key for rocksDB
+	AccountNum    string             `json:"num"` //key for rocksDB
 	AssetBalances map[string]float64 `json:"assets"`
 }
 
 // User - Structure for an entity
 type User struct {
-	UserID   string             `json:"userId"` //key for rocksDB
-	UserName string             `json:"userName"`
+	UserID   string   `json:"userId"` //key for rocksDB
+	UserName string   `json:"userName"`
 	Accounts []string `json:"accounts"`
 }
 
@@ -42,28 +41,28 @@ const assetNamesKey = "assetNames"
 var docMeta = make(map[string]string)
 
 // Init resets all the things
-func (t *AssetMgmt) Init(stub shim.ChaincodeStubInterface) peer.Response {
-	return shim.Success(nil)
+func (t *AssetMgmt) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	return nil, nil
 }
 
 // initLedger
-func (t *AssetMgmt) initLedger(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	
+func (t *AssetMgmt) initLedger(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
 	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
 	}
-		
+
 	accounts := []Account{
 		Account{AccountNum: "", AssetBalances: map[string]float64{"T2Parts": 1000}},
 		Account{AccountNum: "", AssetBalances: map[string]float64{"T1Parts": 1000, "T2Parts": 100}},
-		Account{AccountNum: "", AssetBalances: map[string]{"OEMParts": 1000, "T1Parts": 100}},
+		Account{AccountNum: "", AssetBalances: map[string]float64{"OEMParts": 1000, "T1Parts": 100}},
 		Account{AccountNum: "", AssetBalances: map[string]float64{"OEMParts": 100}},
 	}
 	i := 0
 	for i < len(accounts) {
 		fmt.Println("i is ", i)
 		NumAccounts++
-		accountNum := "Account-"+strconv.Itoa(NumAccounts)
+		accountNum := "Account-" + strconv.Itoa(NumAccounts)
 		accounts[i].AccountNum = accountNum
 		t.saveInBlockchain(stub, accountNum, accounts[i])
 		fmt.Println("Saved to ledger", accounts[i])
@@ -73,21 +72,20 @@ func (t *AssetMgmt) initLedger(stub shim.ChaincodeStubInterface, args []string)
 	fmt.Println("Initializing keys collection")
 	var blank []string
 	blankBytes, _ := json.Marshal(&blank)
-	err = stub.PutState(assetNamesKey, blankBytes)
+	err := stub.PutState(assetNamesKey, blankBytes)
 	if err != nil {
 		fmt.Println("Failed to initialize Products key collection")
 	}
-	
+
 	t.appendKey(stub, assetNamesKey, "T2Parts")
 	t.appendKey(stub, assetNamesKey, "T1Parts")
 	t.appendKey(stub, assetNamesKey, "OEMParts")
-	
-	return shim.Success(nil)
+
+	return nil, nil
 }
 
 // Invoke is entry point to invoke a chaincode function
-func (t *AssetMgmt) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
-	function, args := stub.GetFunctionAndParameters()
+func (t *AssetMgmt) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
 
 	// Handle different functions/transactions
@@ -108,30 +106,39 @@ func (t *AssetMgmt) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 	} else if function == "produce" {
 		return t.produce(stub, args)
 	}
+	fmt.Println("invoke did not find func: " + function)
+	return nil, errors.New("Received unknown function invocation: " + function)
+}
+
+// Query is entry point for queries
+func (t *AssetMgmt) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	fmt.Println("query is running " + function)
+
+	// Handle different functions
 	if function == "getEntity" {
 		return t.read(stub, args)
 	} else if function == "getAssetTypes" {
 		return t.getAssetTypes(stub, args)
 	}
-	fmt.Println("invoke did not find func: " + function)
-	return shim.Error("Received unknown function invocation: " + function)
+	fmt.Println("query did not find func: " + function)
+	return nil, errors.New("Received unknown function query: " + function)
 }
 
-func (t *AssetMgmt) createUser(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *AssetMgmt) createUser(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	userID := args[0]
 	user := User{
-		UserID : userID,
-		UserName : args[1],
-		Accounts : []string{}
+		UserID:   userID,
+		UserName: args[1],
+		Accounts: []string{},
 	}
 
 	// Write the state to the ledger
-	t.saveInBlockchain(stub, userID, user)
-	
+	return t.saveInBlockchain(stub, userID, user)
 }
+
 // write - invoke function to write new key/value pair ex: Account
-func (t *AssetMgmt) createAccount(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *AssetMgmt) createAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("running createAccount()")
 	userID := args[0]
 
@@ -139,44 +146,44 @@ func (t *AssetMgmt) createAccount(stub shim.ChaincodeStubInterface, args []strin
 	bytes, err := stub.GetState(userID)
 	user := User{}
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 	if bytes == nil {
-		return shim.Error("User not found")
+		return nil, errors.New("User not found")
 	}
 	err = json.Unmarshal(bytes, &user)
 	if err != nil {
 		fmt.Println("Error Unmarshaling account ")
-		return shim.Error("Error Unmarshaling account")
+		return nil, errors.New("Error Unmarshaling account")
 	}
 
 	// crerateAccount
 	assets := make(map[string]float64)
 	NumAccounts++
-	accountNum := "Account-"+strconv.Itoa(NumAccounts)
- 	account := Account{
-		AccountNum: accountNum,
+	accountNum := "Account-" + strconv.Itoa(NumAccounts)
+	account := Account{
+		AccountNum:    accountNum,
 		AssetBalances: assets,
 	}
 
 	// Write the acct state to the ledger
-	bytes, err := t.saveInBlockchain(stub, accountNum, account)
+	_, err = t.saveInBlockchain(stub, accountNum, account)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
-	user.Accounts =append(user.Accounts,accountNum)
+	user.Accounts = append(user.Accounts, accountNum)
 	// Write the user state to the ledger
-	bytes, err := t.saveInBlockchain(stub, userID, user)
+	_, err = t.saveInBlockchain(stub, userID, user)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
-	return shim.Success(nil)
+	return nil, nil
 }
 
 // read - query function to read key/value pair
-func (t *AssetMgmt) read(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *AssetMgmt) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("read() is running")
 
 	key := args[0] // name of Account
@@ -184,29 +191,29 @@ func (t *AssetMgmt) read(stub shim.ChaincodeStubInterface, args []string) peer.R
 	bytes, err := stub.GetState(key)
 	if err != nil {
 		fmt.Println("Error retrieving " + key)
-		return shim.Error("Error retrieving " + key)
+		return nil, errors.New("Error retrieving " + key)
 	}
 
 	fmt.Println(bytes)
-	return shim.Success(bytes)
+	return bytes, nil
 }
 
 // getAssetTypes - query function to return the asset-types for this chain
-func (t *AssetMgmt) getAssetTypes(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *AssetMgmt) getAssetTypes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("getAssetTypes() is running")
 
 	bytes, err := stub.GetState(assetNamesKey)
 	if err != nil {
 		fmt.Println("Error retrieving ")
-		return shim.Error("Error retrieving ")
+		return nil, errors.New("Error retrieving ")
 	}
 
 	fmt.Println(bytes)
-	return shim.Success(bytes)
+	return bytes, nil
 }
 
 // add - invoke funcrion to add/issue assets to an account
-func (t *AssetMgmt) issueMore(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *AssetMgmt) issueMore(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	fmt.Println("issueMore is running ")
 
@@ -215,13 +222,13 @@ func (t *AssetMgmt) issueMore(stub shim.ChaincodeStubInterface, args []string) p
 	amt, err := strconv.ParseFloat(args[2], 64) //qty
 
 	if t.isAssetCreated(stub, assetName) == false {
-		return shim.Error("Asset not created")
+		return nil, errors.New("Asset not created")
 	}
 
 	// GET the state of account from the ledger
 	account, err := t.getAccount(stub, accountNum)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
 	// Perform the addition of assests
@@ -232,11 +239,12 @@ func (t *AssetMgmt) issueMore(stub shim.ChaincodeStubInterface, args []string) p
 	// Write the state back to the ledger
 	t.saveInBlockchain(stub, accountNum, account)
 
-	return shim.Success(nil)
+	return nil, nil
 }
 
 //transfer - function to transfer an asset between any two entities
-func (t *AssetMgmt) transfer(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+//no caller check is made, so any invoker can move assets out of any account
+func (t *AssetMgmt) transfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	fmt.Println("transfer is running ")
 
@@ -248,13 +256,13 @@ func (t *AssetMgmt) transfer(stub shim.ChaincodeStubInterface, args []string) pe
 	// GET the state of fromAccount from the ledger
 	fromAccount, err := t.getAccount(stub, fromAccountNum)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
 	// GET the state of toAccount from the ledger
 	toAccount, err := t.getAccount(stub, toAccountNum)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
 	//Perform transfer of Asset
@@ -264,7 +272,7 @@ func (t *AssetMgmt) transfer(stub shim.ChaincodeStubInterface, args []string) pe
 		fmt.Println("account asset balance = ", toAccount.AssetBalances[assetName])
 		fromAccount.AssetBalances[assetName] = fromAccount.AssetBalances[assetName] - amt
 	} else {
-		return shim.Error("Insufficient assets - transfer")
+		return nil, errors.New("Insufficient assets - transfer")
 	}
 
 	// Write the state back to the ledger
@@ -277,20 +285,20 @@ func (t *AssetMgmt) transfer(stub shim.ChaincodeStubInterface, args []string) pe
 	bytes, err := json.Marshal(remarks)
 	if err != nil {
 		fmt.Println("Error marshaling remarks")
-		return shim.Error("Error marshaling remarks")
+		return nil, errors.New("Error marshaling remarks")
 	}
 	err = stub.PutState(txID, bytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
 	t.appendKey(stub, transactionKey, txID)
 
-	return shim.Success(nil)
+	return nil, nil
 }
 
 //exchange - function - exchange of any two assets between two entities
-func (t *AssetMgmt) exchange(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *AssetMgmt) exchange(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("exchange is running ")
 
 	assetName1 := args[1]
@@ -301,13 +309,13 @@ func (t *AssetMgmt) exchange(stub shim.ChaincodeStubInterface, args []string) pe
 	// GET the state of Account1 from the ledger
 	account1, err := t.getAccount(stub, args[0])
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
 	// GET the state of Account2 from the ledger
 	account2, err := t.getAccount(stub, args[3])
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
 	// Perform exchange
@@ -317,7 +325,7 @@ func (t *AssetMgmt) exchange(stub shim.ChaincodeStubInterface, args []string) pe
 		account2.AssetBalances[assetName2] = account2.AssetBalances[assetName2] - amt2
 		account1.AssetBalances[assetName2] = account1.AssetBalances[assetName2] + amt2
 	} else {
-		return shim.Error("Insufficient assets")
+		return nil, errors.New("Insufficient assets")
 	}
 
 	// Write the account1 state back to the ledger
@@ -326,7 +334,7 @@ func (t *AssetMgmt) exchange(stub shim.ChaincodeStubInterface, args []string) pe
 	// Write the account2 state back to the ledger
 	t.saveInBlockchain(stub, args[3], account2)
 
-	return shim.Success(nil)
+	return nil, nil
 }
 
 func (t *AssetMgmt) isAssetCreated(stub shim.ChaincodeStubInterface, key string) bool {
@@ -342,7 +350,7 @@ func (t *AssetMgmt) isAssetCreated(stub shim.ChaincodeStubInterface, key string)
 	return false
 }
 
-func (t *AssetMgmt) createAsset(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *AssetMgmt) createAsset(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("createAsset is running.")
 
 	/*
@@ -356,11 +364,11 @@ func (t *AssetMgmt) createAsset(stub shim.ChaincodeStubInterface, args []string)
 	// GET the state of Account from the ledger
 	account, err := t.getAccount(stub, accountNum)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
 	if t.isAssetCreated(stub, assetName) == true {
-		return shim.Error("Asset already created")
+		return nil, errors.New("Asset already created")
 	}
 
 	account.AssetBalances[assetName] = qty
@@ -371,7 +379,7 @@ func (t *AssetMgmt) createAsset(stub shim.ChaincodeStubInterface, args []string)
 }
 
 //produce - function - use one asset to produce another asset
-func (t *AssetMgmt) produce(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *AssetMgmt) produce(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	fmt.Println("produce is running ")
 
@@ -388,7 +396,7 @@ func (t *AssetMgmt) produce(stub shim.ChaincodeStubInterface, args []string) pee
 	// GET the state of Account from the ledger
 	account, err := t.getAccount(stub, accountNum)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
 	// Perform production :D
@@ -396,32 +404,32 @@ func (t *AssetMgmt) produce(stub shim.ChaincodeStubInterface, args []string) pee
 		account.AssetBalances[assetName1] = account.AssetBalances[assetName1] - amt1
 		account.AssetBalances[assetName2] = account.AssetBalances[assetName2] + amt2
 	} else {
-		return shim.Error("Insufficient assets - produce")
+		return nil, errors.New("Insufficient assets - produce")
 	}
 
 	// Write the account1 state back to the ledger
 	t.saveInBlockchain(stub, accountNum, account)
 
-	return shim.Success(nil)
+	return nil, nil
 }
 
-func (t *AssetMgmt) appendKey(stub shim.ChaincodeStubInterface, primeKey string, key string) peer.Response {
+func (t *AssetMgmt) appendKey(stub shim.ChaincodeStubInterface, primeKey string, key string) ([]byte, error) {
 	fmt.Println("appendKey is running " + primeKey + " " + key)
 
 	bytes, err := stub.GetState(primeKey)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 	var keys []string
 	err = json.Unmarshal(bytes, &keys)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 	keys = append(keys, key)
 
 	t.saveInBlockchain(stub, primeKey, keys)
 
-	return shim.Success(nil)
+	return nil, nil
 }
 
 func (t *AssetMgmt) saveInBlockchain(stub shim.ChaincodeStubInterface, key string, value interface{}) ([]byte, error) {